@@ -0,0 +1,610 @@
+// Package config loads Voryn's settings. Values come from the defaults below,
+// then a YAML file, then environment variables, then command-line flags, each
+// overriding the last.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultFile = "voryn.yaml"
+
+type Config struct {
+	Listen   ListenConfig    `yaml:"listen"`
+	XMPP     XMPPConfig      `yaml:"xmpp"`
+	Hosts    []HostConfig    `yaml:"hosts"`
+	TLS      TLSConfig       `yaml:"tls"`
+	Admin    AdminConfig     `yaml:"admin"`
+	Storage  StorageConfig   `yaml:"storage"`
+	Mongo    MongoConfig     `yaml:"mongo"`
+	Cache    CacheConfig     `yaml:"cache"`
+	Cluster  ClusterConfig   `yaml:"cluster"`
+	Limits   LimitsConfig    `yaml:"limits"`
+	Timeouts TimeoutsConfig  `yaml:"timeouts"`
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	Features FeaturesConfig  `yaml:"features"`
+	Log      LogConfig       `yaml:"log"`
+	Tracing  TracingConfig   `yaml:"tracing"`
+	Messages MessagesConfig  `yaml:"messages"`
+}
+
+// ListenConfig sets where Voryn listens. TrustedProxies lists the addresses
+// or CIDR ranges of reverse proxies whose X-Forwarded-For header is believed;
+// with none, the client address is the peer address of the connection.
+type ListenConfig struct {
+	Address        string   `yaml:"address"`
+	TrustedProxies []string `yaml:"trustedProxies"`
+}
+
+type XMPPConfig struct {
+	Domain string `yaml:"domain"`
+}
+
+// HostConfig is another domain served by the same process, with its own
+// sessions and database. Streams pick a host with the "to" attribute of their
+// opening element. Admin keys listed here only give access to this host, on
+// top of the top-level keys that give access to all of them.
+type HostConfig struct {
+	Domain   string             `yaml:"domain"`
+	Database string             `yaml:"database"`
+	Admin    AdminConfig        `yaml:"admin"`
+	Features HostFeaturesConfig `yaml:"features"`
+}
+
+// HostFeaturesConfig overrides features for one host. Unset toggles follow the
+// top-level features.
+type HostFeaturesConfig struct {
+	Outbox *bool `yaml:"outbox,omitempty"`
+}
+
+// VirtualHost is a domain served by the process with its settings resolved.
+type VirtualHost struct {
+	Domain    string
+	Database  string
+	AdminKeys []string
+	Outbox    bool
+}
+
+// TLSConfig enables HTTPS and WSS when both files are set.
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+type AdminConfig struct {
+	APIKeys []string `yaml:"apiKeys"`
+}
+
+type StorageConfig struct {
+	Backend string `yaml:"backend"`
+	// Seed is a JSON file of users and friends the memory backend starts with.
+	Seed string `yaml:"seed"`
+}
+
+type MongoConfig struct {
+	URI            string `yaml:"uri"`
+	Database       string `yaml:"database"`
+	ConnectRetries int    `yaml:"connectRetries"`
+	FailFast       bool   `yaml:"failFast"`
+}
+
+// CacheConfig sizes the user and friend list caches. A zero TTL disables them.
+type CacheConfig struct {
+	TTL  time.Duration `yaml:"ttl"`
+	Size int           `yaml:"size"`
+}
+
+// ClusterConfig lets several nodes share sessions through the session
+// directory in the database. It is enabled by setting Advertise, the base URL
+// other nodes reach this one on. NodeID defaults to the host name.
+type ClusterConfig struct {
+	NodeID    string        `yaml:"nodeId"`
+	Advertise string        `yaml:"advertise"`
+	Secret    string        `yaml:"secret"`
+	Heartbeat time.Duration `yaml:"heartbeat"`
+}
+
+type LimitsConfig struct {
+	BroadcastConcurrency int   `yaml:"broadcastConcurrency"`
+	OutboundQueue        int   `yaml:"outboundQueue"`
+	MaxStanzaBytes       int64 `yaml:"maxStanzaBytes"`
+}
+
+// TimeoutsConfig holds the server's timeouts. A zero AutoAway disables idle
+// detection. Shutdown bounds how long a stopping server waits for sessions to
+// close and webhooks to be delivered. Drain is how long a server that handed
+// its listener to a new process takes to close its sessions. Resume is how
+// long a session with XEP-0198 resumption waits for its client to reconnect;
+// zero turns resumption off.
+type TimeoutsConfig struct {
+	Write    time.Duration `yaml:"write"`
+	AutoAway time.Duration `yaml:"autoAway"`
+	Shutdown time.Duration `yaml:"shutdown"`
+	Drain    time.Duration `yaml:"drain"`
+	Resume   time.Duration `yaml:"resume"`
+}
+
+type WebhookConfig struct {
+	URL    string   `yaml:"url"`
+	Events []string `yaml:"events"`
+	Secret string   `yaml:"secret"`
+}
+
+type FeaturesConfig struct {
+	Outbox  bool `yaml:"outbox"`
+	Metrics bool `yaml:"metrics"`
+}
+
+// LogConfig sets the lowest level that is logged (debug, info, warning or
+// error) and whether lines are written as text or JSON.
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// TracingConfig turns on OpenTelemetry tracing. Exporter is "otlp", which
+// sends spans over OTLP/HTTP to Endpoint, or "stdout"; empty disables tracing.
+// SampleRatio is the share of new traces that are recorded; traces continued
+// from a caller follow the caller's sampling decision.
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter"`
+	Endpoint    string  `yaml:"endpoint"`
+	ServiceName string  `yaml:"serviceName"`
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+// MessagesConfig holds the texts sent to players when a login is refused.
+// "{seconds}" in KickCooldown is replaced with the time left.
+type MessagesConfig struct {
+	Banned       string `yaml:"banned"`
+	KickCooldown string `yaml:"kickCooldown"`
+}
+
+// Default returns the settings Voryn runs with when nothing is configured.
+func Default() *Config {
+	return &Config{
+		Listen:  ListenConfig{Address: ":5000"},
+		XMPP:    XMPPConfig{Domain: "prod.ol.epicgames.com"},
+		Storage: StorageConfig{Backend: "mongo"},
+		Mongo:   MongoConfig{ConnectRetries: 5},
+		Cache:   CacheConfig{TTL: 5 * time.Minute, Size: 10000},
+		Cluster: ClusterConfig{Heartbeat: 5 * time.Second},
+		Limits: LimitsConfig{
+			BroadcastConcurrency: 32,
+			OutboundQueue:        256,
+			MaxStanzaBytes:       1 << 20,
+		},
+		Timeouts: TimeoutsConfig{Write: 5 * time.Second, Shutdown: 15 * time.Second, Drain: time.Minute, Resume: 2 * time.Minute},
+		Features: FeaturesConfig{Metrics: true},
+		Log:      LogConfig{Level: "debug", Format: "text"},
+		Tracing: TracingConfig{
+			Endpoint:    "http://localhost:4318/v1/traces",
+			ServiceName: "voryn",
+			SampleRatio: 1,
+		},
+		Messages: MessagesConfig{
+			Banned:       "This account is banned",
+			KickCooldown: "Kicked, try again in {seconds} seconds",
+		},
+	}
+}
+
+// Load builds the configuration from the config file, the environment and
+// args, then validates it. The file is named by the -config flag or
+// VORYN_CONFIG, and voryn.yaml is read if present when neither is set.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("voryn", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("VORYN_CONFIG"), "path to the YAML config file")
+	listen := fs.String("listen", "", "address to listen on, e.g. :5000")
+	domain := fs.String("domain", "", "XMPP domain")
+	backend := fs.String("storage", "", "storage backend (mongo or memory)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := cfg.readFile(*path); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(defaultFile); err == nil {
+		if err := cfg.readFile(defaultFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if *listen != "" {
+		cfg.Listen.Address = *listen
+	}
+	if *domain != "" {
+		cfg.XMPP.Domain = *domain
+	}
+	if *backend != "" {
+		cfg.Storage.Backend = *backend
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides the file with the environment variables Voryn has always
+// read from .env, plus a few for settings that used to be fixed.
+func (c *Config) applyEnv() error {
+	var errs []error
+	str := func(name string, dst *string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	list := func(name string, dst *[]string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = SplitList(v)
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v := os.Getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = b
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = n
+		}
+	}
+	duration := func(name string, dst *time.Duration) {
+		if v := os.Getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return
+			}
+			*dst = d
+		}
+	}
+
+	if port := os.Getenv("PORT"); port != "" {
+		c.Listen.Address = ":" + port
+	}
+	list("TRUSTED_PROXIES", &c.Listen.TrustedProxies)
+	str("XMPP_DOMAIN", &c.XMPP.Domain)
+	str("TLS_CERT_FILE", &c.TLS.CertFile)
+	str("TLS_KEY_FILE", &c.TLS.KeyFile)
+	list("ADMIN_API_KEYS", &c.Admin.APIKeys)
+	str("STORAGE_BACKEND", &c.Storage.Backend)
+	str("STORAGE_SEED", &c.Storage.Seed)
+	str("MONGO_URI", &c.Mongo.URI)
+	str("DB_NAME", &c.Mongo.Database)
+	integer("MONGO_CONNECT_RETRIES", &c.Mongo.ConnectRetries)
+	boolean("MONGO_FAIL_FAST", &c.Mongo.FailFast)
+	duration("CACHE_TTL", &c.Cache.TTL)
+	integer("CACHE_SIZE", &c.Cache.Size)
+	str("CLUSTER_NODE_ID", &c.Cluster.NodeID)
+	str("CLUSTER_ADVERTISE", &c.Cluster.Advertise)
+	str("CLUSTER_SECRET", &c.Cluster.Secret)
+	duration("CLUSTER_HEARTBEAT", &c.Cluster.Heartbeat)
+	integer("BROADCAST_CONCURRENCY", &c.Limits.BroadcastConcurrency)
+	integer("OUTBOUND_QUEUE_SIZE", &c.Limits.OutboundQueue)
+	if v := os.Getenv("MAX_STANZA_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("MAX_STANZA_BYTES: %w", err))
+		} else {
+			c.Limits.MaxStanzaBytes = n
+		}
+	}
+	duration("WRITE_TIMEOUT", &c.Timeouts.Write)
+	duration("AUTO_AWAY_AFTER", &c.Timeouts.AutoAway)
+	duration("SHUTDOWN_TIMEOUT", &c.Timeouts.Shutdown)
+	duration("DRAIN_TIMEOUT", &c.Timeouts.Drain)
+	duration("RESUME_TIMEOUT", &c.Timeouts.Resume)
+	boolean("OUTBOX_ENABLED", &c.Features.Outbox)
+	boolean("METRICS_ENABLED", &c.Features.Metrics)
+	str("LOG_LEVEL", &c.Log.Level)
+	str("LOG_FORMAT", &c.Log.Format)
+	str("TRACING_EXPORTER", &c.Tracing.Exporter)
+	str("TRACING_ENDPOINT", &c.Tracing.Endpoint)
+	str("TRACING_SERVICE_NAME", &c.Tracing.ServiceName)
+	if v := os.Getenv("TRACING_SAMPLE_RATIO"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("TRACING_SAMPLE_RATIO: %w", err))
+		} else {
+			c.Tracing.SampleRatio = f
+		}
+	}
+
+	// WEBHOOK_URLS replaces the webhooks from the file; the events and secret
+	// apply to every URL.
+	if urls := SplitList(os.Getenv("WEBHOOK_URLS")); len(urls) > 0 {
+		c.Webhooks = nil
+		for _, u := range urls {
+			c.Webhooks = append(c.Webhooks, WebhookConfig{
+				URL:    u,
+				Events: SplitList(os.Getenv("WEBHOOK_EVENTS")),
+				Secret: os.Getenv("WEBHOOK_SECRET"),
+			})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate reports every setting that Voryn can't run with.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Listen.Address == "" {
+		fail("listen.address is required")
+	}
+	if c.XMPP.Domain == "" || strings.ContainsAny(c.XMPP.Domain, "@/ ") {
+		fail("xmpp.domain %q is not a valid domain", c.XMPP.Domain)
+	}
+	domains := map[string]bool{strings.ToLower(c.XMPP.Domain): true}
+	databases := map[string]bool{c.Mongo.Database: true}
+	for i, host := range c.Hosts {
+		if host.Domain == "" || strings.ContainsAny(host.Domain, "@/ ") {
+			fail("hosts[%d].domain %q is not a valid domain", i, host.Domain)
+		} else if domains[strings.ToLower(host.Domain)] {
+			fail("hosts[%d].domain %q is served twice", i, host.Domain)
+		}
+		domains[strings.ToLower(host.Domain)] = true
+
+		if c.Storage.Backend == "mongo" {
+			if host.Database == "" {
+				fail("hosts[%d].database is required with the mongo backend", i)
+			} else if databases[host.Database] {
+				fail("hosts[%d].database %q is used by another domain", i, host.Database)
+			}
+			databases[host.Database] = true
+		}
+	}
+
+	for i, proxy := range c.Listen.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			fail("listen.trustedProxies[%d] %q is not an IP address or CIDR range", i, proxy)
+		}
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		fail("tls.certFile and tls.keyFile must be set together")
+	}
+
+	switch c.Storage.Backend {
+	case "mongo":
+		if c.Mongo.URI == "" || c.Mongo.Database == "" {
+			fail("mongo.uri and mongo.database are required with the mongo backend")
+		}
+	case "memory":
+	default:
+		fail("storage.backend must be mongo or memory, not %q", c.Storage.Backend)
+	}
+	if c.Storage.Seed != "" && c.Storage.Backend != "memory" {
+		fail("storage.seed only applies to the memory backend")
+	}
+	if c.Mongo.ConnectRetries < 0 {
+		fail("mongo.connectRetries can't be negative")
+	}
+
+	if c.Cache.TTL < 0 || c.Cache.Size < 0 {
+		fail("cache.ttl and cache.size can't be negative")
+	}
+	if c.Cluster.Advertise != "" {
+		u, err := url.Parse(c.Cluster.Advertise)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("cluster.advertise %q is not an http(s) URL", c.Cluster.Advertise)
+		}
+		if c.Cluster.Secret == "" {
+			fail("cluster.secret is required in cluster mode")
+		}
+		if c.Cluster.Heartbeat <= 0 {
+			fail("cluster.heartbeat must be positive")
+		}
+	}
+	if c.Limits.BroadcastConcurrency <= 0 {
+		fail("limits.broadcastConcurrency must be positive")
+	}
+	if c.Limits.OutboundQueue <= 0 {
+		fail("limits.outboundQueue must be positive")
+	}
+	if c.Limits.MaxStanzaBytes <= 0 {
+		fail("limits.maxStanzaBytes must be positive")
+	}
+	if c.Timeouts.Write <= 0 {
+		fail("timeouts.write must be positive")
+	}
+	if c.Timeouts.AutoAway < 0 || (c.Timeouts.AutoAway > 0 && c.Timeouts.AutoAway < time.Second) {
+		fail("timeouts.autoAway must be 0 or at least 1s")
+	}
+	if c.Timeouts.Shutdown <= 0 {
+		fail("timeouts.shutdown must be positive")
+	}
+	if c.Timeouts.Drain < 0 {
+		fail("timeouts.drain can't be negative")
+	}
+	if c.Timeouts.Resume < 0 {
+		fail("timeouts.resume can't be negative")
+	}
+
+	switch c.Log.Level {
+	case "debug", "info", "warning", "error":
+	default:
+		fail("log.level must be debug, info, warning or error, not %q", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		fail("log.format must be text or json, not %q", c.Log.Format)
+	}
+
+	switch c.Tracing.Exporter {
+	case "", "stdout":
+	case "otlp":
+		u, err := url.Parse(c.Tracing.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("tracing.endpoint %q is not an http(s) URL", c.Tracing.Endpoint)
+		}
+	default:
+		fail("tracing.exporter must be otlp, stdout or empty, not %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.ServiceName == "" {
+		fail("tracing.serviceName can't be empty")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("tracing.sampleRatio must be between 0 and 1")
+	}
+
+	for i, hook := range c.Webhooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("webhooks[%d].url %q is not an http(s) URL", i, hook.URL)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy of c that is safe to print.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Mongo.URI = RedactURI(c.Mongo.URI)
+
+	if c.Cluster.Secret != "" {
+		r.Cluster.Secret = "xxxxx"
+	}
+
+	r.Admin.APIKeys = make([]string, len(c.Admin.APIKeys))
+	for i := range r.Admin.APIKeys {
+		r.Admin.APIKeys[i] = "xxxxx"
+	}
+
+	r.Hosts = make([]HostConfig, len(c.Hosts))
+	for i, host := range c.Hosts {
+		r.Hosts[i] = host
+		r.Hosts[i].Admin.APIKeys = make([]string, len(host.Admin.APIKeys))
+		for j := range r.Hosts[i].Admin.APIKeys {
+			r.Hosts[i].Admin.APIKeys[j] = "xxxxx"
+		}
+	}
+
+	r.Webhooks = make([]WebhookConfig, len(c.Webhooks))
+	for i, hook := range c.Webhooks {
+		r.Webhooks[i] = hook
+		if hook.Secret != "" {
+			r.Webhooks[i].Secret = "xxxxx"
+		}
+	}
+	return &r
+}
+
+// VirtualHosts returns every domain the process serves, starting with
+// xmpp.domain, which also serves streams that don't name one.
+func (c *Config) VirtualHosts() []VirtualHost {
+	hosts := []VirtualHost{{
+		Domain:   c.XMPP.Domain,
+		Database: c.Mongo.Database,
+		Outbox:   c.Features.Outbox,
+	}}
+	for _, host := range c.Hosts {
+		outbox := c.Features.Outbox
+		if host.Features.Outbox != nil {
+			outbox = *host.Features.Outbox
+		}
+		hosts = append(hosts, VirtualHost{
+			Domain:    host.Domain,
+			Database:  host.Database,
+			AdminKeys: host.Admin.APIKeys,
+			Outbox:    outbox,
+		})
+	}
+	return hosts
+}
+
+// HostAdminKeys returns the admin keys that only give access to domain.
+func (c *Config) HostAdminKeys(domain string) []string {
+	for _, host := range c.Hosts {
+		if strings.EqualFold(host.Domain, domain) {
+			return host.Admin.APIKeys
+		}
+	}
+	return nil
+}
+
+// YAML renders c in the config file format.
+func (c *Config) YAML() (string, error) {
+	data, err := yaml.Marshal(c)
+	return string(data), err
+}
+
+// RedactURI hides the password in a connection string so it can be logged.
+func RedactURI(uri string) string {
+	scheme, rest, ok := strings.Cut(uri, "://")
+	if !ok {
+		return uri
+	}
+
+	hostStart := strings.LastIndex(rest[:strings.IndexAny(rest+"/", "/?")], "@")
+	if hostStart < 0 {
+		return uri
+	}
+
+	user, _, hasPassword := strings.Cut(rest[:hostStart], ":")
+	if !hasPassword {
+		return uri
+	}
+	return scheme + "://" + user + ":xxxxx" + rest[hostStart:]
+}
+
+// SplitList splits a comma-separated value, dropping empty entries.
+func SplitList(value string) []string {
+	var parts []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Reload returns cur with the settings that can change at run time taken
+// from next. It also names the sections that changed and were applied, and
+// those that changed but only take effect after a restart.
+func Reload(cur, next *Config) (merged *Config, applied, restart []string) {
+	m := *cur
+	applied, restart = []string{}, []string{}
+
+	live := func(name string, changed bool, apply func()) {
+		if changed {
+			apply()
+			applied = append(applied, name)
+		}
+	}
+	live("admin", !reflect.DeepEqual(cur.Admin, next.Admin), func() { m.Admin = next.Admin })
+	hosts := reloadHostKeys(cur.Hosts, next.Hosts)
+	live("hosts.admin", !sameHosts(cur.Hosts, hosts), func() { m.Hosts = hosts })
+	live("limits", cur.Limits != next.Limits, func() { m.Limits = next.Limits })
+	live("timeouts.write", cur.Timeouts.Write != next.Timeouts.Write, func() { m.Timeouts.Write = next.Timeouts.Write })
+	live("timeouts.shutdown", cur.Timeouts.Shutdown != next.Timeouts.Shutdown, func() { m.Timeouts.Shutdown = next.Timeouts.Shutdown })
+	live("timeouts.drain", cur.Timeouts.Drain != next.Timeouts.Drain, func() { m.Timeouts.Drain = next.Timeouts.Drain })
+	live("timeouts.resume", cur.Timeouts.Resume != next.Timeouts.Resume, func() { m.Timeouts.Resume = next.Timeouts.Resume })
+	live("webhooks", !reflect.DeepEqual(cur.Webhooks, next.Webhooks), func() { m.Webhooks = next.Webhooks })
+	live("log.level", cur.Log.Level != next.Log.Level, func() { m.Log.Level = next.Log.Level })
+	live("messages", cur.Messages != next.Messages, func() { m.Messages = next.Messages })
+
+	fixed := func(name string, changed bool) {
+		if changed {
+			restart = append(restart, name)
+		}
+	}
+	fixed("listen", !reflect.DeepEqual(cur.Listen, next.Listen))
+	fixed("xmpp", cur.XMPP != next.XMPP)
+	fixed("hosts", !sameHosts(hosts, next.Hosts))
+	fixed("tls", cur.TLS != next.TLS)
+	fixed("storage", cur.Storage != next.Storage)
+	fixed("mongo", cur.Mongo != next.Mongo)
+	fixed("cache", cur.Cache != next.Cache)
+	fixed("cluster", cur.Cluster != next.Cluster)
+	fixed("timeouts.autoAway", cur.Timeouts.AutoAway != next.Timeouts.AutoAway)
+	fixed("log.format", cur.Log.Format != next.Log.Format)
+	fixed("features", cur.Features != next.Features)
+	fixed("tracing", cur.Tracing != next.Tracing)
+
+	return &m, applied, restart
+}
+
+// reloadHostKeys returns cur with the admin keys of each host taken from the
+// host of the same domain in next. Hosts themselves only change on a restart.
+func reloadHostKeys(cur, next []HostConfig) []HostConfig {
+	hosts := append([]HostConfig(nil), cur...)
+	for i := range hosts {
+		for _, host := range next {
+			if strings.EqualFold(host.Domain, hosts[i].Domain) {
+				hosts[i].Admin = host.Admin
+			}
+		}
+	}
+	return hosts
+}
+
+func sameHosts(a, b []HostConfig) bool {
+	return len(a) == len(b) && (len(a) == 0 || reflect.DeepEqual(a, b))
+}
@@ -1,49 +1,133 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/RazerFrFr/Voryn/config"
+	"github.com/RazerFrFr/Voryn/storage"
 	"github.com/RazerFrFr/Voryn/structs"
 	"github.com/RazerFrFr/Voryn/utils"
 	"github.com/clbanning/mxj/v2"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
+// connections counts the running handleWebsocket goroutines, so shutdown can
+// wait for sessions to be cleaned up.
+var connections sync.WaitGroup
+
 func main() {
 	_ = godotenv.Load()
-	utils.InitDB()
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "5000"
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(configCommand(os.Args[2:]))
+	}
+
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal("Invalid configuration:\n", err)
+	}
+	utils.Configure(cfg)
+
+	if err := utils.StartTracing(cfg.Tracing); err != nil {
+		utils.Log.Tracing.Error("Failed to start tracing", "error", err)
+		os.Exit(1)
+	}
+
+	listener, err := utils.Listen(cfg.Listen.Address)
+	if err != nil {
+		utils.Log.XMPP.Error("Failed to listen", "address", cfg.Listen.Address, "error", err)
+		os.Exit(1)
 	}
 
-	xmppServer := &structs.Server{
-		Clients: []*structs.Client{},
+	var mongoClient *mongo.Client
+	if cfg.Storage.Backend == "memory" {
+		utils.Log.XMPP.Warn("Using in-memory storage; nothing will be persisted")
+	} else {
+		mongoClient = utils.InitDB(cfg.Mongo).Client()
 	}
 
-	r := gin.Default()
+	var servers []*structs.Server
+	for _, host := range cfg.VirtualHosts() {
+		servers = append(servers, newHost(cfg, host, mongoClient))
+	}
+	hosts := utils.NewHosts(servers...)
+
+	if cfg.Cluster.Advertise != "" {
+		if cfg.Storage.Backend == "memory" {
+			utils.Log.Cluster.Warn("Cluster mode with in-memory storage; nodes won't see each other's sessions")
+		}
+		if err := utils.StartCluster(hosts, cfg.Cluster); err != nil {
+			utils.Log.Cluster.Error("Failed to join cluster", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	utils.StartWebhooks(hosts)
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(gin.Recovery())
 	r.RedirectTrailingSlash = false
+	if err := r.SetTrustedProxies(cfg.Listen.TrustedProxies); err != nil {
+		utils.Log.HTTP.Error("Invalid trusted proxies", "error", err)
+		os.Exit(1)
+	}
 
 	r.Use(func(c *gin.Context) {
 		if (c.Request.URL.Path == "/" || c.Request.URL.Path == "//") && websocket.IsWebSocketUpgrade(c.Request) {
+			if utils.ShuttingDown() {
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+				return
+			}
+
 			ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 			if err != nil {
-				utils.Logger.Error("WebSocket upgrade failed:", err)
+				utils.Log.HTTP.Warn("WebSocket upgrade failed", "error", err, "clientIp", c.ClientIP())
 				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "WebSocket upgrade failed"})
 				return
 			}
 
-			client := &structs.Client{Conn: ws}
-			go handleWebsocket(ws, client, xmppServer)
+			ws.SetReadLimit(utils.CurrentConfig().Limits.MaxStanzaBytes)
+
+			client := &structs.Client{
+				ID:           uuid.New().String(),
+				Conn:         ws,
+				RemoteAddr:   c.ClientIP(),
+				ConnectedAt:  time.Now(),
+				LastActivity: time.Now(),
+			}
+			utils.StartWriter(client)
+			utils.Log.XMPP.Debug("Connected", "session", client)
+			utils.PublishEvent(utils.Event{
+				Type: utils.EventSessionConnect,
+				Data: map[string]interface{}{"sessionId": client.ID, "remoteAddr": client.RemoteAddr},
+			})
+			connections.Add(1)
+			go func() {
+				defer connections.Done()
+				handleWebsocket(ws, client, hosts)
+			}()
 
 			c.Abort()
 			return
@@ -51,25 +135,240 @@ func main() {
 
 		c.Next()
 	})
+	r.Use(utils.LogRequests())
+
+	if cfg.Features.Metrics {
+		utils.RegisterServerMetrics(hosts)
+		r.Use(utils.MetricsMiddleware())
+		r.GET("/metrics", gin.WrapH(promhttp.HandlerFor(utils.Metrics, promhttp.HandlerOpts{})))
+	}
 
 	r.GET("/", func(c *gin.Context) {
 		c.String(200, "Voryn, Made by Razer.")
 	})
 
+	if cfg.Cluster.Advertise != "" {
+		r.POST(utils.ClusterRoutePath, utils.TraceRequests(), utils.ClusterHandler(hosts))
+	}
+
 	r.GET("/clients", func(c *gin.Context) {
-		xmppServer.ClientsMutex.Lock()
-		defer xmppServer.ClientsMutex.Unlock()
 		names := []string{}
-		for _, cl := range xmppServer.Clients {
-			names = append(names, cl.DisplayName)
+		for _, server := range hosts.List {
+			for _, cl := range server.Clients.Snapshot() {
+				names = append(names, cl.DisplayName)
+			}
 		}
 		c.JSON(http.StatusOK, gin.H{
-			"usersAmount": len(xmppServer.Clients),
+			"usersAmount": len(names),
 			"Clients":     names,
 		})
 	})
 
-	r.POST("/api/voryn/message/send/:accountId", func(c *gin.Context) {
+	// Every admin endpoint needs a key once one is configured for the host;
+	// the ones that could expose or change too much need one regardless.
+	admin := r.Group("/api/voryn", utils.TraceRequests(), utils.AdminAuth(hosts, false))
+	events := r.Group("/api/voryn/events", utils.TraceRequests(), utils.AdminStreamAuth(hosts))
+
+	events.GET("", func(c *gin.Context) {
+		sub := utils.SubscribeEvents(eventFilter(c))
+		defer utils.UnsubscribeEvents(sub)
+
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event := <-sub.C:
+				c.SSEvent(event.Type, event)
+			case <-heartbeat.C:
+				_, _ = io.WriteString(w, ": heartbeat\n\n")
+			case <-c.Request.Context().Done():
+				return false
+			}
+			return true
+		})
+	})
+
+	events.GET("/ws", func(c *gin.Context) {
+		ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			utils.Log.HTTP.Warn("WebSocket upgrade failed", "error", err, "clientIp", c.ClientIP())
+			return
+		}
+		defer ws.Close()
+
+		sub := utils.SubscribeEvents(eventFilter(c))
+		defer utils.UnsubscribeEvents(sub)
+
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := ws.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		for {
+			select {
+			case event := <-sub.C:
+				ws.SetWriteDeadline(time.Now().Add(5 * time.Second))
+				if err := ws.WriteJSON(event); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	})
+
+	admin.DELETE("/cache", func(c *gin.Context) {
+		utils.AdminServer(c).Store.InvalidateCaches("")
+		c.Status(204)
+	})
+
+	admin.DELETE("/cache/:accountId", func(c *gin.Context) {
+		utils.AdminServer(c).Store.InvalidateCaches(c.Param("accountId"))
+		c.Status(204)
+	})
+
+	admin.POST("/config/reload", utils.AdminAuth(nil, true), func(c *gin.Context) {
+		applied, restart, err := reloadConfig()
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"applied": applied, "restartRequired": restart})
+	})
+
+	captures := admin.Group("/captures", utils.AdminAuth(hosts, true))
+
+	captures.POST("", func(c *gin.Context) {
+		var req struct {
+			AccountID       string  `json:"accountId"`
+			SampleRate      float64 `json:"sampleRate"`
+			MaxBytes        int     `json:"maxBytes"`
+			DurationSeconds int     `json:"durationSeconds"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		capture, err := utils.StartCapture(utils.AdminServer(c), utils.CaptureOptions{
+			AccountID:  req.AccountID,
+			SampleRate: req.SampleRate,
+			MaxBytes:   req.MaxBytes,
+			Duration:   time.Duration(req.DurationSeconds) * time.Second,
+		})
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(201, capture)
+	})
+
+	captures.GET("", func(c *gin.Context) {
+		c.JSON(200, gin.H{"captures": utils.ListCaptures(utils.AdminServer(c))})
+	})
+
+	captures.GET("/:id", func(c *gin.Context) {
+		capture, err := utils.GetCapture(utils.AdminServer(c), c.Param("id"))
+		if err != nil {
+			c.JSON(404, gin.H{"error": "Capture not found"})
+			return
+		}
+
+		if c.Query("format") == "json" {
+			c.JSON(200, gin.H{"capture": capture.Info(), "entries": capture.Entries()})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="capture-%s.log"`, c.Param("id")))
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		c.Status(200)
+		_ = capture.WriteText(c.Writer)
+	})
+
+	captures.DELETE("/:id", func(c *gin.Context) {
+		if err := utils.StopCapture(utils.AdminServer(c), c.Param("id")); err != nil {
+			c.JSON(404, gin.H{"error": "Capture not found"})
+			return
+		}
+		c.Status(204)
+	})
+
+	admin.GET("/sessions", func(c *gin.Context) {
+		limit, _ := strconv.Atoi(c.Query("limit"))
+		page, err := utils.ListSessions(utils.AdminServer(c), utils.SessionQuery{
+			Platform:      c.Query("platform"),
+			PartyID:       c.Query("partyId"),
+			DisplayName:   c.Query("displayName"),
+			Authenticated: queryBool(c, "authenticated"),
+			Away:          queryBool(c, "away"),
+			Sort:          c.Query("sort"),
+			Desc:          c.Query("order") == "desc",
+			Limit:         limit,
+			Cursor:        c.Query("cursor"),
+		})
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(200, page)
+	})
+
+	admin.GET("/sessions/:accountId", func(c *gin.Context) {
+		accountID := c.Param("accountId")
+
+		sessions := utils.GetAccountSessions(utils.AdminServer(c), accountID)
+		if len(sessions) == 0 {
+			c.JSON(404, gin.H{"error": "Client not found"})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"accountId": accountID,
+			"sessions":  sessions,
+		})
+	})
+
+	admin.GET("/presence/:accountId", func(c *gin.Context) {
+		accountID := c.Param("accountId")
+		server := utils.AdminServer(c)
+
+		sessions := []gin.H{}
+		for _, cl := range server.Clients.ByAccount(accountID) {
+			directedTo := []string{}
+			cl.DirectedMutex.Lock()
+			for jid := range cl.DirectedPresence {
+				directedTo = append(directedTo, jid)
+			}
+			cl.DirectedMutex.Unlock()
+
+			presence := utils.LastPresence(cl)
+			sessions = append(sessions, gin.H{
+				"jid":        cl.JID,
+				"invisible":  cl.Invisible,
+				"away":       presence.Away,
+				"status":     presence.Status,
+				"directedTo": directedTo,
+			})
+		}
+
+		if len(sessions) == 0 {
+			c.JSON(404, gin.H{"error": "Client not found"})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"accountId": accountID,
+			"sessions":  sessions,
+		})
+	})
+
+	admin.POST("/message/send/:accountId", func(c *gin.Context) {
 		accountID := c.Param("accountId")
 
 		var body interface{}
@@ -78,7 +377,7 @@ func main() {
 			return
 		}
 
-		if err := utils.SendMessage(body, accountID, xmppServer); err != nil {
+		if err := utils.SendMessage(c.Request.Context(), body, accountID, utils.AdminServer(c)); err != nil {
 			c.JSON(500, gin.H{"error": err.Error()})
 			return
 		}
@@ -86,60 +385,352 @@ func main() {
 		c.Status(204)
 	})
 
-	r.DELETE("/api/voryn/client/remove/:accountId", func(c *gin.Context) {
+	admin.POST("/message/multicast", func(c *gin.Context) {
+		var req struct {
+			AccountIDs []string    `json:"accountIds"`
+			Body       interface{} `json:"body"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Body == nil || len(req.AccountIDs) == 0 {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		results := utils.MulticastMessage(c.Request.Context(), req.Body, req.AccountIDs, utils.CurrentConfig().Limits.BroadcastConcurrency, utils.AdminServer(c))
+		c.JSON(200, deliverySummary(results))
+	})
+
+	admin.POST("/message/broadcast", func(c *gin.Context) {
+		var req struct {
+			Filter utils.BroadcastFilter `json:"filter"`
+			Body   interface{}           `json:"body"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Body == nil {
+			c.JSON(400, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		server := utils.AdminServer(c)
+		accountIDs := utils.SelectAccounts(server, req.Filter)
+		results := utils.MulticastMessage(c.Request.Context(), req.Body, accountIDs, utils.CurrentConfig().Limits.BroadcastConcurrency, server)
+		c.JSON(200, deliverySummary(results))
+	})
+
+	admin.DELETE("/client/remove/:accountId", func(c *gin.Context) {
 		accountID := c.Param("accountId")
 
-		xmppServer.ClientsMutex.Lock()
-		var clientsToRemove []*structs.Client
-		for _, cl := range xmppServer.Clients {
-			if cl.AccountID == accountID {
-				clientsToRemove = append(clientsToRemove, cl)
+		var req struct {
+			Reason          string `json:"reason"`
+			Condition       string `json:"condition"`
+			CooldownSeconds int    `json:"cooldownSeconds"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid request body"})
+				return
 			}
 		}
-		xmppServer.ClientsMutex.Unlock()
 
-		if len(clientsToRemove) == 0 {
+		kick, err := utils.KickAccount(c.Request.Context(), utils.AdminServer(c), accountID, utils.KickOptions{
+			Reason:    req.Reason,
+			Condition: req.Condition,
+			KickedBy:  utils.AdminIdentity(c),
+			Cooldown:  time.Duration(req.CooldownSeconds) * time.Second,
+		})
+		if errors.Is(err, utils.ErrClientNotFound) {
 			c.JSON(404, gin.H{"error": "Client not found"})
 			return
 		}
-
-		for _, client := range clientsToRemove {
-			utils.RemoveClient(xmppServer, client)
-			if client.Conn != nil {
-				_ = client.Conn.Close()
-			}
+		if err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
 		}
 
 		c.JSON(200, gin.H{
 			"status":    "REMOVED",
 			"accountId": accountID,
+			"kick":      kick,
 		})
 	})
 
-	utils.Logger.XMPP("XMPP server started on port", port)
-	if err := r.Run(":" + port); err != nil {
-		utils.Logger.Error("Server failed:", err)
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if _, _, err := reloadConfig(); err != nil {
+				utils.Log.XMPP.Error("Config reload failed", "error", err)
+			}
+		}
+	}()
+
+	srv := &http.Server{Handler: r}
+	go func() {
+		var err error
+		if cfg.TLS.CertFile != "" {
+			err = srv.ServeTLS(listener, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		} else {
+			err = srv.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			utils.Log.HTTP.Error("Server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+	utils.Log.XMPP.Info("XMPP server started", "address", listener.Addr().String())
+	utils.HandoffReady()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	handoff := make(chan os.Signal, 1)
+	utils.NotifyHandoff(handoff)
+
+	for {
+		select {
+		case sig := <-stop:
+			utils.Log.XMPP.Info("Shutting down", "signal", sig.String())
+		case <-handoff:
+			if err := utils.Handoff(listener); err != nil {
+				utils.Log.XMPP.Error("Listener handoff failed", "error", err)
+				continue
+			}
+			drain(srv, stop)
+		}
+		shutdown(srv, hosts, mongoClient)
+		return
+	}
+}
+
+// drain stops accepting connections after the listener was handed to a new
+// process and closes this one's sessions over timeouts.drain, then gives
+// their clients up to timeouts.resume to resume them in the new process. A
+// signal on stop cuts it short.
+func drain(srv *http.Server, stop <-chan os.Signal) {
+	cfg := utils.CurrentConfig()
+	utils.Log.XMPP.Info("Listener handed over, draining sessions", "window", cfg.Timeouts.Drain)
+
+	stopped, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-stop:
+			utils.Log.XMPP.Info("Shutting down while draining", "signal", sig.String())
+			cancel()
+		case <-stopped.Done():
+		}
+	}()
+
+	ctx, dcancel := context.WithTimeout(stopped, cfg.Timeouts.Drain)
+	defer dcancel()
+	go func() { _ = srv.Shutdown(ctx) }()
+	utils.DrainSessions(ctx)
+
+	rctx, rcancel := context.WithTimeout(stopped, cfg.Timeouts.Resume)
+	defer rcancel()
+	utils.AwaitResumptions(rctx)
+}
+
+// shutdown stops the server within timeouts.shutdown. It stops accepting
+// connections, closes every session with a system-shutdown stream error,
+// waits for their cleanup, flushes webhooks, disconnects from MongoDB and
+// exports the spans still buffered.
+func shutdown(srv *http.Server, hosts *utils.Hosts, mongoClient *mongo.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), utils.CurrentConfig().Timeouts.Shutdown)
+	defer cancel()
+
+	// Shutdown closes the listeners right away but waits for streaming admin
+	// requests until ctx ends, so it runs alongside the rest.
+	go func() { _ = srv.Shutdown(ctx) }()
+
+	if err := utils.CloseSessions(ctx); err != nil {
+		utils.Log.XMPP.Warn("Sessions did not close in time", "error", err)
+	}
+	if err := utils.Wait(ctx, &connections); err != nil {
+		utils.Log.XMPP.Warn("Session cleanup did not finish in time", "error", err)
+	}
+	utils.ExpireDetachedSessions()
+	utils.LeaveCluster(hosts)
+	if err := utils.FlushWebhooks(ctx); err != nil {
+		utils.Log.Webhooks.Warn("Webhooks not flushed", "error", err)
+	}
+	_ = srv.Close()
+
+	if mongoClient != nil {
+		dctx, dcancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer dcancel()
+		if err := mongoClient.Disconnect(dctx); err != nil {
+			utils.Log.MongoDB.Error("Failed to disconnect", "error", err)
+		}
+	}
+
+	tctx, tcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer tcancel()
+	if err := utils.StopTracing(tctx); err != nil {
+		utils.Log.Tracing.Warn("Spans not exported", "error", err)
+	}
+	utils.Log.XMPP.Info("Shutdown complete")
+}
+
+// newHost sets up the server for one virtual host, with its own storage and
+// background jobs. mongoClient is nil with the memory backend.
+func newHost(cfg *config.Config, host config.VirtualHost, mongoClient *mongo.Client) *structs.Server {
+	var store *storage.Store
+	if mongoClient == nil {
+		var seed storage.Seed
+		if cfg.Storage.Seed != "" {
+			var err error
+			if seed, err = storage.ReadSeed(cfg.Storage.Seed); err != nil {
+				utils.Log.XMPP.Error("Failed to read storage seed", "error", err)
+				os.Exit(1)
+			}
+		}
+		store = storage.NewMemory(seed)
+	} else {
+		store = storage.NewMongo(mongoClient.Database(host.Database))
+		// Cluster nodes rely on the unique session index to keep an
+		// account to one session, so they can't run without it.
+		if err := store.EnsureIndexes(); err != nil {
+			utils.Log.MongoDB.Error("Failed to create indexes", "domain", host.Domain, "error", err)
+			if cfg.Mongo.FailFast || cfg.Cluster.Advertise != "" {
+				os.Exit(1)
+			}
+		}
+	}
+
+	if cfg.Cache.TTL > 0 {
+		store = storage.NewCached(store, cfg.Cache.TTL, cfg.Cache.Size)
+		if err := store.WatchInvalidations(); err != nil {
+			utils.Log.MongoDB.Warn("Cache invalidation from change streams unavailable, relying on the cache TTL", "domain", host.Domain, "error", err)
+		}
+	}
+
+	server := &structs.Server{
+		Domain:      host.Domain,
+		StartedAt:   time.Now(),
+		Store:       store,
+		PendingCaps: map[string]structs.CapsQuery{},
+	}
+
+	if cfg.Timeouts.AutoAway > 0 {
+		go utils.StartIdleChecker(server, cfg.Timeouts.AutoAway)
+	}
+
+	if host.Outbox {
+		utils.StartOutbox(server)
+	}
+
+	if len(cfg.Admin.APIKeys) == 0 && len(host.AdminKeys) == 0 {
+		utils.Log.HTTP.Warn("No admin API keys; the admin API of this host is open to anyone", "domain", host.Domain)
+	}
+
+	utils.Log.XMPP.Info("Serving host", "domain", host.Domain)
+	return server
+}
+
+// reloadConfig reads the configuration again and applies the settings that can
+// change without a restart. The environment is not re-read from .env.
+func reloadConfig() (applied, restart []string, err error) {
+	next, err := config.Load(os.Args[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	merged, applied, restart := config.Reload(utils.CurrentConfig(), next)
+	utils.Configure(merged)
+
+	if len(applied) > 0 {
+		utils.Log.XMPP.Info("Config reloaded", "applied", applied)
+	} else {
+		utils.Log.XMPP.Info("Config reloaded; no live settings changed")
+	}
+	if len(restart) > 0 {
+		utils.Log.XMPP.Warn("Config changes that need a restart", "settings", restart)
+	}
+	return applied, restart, nil
+}
+
+// configCommand runs "voryn config check", which loads the configuration the
+// way the server would and prints it with secrets redacted.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: voryn config check [-config file] [-listen addr] [-domain domain] [-storage backend]")
+		return 2
+	}
+
+	cfg, err := config.Load(args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	out, err := cfg.Redacted().YAML()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Print(out)
+	return 0
+}
+
+// eventFilter reads an event stream's filter from the query. Streams opened
+// with a host's own key only see that host; top-level keys see every host
+// unless a domain is given.
+func eventFilter(c *gin.Context) utils.EventFilter {
+	domain := c.Query("domain")
+	if !utils.AdminGlobal(c) {
+		domain = utils.AdminServer(c).Domain
+	}
+	return utils.EventFilter{
+		Domain:     domain,
+		AccountIDs: config.SplitList(c.Query("accountId")),
+		Types:      config.SplitList(c.Query("type")),
+	}
+}
+
+func queryBool(c *gin.Context, name string) *bool {
+	value, err := strconv.ParseBool(c.Query(name))
+	if err != nil {
+		return nil
+	}
+	return &value
+}
+
+func deliverySummary(results []utils.DeliveryResult) gin.H {
+	delivered := 0
+	for _, result := range results {
+		if result.Status == "delivered" {
+			delivered++
+		}
+	}
+
+	return gin.H{
+		"total":     len(results),
+		"delivered": delivered,
+		"results":   results,
 	}
 }
 
-func handleWebsocket(ws *websocket.Conn, client *structs.Client, server *structs.Server) {
-	server.ClientsMutex.Lock()
-	server.Clients = append(server.Clients, client)
-	client.ClientExists = true
-	server.ClientsMutex.Unlock()
+// handleWebsocket reads a client's stream. The client joins the host named by
+// the "to" attribute of its first open element, and stays on it.
+func handleWebsocket(ws *websocket.Conn, client *structs.Client, hosts *utils.Hosts) {
+	var server *structs.Server
 
 	for {
 		_, message, err := ws.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				utils.Logger.Error("WebSocket read error:", err)
+				utils.Log.Stream.Warn("WebSocket read error", "error", err, "session", client)
 			}
 
-			utils.RemoveClient(server, client)
-			_ = ws.Close()
+			if server != nil && !utils.DetachClient(server, client) {
+				utils.RemoveClient(server, client)
+			}
+			utils.CloseClient(client)
+			utils.Log.XMPP.Debug("Disconnected", "session", client)
 			return
 		}
 
+		utils.CaptureInbound(client, message)
+
 		msgStr := strings.TrimSpace(string(message))
 		if msgStr == "" {
 			continue
@@ -147,11 +738,15 @@ func handleWebsocket(ws *websocket.Conn, client *structs.Client, server *structs
 
 		root, err := mxj.NewMapXml([]byte(msgStr))
 		if err != nil {
-			utils.Logger.Error("Failed to parse XML:", err)
+			utils.Log.Stream.Warn("Failed to parse XML", "error", err, "session", client)
 			utils.SendError(client)
 			continue
 		}
 
+		if server != nil {
+			utils.MarkActive(client, root, server)
+		}
+
 		for nodeName, nodeValue := range root {
 			baseName := nodeName
 			if strings.Contains(nodeName, ":") {
@@ -159,6 +754,13 @@ func handleWebsocket(ws *websocket.Conn, client *structs.Client, server *structs
 				baseName = parts[1]
 			}
 
+			utils.CountStanzaIn(baseName)
+
+			if server == nil && baseName != "open" && baseName != "close" {
+				utils.SendError(client)
+				continue
+			}
+
 			switch baseName {
 			case "open":
 				rawAttrs := map[string]string{}
@@ -169,6 +771,19 @@ func handleWebsocket(ws *websocket.Conn, client *structs.Client, server *structs
 						}
 					}
 				}
+
+				host := hosts.Lookup(rawAttrs["-to"])
+				if host == nil || (server != nil && rawAttrs["-to"] != "" && host != server) {
+					utils.SendStreamError(client, "host-unknown", "")
+					continue
+				}
+				if server == nil {
+					server = host
+					client.Domain = server.Domain
+					server.Clients.Add(client)
+					client.ClientExists = true
+				}
+
 				utils.HandleOpen(client, map[string]string{}, rawAttrs)
 			case "auth":
 				content := ""
@@ -180,10 +795,33 @@ func handleWebsocket(ws *websocket.Conn, client *structs.Client, server *structs
 				if nodeMap, ok := nodeValue.(map[string]interface{}); ok {
 					utils.HandleIQ(client, nodeMap, server)
 				}
+				utils.StanzaHandled(client)
+			case "message":
+				if nodeMap, ok := nodeValue.(map[string]interface{}); ok {
+					utils.HandleMessage(client, nodeMap, server)
+				}
+				utils.StanzaHandled(client)
 			case "presence":
 				if nodeMap, ok := nodeValue.(map[string]interface{}); ok {
 					utils.HandlePresence(client, nodeMap, server)
 				}
+				utils.StanzaHandled(client)
+			case "enable":
+				if nodeMap, ok := nodeValue.(map[string]interface{}); ok {
+					utils.HandleEnable(client, nodeMap)
+				}
+			case "resume":
+				if nodeMap, ok := nodeValue.(map[string]interface{}); ok {
+					utils.HandleResume(client, nodeMap, server)
+				}
+			case "r":
+				if nodeMap, ok := nodeValue.(map[string]interface{}); ok {
+					utils.HandleAckRequest(client, nodeMap)
+				}
+			case "a":
+				if nodeMap, ok := nodeValue.(map[string]interface{}); ok {
+					utils.HandleAck(client, nodeMap)
+				}
 			case "close":
 				return
 			}
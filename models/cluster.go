@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// SessionEntry is an authenticated session in the shared session directory.
+// JID is empty until the session binds a resource.
+type SessionEntry struct {
+	ID        string    `bson:"_id" json:"id"`
+	AccountID string    `bson:"accountId" json:"accountId"`
+	JID       string    `bson:"jid,omitempty" json:"jid,omitempty"`
+	NodeID    string    `bson:"nodeId" json:"nodeId"`
+	Seen      time.Time `bson:"seen" json:"seen"`
+}
+
+// ClusterNode is a Voryn node sharing the session directory. Address is the
+// base URL other nodes route stanzas to.
+type ClusterNode struct {
+	ID      string    `bson:"_id" json:"id"`
+	Address string    `bson:"address" json:"address"`
+	Seen    time.Time `bson:"seen" json:"seen"`
+}
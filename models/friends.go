@@ -17,6 +17,22 @@ type FriendList struct {
 	Blocked  []FriendEntry `bson:"blocked" json:"blocked"`
 }
 
+// Named returns the list called name: "accepted", "incoming", "outgoing" or
+// "blocked". It returns nil for any other name.
+func (l *FriendList) Named(name string) *[]FriendEntry {
+	switch name {
+	case "accepted":
+		return &l.Accepted
+	case "incoming":
+		return &l.Incoming
+	case "outgoing":
+		return &l.Outgoing
+	case "blocked":
+		return &l.Blocked
+	}
+	return nil
+}
+
 type Friends struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	AccountID string             `bson:"accountId" json:"accountId"`
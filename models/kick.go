@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Kick struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	AccountID     string             `bson:"accountId" json:"accountId"`
+	KickedBy      string             `bson:"kickedBy" json:"kickedBy"`
+	Reason        string             `bson:"reason" json:"reason"`
+	Condition     string             `bson:"condition" json:"condition"`
+	CooldownUntil time.Time          `bson:"cooldownUntil,omitempty" json:"cooldownUntil,omitempty"`
+	Sessions      int                `bson:"sessions" json:"sessions"`
+	Created       time.Time          `bson:"created" json:"created"`
+}
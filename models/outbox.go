@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	OutboxPending    = "pending"
+	OutboxProcessing = "processing"
+	OutboxDelivered  = "delivered"
+	OutboxQueued     = "queued"
+	OutboxFailed     = "failed"
+	OutboxDuplicate  = "duplicate"
+)
+
+// OutboxMessage is a message another service asked Voryn to deliver by
+// inserting it into the xmpp_outbox collection. Producers set AccountID, Body
+// and optionally IdempotencyKey; Voryn owns the remaining fields.
+type OutboxMessage struct {
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	AccountID      string             `bson:"accountId" json:"accountId"`
+	Body           bson.RawValue      `bson:"body" json:"-"`
+	IdempotencyKey string             `bson:"idempotencyKey,omitempty" json:"idempotencyKey,omitempty"`
+	Status         string             `bson:"status,omitempty" json:"status"`
+	Attempts       int                `bson:"attempts,omitempty" json:"attempts"`
+	Error          string             `bson:"error,omitempty" json:"error,omitempty"`
+	LeaseUntil     time.Time          `bson:"leaseUntil,omitempty" json:"-"`
+	NextAttempt    time.Time          `bson:"nextAttempt,omitempty" json:"nextAttempt,omitempty"`
+	Created        time.Time          `bson:"created,omitempty" json:"created"`
+	DeliveredAt    time.Time          `bson:"deliveredAt,omitempty" json:"deliveredAt,omitempty"`
+}
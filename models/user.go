@@ -23,5 +23,6 @@ type User struct {
 	IsServer        bool               `bson:"isServer" json:"isServer"`
 	AcceptedEULA    bool               `bson:"acceptedEULA" json:"acceptedEULA"`
 	LastVbucksClaim time.Time          `bson:"lastVbucksClaim" json:"lastVbucksClaim"`
+	LastLogout      time.Time          `bson:"lastLogout" json:"lastLogout"`
 	Arena           Arena              `bson:"arena" json:"arena"`
 }
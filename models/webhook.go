@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WebhookDelivery is an event waiting to be retried against a webhook.
+type WebhookDelivery struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	URL         string             `bson:"url" json:"url"`
+	EventType   string             `bson:"eventType" json:"eventType"`
+	Payload     string             `bson:"payload" json:"payload"`
+	Attempts    int                `bson:"attempts" json:"attempts"`
+	NextAttempt time.Time          `bson:"nextAttempt" json:"nextAttempt"`
+	LastError   string             `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	Failed      bool               `bson:"failed" json:"failed"`
+	Created     time.Time          `bson:"created" json:"created"`
+}
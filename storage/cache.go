@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/models"
+)
+
+const (
+	watchMinBackoff = time.Second
+	watchMaxBackoff = time.Minute
+)
+
+// Cache is a size-bounded LRU map whose entries go stale after a TTL. Stale
+// entries are kept until evicted so they can stand in when the backing store
+// fails.
+type Cache struct {
+	name  string
+	ttl   time.Duration
+	size  int
+	watch func() (<-chan string, error)
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+	stats CacheStats
+
+	// fetches tracks the keys being fetched, so a fetch that raced with an
+	// invalidation doesn't cache what it read. epoch counts purges.
+	fetches map[string]*cacheFetch
+	epoch   uint64
+}
+
+// cacheFetch counts the fetches of a key in flight and the invalidations of
+// the key since the first of them started.
+type cacheFetch struct {
+	running    int
+	generation uint64
+}
+
+// CacheStats counts cache lookups. Stale counts lookups answered from an
+// expired entry because the backing store failed.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Stale     uint64
+	Evictions uint64
+	Entries   int
+}
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newCache(name string, ttl time.Duration, size int) *Cache {
+	return &Cache{
+		name:    name,
+		ttl:     ttl,
+		size:    size,
+		items:   map[string]*list.Element{},
+		order:   list.New(),
+		fetches: map[string]*cacheFetch{},
+	}
+}
+
+func (c *Cache) Name() string {
+	return c.name
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	return stats
+}
+
+// Invalidate drops key from the cache.
+func (c *Cache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+	if fetch, ok := c.fetches[key]; ok {
+		fetch.generation++
+	}
+}
+
+// Purge empties the cache.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = map[string]*list.Element{}
+	c.order.Init()
+	c.epoch++
+}
+
+// load returns the cached value for key, calling fetch when there is none or
+// it has expired. If fetch fails and an expired value is present, that value
+// is returned instead of the error. A fetched value is only cached if key
+// wasn't invalidated while it was read, since it may predate the change.
+func (c *Cache) load(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	var stale interface{}
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.order.MoveToFront(el)
+			c.stats.Hits++
+			c.mu.Unlock()
+			return entry.value, nil
+		}
+		stale = entry.value
+	}
+	c.stats.Misses++
+	inflight, ok := c.fetches[key]
+	if !ok {
+		inflight = &cacheFetch{}
+		c.fetches[key] = inflight
+	}
+	inflight.running++
+	generation, epoch := inflight.generation, c.epoch
+	c.mu.Unlock()
+
+	value, err := fetch()
+
+	c.mu.Lock()
+	current := inflight.generation == generation && c.epoch == epoch
+	if inflight.running--; inflight.running == 0 {
+		delete(c.fetches, key)
+	}
+	c.mu.Unlock()
+
+	if err != nil {
+		if stale != nil && err != ErrNotFound {
+			c.mu.Lock()
+			c.stats.Stale++
+			c.mu.Unlock()
+			return stale, nil
+		}
+		return nil, err
+	}
+
+	if current {
+		c.set(key, value)
+	}
+	return value, nil
+}
+
+func (c *Cache) set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		el.Value = &cacheEntry{key: key, value: value, expires: expires}
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, value: value, expires: expires})
+	for c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// changeNotifier is implemented by backends that can report which accounts
+// changed outside of Voryn. An empty account ID means the whole cache should
+// be dropped.
+type changeNotifier interface {
+	watchChanges() (<-chan string, error)
+}
+
+// NewCached wraps the user and friend stores of store in read-through caches
+// holding up to size entries each for ttl. The other stores are shared with
+// store. Writes made through the returned Store invalidate the entries they
+// touch; see WatchInvalidations for writes made elsewhere.
+func NewCached(store *Store, ttl time.Duration, size int) *Store {
+	users := &cachedUsers{UserStore: store.Users, cache: newCache("users", ttl, size)}
+	friends := &cachedFriends{FriendStore: store.Friends, cache: newCache("friends", ttl, size)}
+
+	if n, ok := store.Users.(changeNotifier); ok {
+		users.cache.watch = n.watchChanges
+	}
+	if n, ok := store.Friends.(changeNotifier); ok {
+		friends.cache.watch = n.watchChanges
+	}
+
+	cached := *store
+	cached.Users = users
+	cached.Friends = friends
+	cached.Caches = []*Cache{users.cache, friends.cache}
+	return &cached
+}
+
+// WatchInvalidations keeps the caches in step with changes other services
+// make to the database, for backends that can report them. Without it, such
+// changes show up once the cached entries expire. When a change stream ends
+// it is reopened with backoff.
+func (s *Store) WatchInvalidations() error {
+	for _, cache := range s.Caches {
+		if cache.watch == nil {
+			continue
+		}
+		changed, err := cache.watch()
+		if err != nil {
+			return err
+		}
+		go cache.followChanges(changed)
+	}
+	return nil
+}
+
+func (c *Cache) followChanges(changed <-chan string) {
+	backoff := watchMinBackoff
+	for {
+		for accountID := range changed {
+			if accountID == "" {
+				c.Purge()
+			} else {
+				c.Invalidate(accountID)
+			}
+			backoff = watchMinBackoff
+		}
+
+		// The stream ended; anything could have changed since, and until
+		// it is back.
+		c.Purge()
+		for {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > watchMaxBackoff {
+				backoff = watchMaxBackoff
+			}
+
+			var err error
+			if changed, err = c.watch(); err == nil {
+				c.Purge()
+				break
+			}
+		}
+	}
+}
+
+// InvalidateCaches drops accountID from every cache, or empties them all when
+// accountID is empty.
+func (s *Store) InvalidateCaches(accountID string) {
+	for _, cache := range s.Caches {
+		if accountID == "" {
+			cache.Purge()
+		} else {
+			cache.Invalidate(accountID)
+		}
+	}
+}
+
+type cachedUsers struct {
+	UserStore
+	cache *Cache
+}
+
+func (s *cachedUsers) GetUser(ctx context.Context, accountID string) (*models.User, error) {
+	value, err := s.cache.load(accountID, func() (interface{}, error) {
+		user, err := s.UserStore.GetUser(ctx, accountID)
+		if err != nil {
+			return nil, err
+		}
+		return *user, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user := value.(models.User)
+	return &user, nil
+}
+
+func (s *cachedUsers) SetLastLogout(ctx context.Context, accountID string, at time.Time) error {
+	defer s.cache.Invalidate(accountID)
+	return s.UserStore.SetLastLogout(ctx, accountID, at)
+}
+
+type cachedFriends struct {
+	FriendStore
+	cache *Cache
+}
+
+func (s *cachedFriends) GetFriends(ctx context.Context, accountID string) (*models.Friends, error) {
+	value, err := s.cache.load(accountID, func() (interface{}, error) {
+		friends, err := s.FriendStore.GetFriends(ctx, accountID)
+		if err != nil {
+			return nil, err
+		}
+		return *copyFriends(*friends), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return copyFriends(value.(models.Friends)), nil
+}
+
+func (s *cachedFriends) AddFriendEntry(ctx context.Context, accountID, list, friendID string) error {
+	defer s.cache.Invalidate(accountID)
+	return s.FriendStore.AddFriendEntry(ctx, accountID, list, friendID)
+}
+
+func (s *cachedFriends) RemoveFriendEntry(ctx context.Context, accountID, friendID string, lists ...string) error {
+	defer s.cache.Invalidate(accountID)
+	return s.FriendStore.RemoveFriendEntry(ctx, accountID, friendID, lists...)
+}
+
+func (s *cachedFriends) ClearFriendList(ctx context.Context, accountID, list string) error {
+	defer s.cache.Invalidate(accountID)
+	return s.FriendStore.ClearFriendList(ctx, accountID, list)
+}
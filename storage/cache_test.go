@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingFetch returns a fetch function that counts its calls and, when
+// gate is set, waits for it before returning.
+func countingFetch(value string, calls *int, mu *sync.Mutex, gate chan struct{}) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		mu.Lock()
+		*calls++
+		mu.Unlock()
+		if gate != nil {
+			<-gate
+		}
+		return value, nil
+	}
+}
+
+func TestCacheLoad(t *testing.T) {
+	cache := newCache("test", time.Minute, 10)
+	var mu sync.Mutex
+	calls := 0
+
+	for i := 0; i < 3; i++ {
+		value, err := cache.load("alice", countingFetch("v1", &calls, &mu, nil))
+		if err != nil || value != "v1" {
+			t.Fatalf("load = %v, %v", value, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("fetched %d times, want 1", calls)
+	}
+	if stats := cache.Stats(); stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestCacheFetchRacingInvalidation(t *testing.T) {
+	for name, invalidate := range map[string]func(*Cache){
+		"invalidate": func(c *Cache) { c.Invalidate("alice") },
+		"purge":      func(c *Cache) { c.Purge() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache := newCache("test", time.Minute, 10)
+			var mu sync.Mutex
+			calls := 0
+
+			// The fetch reads the old value, then the account changes and
+			// is invalidated before the fetch returns.
+			gate := make(chan struct{})
+			done := make(chan interface{})
+			go func() {
+				value, _ := cache.load("alice", countingFetch("old", &calls, &mu, gate))
+				done <- value
+			}()
+			for {
+				mu.Lock()
+				started := calls == 1
+				mu.Unlock()
+				if started {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			invalidate(cache)
+			close(gate)
+
+			if value := <-done; value != "old" {
+				t.Errorf("racing load returned %v, want what it read", value)
+			}
+
+			value, err := cache.load("alice", countingFetch("new", &calls, &mu, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value != "new" {
+				t.Errorf("load after the invalidation = %v, want new; the racing fetch was cached", value)
+			}
+
+			// The fetch after the invalidation is cached as usual.
+			if value, _ := cache.load("alice", countingFetch("newer", &calls, &mu, nil)); value != "new" {
+				t.Errorf("third load = %v, want the cached new", value)
+			}
+			if len(cache.fetches) != 0 {
+				t.Errorf("%d fetches still tracked", len(cache.fetches))
+			}
+		})
+	}
+}
+
+func TestCacheRewatch(t *testing.T) {
+	first := make(chan string)
+	second := make(chan string, 1)
+
+	var mu sync.Mutex
+	watches := 0
+	cache := newCache("test", time.Minute, 10)
+	cache.watch = func() (<-chan string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		watches++
+		if watches == 1 {
+			return first, nil
+		}
+		return second, nil
+	}
+
+	store := &Store{Caches: []*Cache{cache}}
+	if err := store.WatchInvalidations(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache.set("alice", "v1")
+	close(first)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := watches
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("change stream wasn't reopened after it ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Changes reported on the new stream still invalidate.
+	cache.set("bob", "v1")
+	second <- "bob"
+	deadline = time.Now().Add(time.Second)
+	for cache.Stats().Entries > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("change on the reopened stream didn't invalidate")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,475 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// NewMemory returns a Store that keeps everything in process memory, starting
+// with the users and friends in seed. Nothing survives a restart, so it is
+// meant for local runs and tests.
+func NewMemory(seed Seed) *Store {
+	users := map[string]models.User{}
+	for _, user := range seed.Users {
+		users[user.AccountID] = user
+	}
+	friends := map[string]models.Friends{}
+	for _, f := range seed.Friends {
+		friends[f.AccountID] = *copyFriends(f)
+	}
+
+	return &Store{
+		Users:    &memoryUsers{users: users},
+		Friends:  &memoryFriends{friends: friends},
+		Kicks:    &memoryKicks{},
+		Webhooks: &memoryWebhooks{deliveries: map[primitive.ObjectID]models.WebhookDelivery{}},
+		Outbox:   &memoryOutbox{messages: map[primitive.ObjectID]models.OutboxMessage{}},
+		Sessions: &memorySessions{sessions: map[string]models.SessionEntry{}, nodes: map[string]models.ClusterNode{}},
+	}
+}
+
+type memoryUsers struct {
+	mu    sync.Mutex
+	users map[string]models.User
+}
+
+func (s *memoryUsers) GetUser(_ context.Context, accountID string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[accountID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (s *memoryUsers) SetLastLogout(_ context.Context, accountID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[accountID]; ok {
+		user.LastLogout = at
+		s.users[accountID] = user
+	}
+	return nil
+}
+
+type memoryFriends struct {
+	mu      sync.Mutex
+	friends map[string]models.Friends
+}
+
+func (s *memoryFriends) GetFriends(_ context.Context, accountID string) (*models.Friends, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	friends, ok := s.friends[accountID]
+	if !ok {
+		return &models.Friends{AccountID: accountID}, nil
+	}
+
+	return copyFriends(friends), nil
+}
+
+func (s *memoryFriends) AddFriendEntry(_ context.Context, accountID, list, friendID string) error {
+	if err := checkLists(list); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	friends := s.friends[accountID]
+	friends.AccountID = accountID
+	entries := friends.List.Named(list)
+	for _, entry := range *entries {
+		if entry.AccountID == friendID {
+			return nil
+		}
+	}
+
+	*entries = append(*entries, models.FriendEntry{
+		AccountID: friendID,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+	})
+	s.friends[accountID] = friends
+	return nil
+}
+
+func (s *memoryFriends) RemoveFriendEntry(_ context.Context, accountID, friendID string, lists ...string) error {
+	if err := checkLists(lists...); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	friends, ok := s.friends[accountID]
+	if !ok {
+		return nil
+	}
+
+	for _, list := range lists {
+		entries := friends.List.Named(list)
+		kept := (*entries)[:0:0]
+		for _, entry := range *entries {
+			if entry.AccountID != friendID {
+				kept = append(kept, entry)
+			}
+		}
+		*entries = kept
+	}
+	s.friends[accountID] = friends
+	return nil
+}
+
+func (s *memoryFriends) ClearFriendList(_ context.Context, accountID, list string) error {
+	if err := checkLists(list); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	friends, ok := s.friends[accountID]
+	if !ok {
+		return nil
+	}
+	*friends.List.Named(list) = []models.FriendEntry{}
+	s.friends[accountID] = friends
+	return nil
+}
+
+// copyFriends returns a copy of friends that shares no lists with it.
+func copyFriends(friends models.Friends) *models.Friends {
+	list := friends.List
+	friends.List = models.FriendList{
+		Accepted: append([]models.FriendEntry(nil), list.Accepted...),
+		Incoming: append([]models.FriendEntry(nil), list.Incoming...),
+		Outgoing: append([]models.FriendEntry(nil), list.Outgoing...),
+		Blocked:  append([]models.FriendEntry(nil), list.Blocked...),
+	}
+	return &friends
+}
+
+type memoryKicks struct {
+	mu    sync.Mutex
+	kicks []models.Kick
+}
+
+func (s *memoryKicks) SaveKick(_ context.Context, kick *models.Kick) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if kick.ID.IsZero() {
+		kick.ID = primitive.NewObjectID()
+	}
+	s.kicks = append(s.kicks, *kick)
+	return nil
+}
+
+func (s *memoryKicks) CooldownUntil(_ context.Context, accountID string, now time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var until time.Time
+	for _, kick := range s.kicks {
+		if kick.AccountID == accountID && kick.CooldownUntil.After(now) && kick.CooldownUntil.After(until) {
+			until = kick.CooldownUntil
+		}
+	}
+	return until, nil
+}
+
+type memoryWebhooks struct {
+	mu         sync.Mutex
+	deliveries map[primitive.ObjectID]models.WebhookDelivery
+}
+
+func (s *memoryWebhooks) SaveDelivery(_ context.Context, delivery models.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if delivery.ID.IsZero() {
+		delivery.ID = primitive.NewObjectID()
+	}
+	s.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (s *memoryWebhooks) ClaimDelivery(_ context.Context, lease time.Duration) (*models.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var due *models.WebhookDelivery
+	for _, delivery := range s.deliveries {
+		if delivery.Failed || delivery.NextAttempt.After(now) {
+			continue
+		}
+		if due == nil || delivery.NextAttempt.Before(due.NextAttempt) {
+			d := delivery
+			due = &d
+		}
+	}
+	if due == nil {
+		return nil, ErrNotFound
+	}
+
+	claimed := *due
+	claimed.NextAttempt = now.Add(lease)
+	s.deliveries[claimed.ID] = claimed
+	return due, nil
+}
+
+func (s *memoryWebhooks) UpdateDelivery(_ context.Context, delivery *models.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored, ok := s.deliveries[delivery.ID]; ok {
+		stored.Attempts = delivery.Attempts
+		stored.LastError = delivery.LastError
+		stored.NextAttempt = delivery.NextAttempt
+		stored.Failed = delivery.Failed
+		s.deliveries[delivery.ID] = stored
+	}
+	return nil
+}
+
+func (s *memoryWebhooks) DeleteDelivery(_ context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.deliveries, id)
+	return nil
+}
+
+type memoryOutbox struct {
+	mu       sync.Mutex
+	messages map[primitive.ObjectID]models.OutboxMessage
+	watchers []chan struct{}
+}
+
+func (s *memoryOutbox) Insert(_ context.Context, msg *models.OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if msg.ID.IsZero() {
+		msg.ID = primitive.NewObjectID()
+	}
+	if msg.Created.IsZero() {
+		msg.Created = time.Now()
+	}
+	s.messages[msg.ID] = *msg
+
+	for _, watcher := range s.watchers {
+		select {
+		case watcher <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *memoryOutbox) Watch() (<-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inserted := make(chan struct{}, 1)
+	s.watchers = append(s.watchers, inserted)
+	return inserted, nil
+}
+
+func (s *memoryOutbox) Claim(_ context.Context, lease time.Duration) (*models.OutboxMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var ids []primitive.ObjectID
+	for id, msg := range s.messages {
+		switch {
+		case (msg.Status == "" || msg.Status == models.OutboxPending) && !msg.NextAttempt.After(now):
+		case msg.Status == models.OutboxProcessing && msg.LeaseUntil.Before(now):
+		default:
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, ErrNotFound
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Hex() < ids[j].Hex() })
+
+	msg := s.messages[ids[0]]
+	msg.Status = models.OutboxProcessing
+	msg.LeaseUntil = now.Add(lease)
+	msg.Attempts++
+	s.messages[msg.ID] = msg
+	return &msg, nil
+}
+
+func (s *memoryOutbox) HasEarlierDuplicate(_ context.Context, msg *models.OutboxMessage) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, other := range s.messages {
+		if other.IdempotencyKey == msg.IdempotencyKey && id.Hex() < msg.ID.Hex() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryOutbox) SetStatus(_ context.Context, id primitive.ObjectID, status, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	msg.Status = status
+	msg.Error = reason
+	msg.LeaseUntil = time.Time{}
+	msg.NextAttempt = time.Time{}
+	if status == models.OutboxDelivered {
+		msg.DeliveredAt = time.Now()
+	}
+	s.messages[id] = msg
+	return nil
+}
+
+func (s *memoryOutbox) Retry(_ context.Context, id primitive.ObjectID, reason string, next time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, ok := s.messages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	msg.Status = models.OutboxPending
+	msg.Error = reason
+	msg.LeaseUntil = time.Time{}
+	msg.NextAttempt = next
+	s.messages[id] = msg
+	return nil
+}
+
+func (s *memoryOutbox) Requeue(_ context.Context, accountID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for id, msg := range s.messages {
+		if msg.AccountID == accountID && msg.Status == models.OutboxQueued {
+			msg.Status = models.OutboxPending
+			s.messages[id] = msg
+			n++
+		}
+	}
+	return n, nil
+}
+
+// memorySessions is a session directory for a single process. Nodes only
+// share it when they run in the same process, as in tests.
+type memorySessions struct {
+	mu       sync.Mutex
+	sessions map[string]models.SessionEntry
+	nodes    map[string]models.ClusterNode
+}
+
+func (s *memorySessions) Claim(_ context.Context, entry models.SessionEntry, stale time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, existing := range s.sessions {
+		if existing.AccountID != entry.AccountID {
+			continue
+		}
+		if !existing.Seen.Before(stale) {
+			return ErrConflict
+		}
+		delete(s.sessions, id)
+	}
+	s.sessions[entry.ID] = entry
+	return nil
+}
+
+func (s *memorySessions) SetJID(_ context.Context, sessionID, jid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.sessions[sessionID]; ok {
+		entry.JID = jid
+		s.sessions[sessionID] = entry
+	}
+	return nil
+}
+
+func (s *memorySessions) Release(_ context.Context, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, sessionID)
+	return nil
+}
+
+func (s *memorySessions) Sessions(_ context.Context, accountID string, stale time.Time) ([]models.SessionEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := []models.SessionEntry{}
+	for _, entry := range s.sessions {
+		if entry.AccountID == accountID && !entry.Seen.Before(stale) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (s *memorySessions) Heartbeat(_ context.Context, node models.ClusterNode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodes[node.ID] = node
+	for id, entry := range s.sessions {
+		if entry.NodeID == node.ID {
+			entry.Seen = node.Seen
+			s.sessions[id] = entry
+		}
+	}
+	return nil
+}
+
+func (s *memorySessions) Nodes(_ context.Context, stale time.Time) ([]models.ClusterNode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nodes := []models.ClusterNode{}
+	for _, node := range s.nodes {
+		if !node.Seen.Before(stale) {
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes, nil
+}
+
+func (s *memorySessions) ReleaseNode(_ context.Context, nodeID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.nodes, nodeID)
+	for id, entry := range s.sessions {
+		if entry.NodeID == nodeID {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
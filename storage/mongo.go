@@ -0,0 +1,543 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const mongoTimeout = 5 * time.Second
+
+// NewMongo returns a Store backed by db.
+func NewMongo(db *mongo.Database) *Store {
+	return &Store{
+		Users:    &mongoUsers{db.Collection("users")},
+		Friends:  &mongoFriends{db.Collection("friends")},
+		Kicks:    &mongoKicks{db.Collection("kicks")},
+		Webhooks: &mongoWebhooks{db.Collection("webhook_deliveries")},
+		Outbox:   &mongoOutbox{db.Collection("xmpp_outbox")},
+		Sessions: &mongoSessions{sessions: db.Collection("sessions"), nodes: db.Collection("cluster_nodes")},
+	}
+}
+
+func createIndexes(collection *mongo.Collection, indexes []mongo.IndexModel) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := collection.Indexes().CreateMany(ctx, indexes); err != nil {
+		return fmt.Errorf("%s indexes: %w", collection.Name(), err)
+	}
+	return nil
+}
+
+func notFound(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// watchAccountIDs reports the accountId of every document changed in
+// collection, or an empty string for deletions, which don't carry one.
+func watchAccountIDs(collection *mongo.Collection) (<-chan string, error) {
+	ctx := context.Background()
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	stream, err := collection.Watch(ctx, mongo.Pipeline{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make(chan string, 64)
+	go func() {
+		defer close(changed)
+		defer stream.Close(ctx)
+
+		for stream.Next(ctx) {
+			var change struct {
+				FullDocument struct {
+					AccountID string `bson:"accountId"`
+				} `bson:"fullDocument"`
+			}
+			if err := stream.Decode(&change); err != nil {
+				changed <- ""
+				continue
+			}
+			changed <- change.FullDocument.AccountID
+		}
+	}()
+	return changed, nil
+}
+
+type mongoUsers struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoUsers) watchChanges() (<-chan string, error) {
+	return watchAccountIDs(s.collection)
+}
+
+func (s *mongoUsers) ensureIndexes() error {
+	return createIndexes(s.collection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "accountId", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+}
+
+func (s *mongoUsers) GetUser(ctx context.Context, accountID string) (*models.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	var user models.User
+	if err := s.collection.FindOne(ctx, bson.M{"accountId": accountID}).Decode(&user); err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (s *mongoUsers) SetLastLogout(ctx context.Context, accountID string, at time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	_, err := s.collection.UpdateOne(ctx, bson.M{"accountId": accountID}, bson.M{"$set": bson.M{"lastLogout": at}})
+	return err
+}
+
+type mongoFriends struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoFriends) watchChanges() (<-chan string, error) {
+	return watchAccountIDs(s.collection)
+}
+
+func (s *mongoFriends) ensureIndexes() error {
+	return createIndexes(s.collection, []mongo.IndexModel{
+		// One document per account, so concurrent upserts in AddFriendEntry
+		// can't create a second one.
+		{Keys: bson.D{{Key: "accountId", Value: 1}}, Options: options.Index().SetUnique(true)},
+	})
+}
+
+func (s *mongoFriends) GetFriends(ctx context.Context, accountID string) (*models.Friends, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	var friends models.Friends
+	err := s.collection.FindOne(ctx, bson.M{"accountId": accountID}).Decode(&friends)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return &models.Friends{AccountID: accountID}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &friends, nil
+}
+
+func (s *mongoFriends) AddFriendEntry(ctx context.Context, accountID, list, friendID string) error {
+	if err := checkLists(list); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	// Accounts without a friends document get one first, so the push below,
+	// which skips friends already in the list, has a document to match.
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"accountId": accountID},
+		bson.M{"$setOnInsert": bson.M{"accountId": accountID}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+
+	entry := models.FriendEntry{
+		AccountID: friendID,
+		Created:   time.Now().UTC().Format(time.RFC3339),
+	}
+
+	_, err = s.collection.UpdateOne(ctx,
+		bson.M{"accountId": accountID, "list." + list + ".accountId": bson.M{"$ne": friendID}},
+		bson.M{"$push": bson.M{"list." + list: entry}},
+	)
+	return err
+}
+
+func (s *mongoFriends) RemoveFriendEntry(ctx context.Context, accountID, friendID string, lists ...string) error {
+	if err := checkLists(lists...); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	pull := bson.M{}
+	for _, list := range lists {
+		pull["list."+list] = bson.M{"accountId": friendID}
+	}
+
+	_, err := s.collection.UpdateOne(ctx, bson.M{"accountId": accountID}, bson.M{"$pull": pull})
+	return err
+}
+
+func (s *mongoFriends) ClearFriendList(ctx context.Context, accountID, list string) error {
+	if err := checkLists(list); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"accountId": accountID},
+		bson.M{"$set": bson.M{"list." + list: []models.FriendEntry{}}},
+	)
+	return err
+}
+
+type mongoKicks struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoKicks) ensureIndexes() error {
+	return createIndexes(s.collection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "accountId", Value: 1}, {Key: "created", Value: -1}}},
+	})
+}
+
+func (s *mongoKicks) SaveKick(ctx context.Context, kick *models.Kick) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	result, err := s.collection.InsertOne(ctx, kick)
+	if err != nil {
+		return err
+	}
+	if id, ok := result.InsertedID.(primitive.ObjectID); ok {
+		kick.ID = id
+	}
+	return nil
+}
+
+func (s *mongoKicks) CooldownUntil(ctx context.Context, accountID string, now time.Time) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	var kick models.Kick
+	err := s.collection.FindOne(ctx,
+		bson.M{"accountId": accountID, "cooldownUntil": bson.M{"$gt": now}},
+		options.FindOne().SetSort(bson.D{{Key: "cooldownUntil", Value: -1}}),
+	).Decode(&kick)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return kick.CooldownUntil, nil
+}
+
+type mongoWebhooks struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoWebhooks) ensureIndexes() error {
+	return createIndexes(s.collection, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "failed", Value: 1}, {Key: "nextAttempt", Value: 1}}},
+	})
+}
+
+func (s *mongoWebhooks) SaveDelivery(ctx context.Context, delivery models.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	_, err := s.collection.InsertOne(ctx, delivery)
+	return err
+}
+
+func (s *mongoWebhooks) ClaimDelivery(ctx context.Context, lease time.Duration) (*models.WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{"failed": false, "nextAttempt": bson.M{"$lte": now}}
+	update := bson.M{"$set": bson.M{"nextAttempt": now.Add(lease)}}
+	opts := options.FindOneAndUpdate().SetSort(bson.M{"nextAttempt": 1})
+
+	var delivery models.WebhookDelivery
+	if err := s.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&delivery); err != nil {
+		return nil, notFound(err)
+	}
+	return &delivery, nil
+}
+
+func (s *mongoWebhooks) UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	_, err := s.collection.UpdateByID(ctx, delivery.ID, bson.M{"$set": bson.M{
+		"attempts":    delivery.Attempts,
+		"lastError":   delivery.LastError,
+		"nextAttempt": delivery.NextAttempt,
+		"failed":      delivery.Failed,
+	}})
+	return err
+}
+
+func (s *mongoWebhooks) DeleteDelivery(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	_, err := s.collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+type mongoOutbox struct {
+	collection *mongo.Collection
+}
+
+func (s *mongoOutbox) ensureIndexes() error {
+	return createIndexes(s.collection, []mongo.IndexModel{
+		{
+			// Producers retrying an insert get a duplicate key error instead
+			// of a second message.
+			Keys: bson.D{{Key: "idempotencyKey", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"idempotencyKey": bson.M{"$type": "string"}}),
+		},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created", Value: 1}}},
+		{Keys: bson.D{{Key: "accountId", Value: 1}, {Key: "status", Value: 1}}},
+	})
+}
+
+func (s *mongoOutbox) Insert(ctx context.Context, msg *models.OutboxMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	if msg.ID.IsZero() {
+		msg.ID = primitive.NewObjectID()
+	}
+	if msg.Created.IsZero() {
+		msg.Created = time.Now()
+	}
+
+	_, err := s.collection.InsertOne(ctx, msg)
+	return err
+}
+
+// Watch uses a change stream, which needs a replica set or sharded cluster.
+func (s *mongoOutbox) Watch() (<-chan struct{}, error) {
+	ctx := context.Background()
+
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{"operationType": "insert"}}}}
+	stream, err := s.collection.Watch(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	inserted := make(chan struct{}, 1)
+	go func() {
+		defer close(inserted)
+		defer stream.Close(ctx)
+
+		for stream.Next(ctx) {
+			select {
+			case inserted <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return inserted, nil
+}
+
+func (s *mongoOutbox) Claim(ctx context.Context, lease time.Duration) (*models.OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{"$or": []bson.M{
+		{
+			"status":      bson.M{"$in": []interface{}{nil, "", models.OutboxPending}},
+			"nextAttempt": bson.M{"$not": bson.M{"$gt": now}},
+		},
+		{"status": models.OutboxProcessing, "leaseUntil": bson.M{"$lt": now}},
+	}}
+	update := bson.M{
+		"$set": bson.M{"status": models.OutboxProcessing, "leaseUntil": now.Add(lease)},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	var msg models.OutboxMessage
+	if err := s.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&msg); err != nil {
+		return nil, notFound(err)
+	}
+	return &msg, nil
+}
+
+func (s *mongoOutbox) HasEarlierDuplicate(ctx context.Context, msg *models.OutboxMessage) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	count, err := s.collection.CountDocuments(ctx, bson.M{
+		"idempotencyKey": msg.IdempotencyKey,
+		"_id":            bson.M{"$lt": msg.ID},
+	})
+	return count > 0, err
+}
+
+func (s *mongoOutbox) SetStatus(ctx context.Context, id primitive.ObjectID, status, reason string) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	set := bson.M{"status": status}
+	unset := bson.M{"leaseUntil": "", "nextAttempt": ""}
+	if reason != "" {
+		set["error"] = reason
+	} else {
+		unset["error"] = ""
+	}
+	if status == models.OutboxDelivered {
+		set["deliveredAt"] = time.Now()
+	}
+
+	_, err := s.collection.UpdateByID(ctx, id, bson.M{"$set": set, "$unset": unset})
+	return err
+}
+
+func (s *mongoOutbox) Retry(ctx context.Context, id primitive.ObjectID, reason string, next time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	_, err := s.collection.UpdateByID(ctx, id, bson.M{
+		"$set":   bson.M{"status": models.OutboxPending, "error": reason, "nextAttempt": next},
+		"$unset": bson.M{"leaseUntil": ""},
+	})
+	return err
+}
+
+func (s *mongoOutbox) Requeue(ctx context.Context, accountID string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	result, err := s.collection.UpdateMany(ctx,
+		bson.M{"accountId": accountID, "status": models.OutboxQueued},
+		bson.M{"$set": bson.M{"status": models.OutboxPending}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+type mongoSessions struct {
+	sessions *mongo.Collection
+	nodes    *mongo.Collection
+}
+
+func (s *mongoSessions) ensureIndexes() error {
+	return createIndexes(s.sessions, []mongo.IndexModel{
+		// One session per account across the cluster.
+		{Keys: bson.D{{Key: "accountId", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "nodeId", Value: 1}}},
+	})
+}
+
+func (s *mongoSessions) Claim(ctx context.Context, entry models.SessionEntry, stale time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	if _, err := s.sessions.DeleteMany(ctx, bson.M{"accountId": entry.AccountID, "seen": bson.M{"$lt": stale}}); err != nil {
+		return err
+	}
+
+	_, err := s.sessions.InsertOne(ctx, entry)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+func (s *mongoSessions) SetJID(ctx context.Context, sessionID, jid string) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	_, err := s.sessions.UpdateByID(ctx, sessionID, bson.M{"$set": bson.M{"jid": jid}})
+	return err
+}
+
+func (s *mongoSessions) Release(ctx context.Context, sessionID string) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	_, err := s.sessions.DeleteOne(ctx, bson.M{"_id": sessionID})
+	return err
+}
+
+func (s *mongoSessions) Sessions(ctx context.Context, accountID string, stale time.Time) ([]models.SessionEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	cursor, err := s.sessions.Find(ctx, bson.M{"accountId": accountID, "seen": bson.M{"$gte": stale}})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []models.SessionEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (s *mongoSessions) Heartbeat(ctx context.Context, node models.ClusterNode) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	_, err := s.nodes.UpdateByID(ctx, node.ID,
+		bson.M{"$set": bson.M{"address": node.Address, "seen": node.Seen}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.sessions.UpdateMany(ctx, bson.M{"nodeId": node.ID}, bson.M{"$set": bson.M{"seen": node.Seen}})
+	return err
+}
+
+func (s *mongoSessions) Nodes(ctx context.Context, stale time.Time) ([]models.ClusterNode, error) {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	cursor, err := s.nodes.Find(ctx, bson.M{"seen": bson.M{"$gte": stale}})
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []models.ClusterNode{}
+	if err := cursor.All(ctx, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (s *mongoSessions) ReleaseNode(ctx context.Context, nodeID string) error {
+	ctx, cancel := context.WithTimeout(ctx, mongoTimeout)
+	defer cancel()
+
+	if _, err := s.nodes.DeleteOne(ctx, bson.M{"_id": nodeID}); err != nil {
+		return err
+	}
+	_, err := s.sessions.DeleteMany(ctx, bson.M{"nodeId": nodeID})
+	return err
+}
@@ -0,0 +1,161 @@
+// Package storage holds the persistence interfaces Voryn depends on, with a
+// MongoDB implementation for production and an in-memory one for local runs
+// and tests.
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrNotFound is returned when a lookup or claim matches nothing.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when an account already has a session.
+	ErrConflict = errors.New("account already has a session")
+)
+
+// Seed is the data a memory store starts with, so local runs have accounts to
+// log in with.
+type Seed struct {
+	Users   []models.User    `json:"users"`
+	Friends []models.Friends `json:"friends"`
+}
+
+// ReadSeed reads a Seed from a JSON file.
+func ReadSeed(path string) (Seed, error) {
+	var seed Seed
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return seed, err
+	}
+	if err := json.Unmarshal(data, &seed); err != nil {
+		return seed, fmt.Errorf("%s: %w", path, err)
+	}
+	return seed, nil
+}
+
+// Store bundles the repositories the server uses.
+type Store struct {
+	Users    UserStore
+	Friends  FriendStore
+	Kicks    KickStore
+	Webhooks WebhookStore
+	Outbox   OutboxStore
+	Sessions SessionDirectory
+
+	// Caches are the read-through caches in front of the stores, if any.
+	Caches []*Cache
+}
+
+// indexer is implemented by stores that need database indexes.
+type indexer interface {
+	ensureIndexes() error
+}
+
+// EnsureIndexes creates the indexes the stores rely on, where the backend
+// uses any. It is safe to call on every start.
+func (s *Store) EnsureIndexes() error {
+	for _, store := range []interface{}{s.Users, s.Friends, s.Kicks, s.Webhooks, s.Outbox, s.Sessions} {
+		if i, ok := store.(indexer); ok {
+			if err := i.ensureIndexes(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type UserStore interface {
+	GetUser(ctx context.Context, accountID string) (*models.User, error)
+	SetLastLogout(ctx context.Context, accountID string, at time.Time) error
+}
+
+// FriendStore manages friends documents. The list arguments name one of the
+// lists of models.FriendList: "accepted", "incoming", "outgoing" or "blocked";
+// any other name is an error.
+type FriendStore interface {
+	// GetFriends returns an empty document for accounts that have none.
+	GetFriends(ctx context.Context, accountID string) (*models.Friends, error)
+	// AddFriendEntry appends friendID to a list unless it is already there,
+	// creating the account's friends document if it has none.
+	AddFriendEntry(ctx context.Context, accountID, list, friendID string) error
+	RemoveFriendEntry(ctx context.Context, accountID, friendID string, lists ...string) error
+	ClearFriendList(ctx context.Context, accountID, list string) error
+}
+
+func checkLists(lists ...string) error {
+	var friends models.FriendList
+	for _, list := range lists {
+		if friends.Named(list) == nil {
+			return fmt.Errorf("unknown friend list %q", list)
+		}
+	}
+	return nil
+}
+
+type KickStore interface {
+	SaveKick(ctx context.Context, kick *models.Kick) error
+	// CooldownUntil returns the latest reconnect cooldown end of the kicks of
+	// accountID that is after now, or the zero time when there is none.
+	CooldownUntil(ctx context.Context, accountID string, now time.Time) (time.Time, error)
+}
+
+// WebhookStore is the retry queue of webhook deliveries.
+type WebhookStore interface {
+	SaveDelivery(ctx context.Context, delivery models.WebhookDelivery) error
+	// ClaimDelivery returns the earliest due delivery that hasn't failed and
+	// pushes its next attempt back by lease.
+	ClaimDelivery(ctx context.Context, lease time.Duration) (*models.WebhookDelivery, error)
+	// UpdateDelivery saves the attempt count, error, schedule and failed flag.
+	UpdateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error
+	DeleteDelivery(ctx context.Context, id primitive.ObjectID) error
+}
+
+// OutboxStore is the xmpp_outbox collection other services write messages to.
+type OutboxStore interface {
+	Insert(ctx context.Context, msg *models.OutboxMessage) error
+	// Watch signals on the returned channel when messages are inserted. It
+	// returns an error when the backend can't notify, and the channel is
+	// closed if notifications stop.
+	Watch() (<-chan struct{}, error)
+	// Claim leases the oldest pending message that is due, or one whose
+	// lease ran out, and counts the attempt.
+	Claim(ctx context.Context, lease time.Duration) (*models.OutboxMessage, error)
+	// HasEarlierDuplicate reports whether an older message shares msg's
+	// idempotency key.
+	HasEarlierDuplicate(ctx context.Context, msg *models.OutboxMessage) (bool, error)
+	SetStatus(ctx context.Context, id primitive.ObjectID, status, reason string) error
+	// Retry makes a message pending again, due at next.
+	Retry(ctx context.Context, id primitive.ObjectID, reason string, next time.Time) error
+	// Requeue makes the queued messages of accountID pending again.
+	Requeue(ctx context.Context, accountID string) (int64, error)
+}
+
+// SessionDirectory is the record of which node holds each account's session,
+// shared by the nodes of a cluster. Entries and nodes count as gone once they
+// haven't been seen since the stale time passed in.
+type SessionDirectory interface {
+	// Claim records a session. It returns ErrConflict when the account has a
+	// session seen since stale on any node.
+	Claim(ctx context.Context, entry models.SessionEntry, stale time.Time) error
+	// SetJID records the full JID a session bound.
+	SetJID(ctx context.Context, sessionID, jid string) error
+	Release(ctx context.Context, sessionID string) error
+	// Sessions returns the sessions of accountID seen since stale.
+	Sessions(ctx context.Context, accountID string, stale time.Time) ([]models.SessionEntry, error)
+	// Heartbeat marks node and its sessions as seen now.
+	Heartbeat(ctx context.Context, node models.ClusterNode) error
+	// Nodes returns the nodes seen since stale.
+	Nodes(ctx context.Context, stale time.Time) ([]models.ClusterNode, error)
+	// ReleaseNode drops a node and the sessions it left behind, e.g. when it
+	// shuts down or before it starts again after a crash.
+	ReleaseNode(ctx context.Context, nodeID string) error
+}
@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The cases below run against every backend. The Mongo one needs a server:
+// set VORYN_TEST_MONGO_URI to run it, for example to mongodb://127.0.0.1:27017/.
+// Each run uses a database of its own and drops it afterwards.
+
+var testSeed = Seed{
+	Users: []models.User{
+		{AccountID: "alice", Username: "Alice"},
+		{AccountID: "bob", Username: "Bob"},
+	},
+	Friends: []models.Friends{{
+		AccountID: "alice",
+		List: models.FriendList{
+			Accepted: []models.FriendEntry{{AccountID: "bob", Created: "2024-01-01T00:00:00Z"}},
+		},
+	}},
+}
+
+// forEachBackend runs test against a fresh store of every available backend,
+// each holding testSeed.
+func forEachBackend(t *testing.T, test func(t *testing.T, store *Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemory(testSeed))
+	})
+	t.Run("mongo", func(t *testing.T) {
+		test(t, newTestMongo(t))
+	})
+}
+
+func newTestMongo(t *testing.T) *Store {
+	uri := os.Getenv("VORYN_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("VORYN_TEST_MONGO_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("connecting to %s: %v", uri, err)
+	}
+	db := client.Database(fmt.Sprintf("voryn_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = db.Drop(ctx)
+		_ = client.Disconnect(ctx)
+	})
+
+	for _, user := range testSeed.Users {
+		if _, err := db.Collection("users").InsertOne(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, friends := range testSeed.Friends {
+		if _, err := db.Collection("friends").InsertOne(ctx, friends); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewMongo(db)
+	if err := store.EnsureIndexes(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func friendIDs(entries []models.FriendEntry) []string {
+	ids := []string{}
+	for _, entry := range entries {
+		ids = append(ids, entry.AccountID)
+	}
+	return ids
+}
+
+func equalIDs(got []models.FriendEntry, want ...string) bool {
+	ids := friendIDs(got)
+	if len(ids) != len(want) {
+		return false
+	}
+	for i := range ids {
+		if ids[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUsers(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store *Store) {
+		ctx := context.Background()
+		user, err := store.Users.GetUser(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Username != "Alice" {
+			t.Errorf("username = %q, want Alice", user.Username)
+		}
+
+		if _, err := store.Users.GetUser(ctx, "nobody"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetUser of an unknown account = %v, want ErrNotFound", err)
+		}
+
+		at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		if err := store.Users.SetLastLogout(ctx, "alice", at); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Users.SetLastLogout(ctx, "nobody", at); err != nil {
+			t.Errorf("SetLastLogout of an unknown account: %v", err)
+		}
+		user, err = store.Users.GetUser(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !user.LastLogout.Equal(at) {
+			t.Errorf("last logout = %v, want %v", user.LastLogout, at)
+		}
+		if _, err := store.Users.GetUser(ctx, "nobody"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("SetLastLogout created an account: %v", err)
+		}
+	})
+}
+
+func TestFriends(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store *Store) {
+		ctx := context.Background()
+		friends := store.Friends
+
+		got, err := friends.GetFriends(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalIDs(got.List.Accepted, "bob") {
+			t.Errorf("accepted = %v, want [bob]", friendIDs(got.List.Accepted))
+		}
+
+		got, err = friends.GetFriends(ctx, "carol")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.AccountID != "carol" || len(got.List.Accepted) != 0 {
+			t.Errorf("friends of an account without a document = %+v", got)
+		}
+
+		// Adding creates the document, and adding twice keeps one entry.
+		for i := 0; i < 2; i++ {
+			if err := friends.AddFriendEntry(ctx, "carol", "outgoing", "alice"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err = friends.GetFriends(ctx, "carol")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalIDs(got.List.Outgoing, "alice") {
+			t.Errorf("outgoing = %v, want [alice]", friendIDs(got.List.Outgoing))
+		}
+		if got.List.Outgoing[0].Created == "" {
+			t.Error("entry has no creation time")
+		}
+
+		if err := friends.AddFriendEntry(ctx, "alice", "incoming", "carol"); err != nil {
+			t.Fatal(err)
+		}
+		if err := friends.AddFriendEntry(ctx, "alice", "blocked", "dave"); err != nil {
+			t.Fatal(err)
+		}
+		if err := friends.RemoveFriendEntry(ctx, "alice", "carol", "incoming", "accepted"); err != nil {
+			t.Fatal(err)
+		}
+		if err := friends.RemoveFriendEntry(ctx, "nobody", "carol", "incoming"); err != nil {
+			t.Errorf("RemoveFriendEntry on an account without a document: %v", err)
+		}
+		if err := friends.ClearFriendList(ctx, "alice", "blocked"); err != nil {
+			t.Fatal(err)
+		}
+		if err := friends.ClearFriendList(ctx, "nobody", "blocked"); err != nil {
+			t.Errorf("ClearFriendList on an account without a document: %v", err)
+		}
+
+		got, err = friends.GetFriends(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !equalIDs(got.List.Accepted, "bob") || len(got.List.Incoming) != 0 || len(got.List.Blocked) != 0 {
+			t.Errorf("alice's lists = %+v", got.List)
+		}
+
+		// A returned document is a copy.
+		got.List.Accepted[0].AccountID = "mallory"
+		if again, _ := friends.GetFriends(ctx, "alice"); !equalIDs(again.List.Accepted, "bob") {
+			t.Error("changing a returned document changed the store")
+		}
+
+		if err := friends.AddFriendEntry(ctx, "alice", "pending", "bob"); err == nil {
+			t.Error("AddFriendEntry accepted an unknown list")
+		}
+		if err := friends.RemoveFriendEntry(ctx, "alice", "bob", "accepted", "pending"); err == nil {
+			t.Error("RemoveFriendEntry accepted an unknown list")
+		}
+		if err := friends.ClearFriendList(ctx, "alice", "pending"); err == nil {
+			t.Error("ClearFriendList accepted an unknown list")
+		}
+		if again, _ := friends.GetFriends(ctx, "alice"); !equalIDs(again.List.Accepted, "bob") {
+			t.Error("a call with an unknown list changed the document")
+		}
+	})
+}
+
+func TestKicks(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store *Store) {
+		ctx := context.Background()
+		kick := &models.Kick{AccountID: "alice"}
+		if err := store.Kicks.SaveKick(ctx, kick); err != nil {
+			t.Fatal(err)
+		}
+		if kick.ID.IsZero() {
+			t.Error("saved kick has no ID")
+		}
+
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		for _, until := range []time.Time{now.Add(time.Hour), now.Add(time.Minute), now.Add(-time.Minute)} {
+			if err := store.Kicks.SaveKick(ctx, &models.Kick{AccountID: "alice", CooldownUntil: until}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if until, err := store.Kicks.CooldownUntil(ctx, "alice", now); err != nil || !until.Equal(now.Add(time.Hour)) {
+			t.Errorf("CooldownUntil = %v, %v; want the latest cooldown", until, err)
+		}
+		if until, err := store.Kicks.CooldownUntil(ctx, "alice", now.Add(2*time.Hour)); err != nil || !until.IsZero() {
+			t.Errorf("CooldownUntil = %v, %v after every cooldown ended", until, err)
+		}
+		if until, err := store.Kicks.CooldownUntil(ctx, "bob", now); err != nil || !until.IsZero() {
+			t.Errorf("CooldownUntil = %v, %v for an account that wasn't kicked", until, err)
+		}
+	})
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store *Store) {
+		ctx := context.Background()
+		webhooks := store.Webhooks
+		now := time.Now()
+
+		later := models.WebhookDelivery{ID: primitive.NewObjectID(), URL: "http://b", NextAttempt: now.Add(-time.Second)}
+		earlier := models.WebhookDelivery{ID: primitive.NewObjectID(), URL: "http://a", NextAttempt: now.Add(-time.Minute)}
+		notDue := models.WebhookDelivery{ID: primitive.NewObjectID(), URL: "http://c", NextAttempt: now.Add(time.Hour)}
+		for _, d := range []models.WebhookDelivery{later, earlier, notDue} {
+			if err := webhooks.SaveDelivery(ctx, d); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		claimed, err := webhooks.ClaimDelivery(ctx, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed.ID != earlier.ID {
+			t.Errorf("claimed %s first, want the earliest due", claimed.URL)
+		}
+
+		claimed.Attempts = 3
+		claimed.LastError = "boom"
+		claimed.Failed = true
+		if err := webhooks.UpdateDelivery(ctx, claimed); err != nil {
+			t.Fatal(err)
+		}
+
+		second, err := webhooks.ClaimDelivery(ctx, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second.ID != later.ID {
+			t.Errorf("claimed %s second, want http://b", second.URL)
+		}
+		if err := webhooks.DeleteDelivery(ctx, second.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		// What is left is leased, failed or not due.
+		if d, err := webhooks.ClaimDelivery(ctx, time.Minute); !errors.Is(err, ErrNotFound) {
+			t.Errorf("claimed %+v, want nothing due", d)
+		}
+	})
+}
+
+func TestOutbox(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store *Store) {
+		ctx := context.Background()
+		outbox := store.Outbox
+
+		first := &models.OutboxMessage{AccountID: "alice", IdempotencyKey: "k1"}
+		second := &models.OutboxMessage{AccountID: "bob"}
+		for _, msg := range []*models.OutboxMessage{first, second} {
+			if err := outbox.Insert(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.ID.IsZero() || msg.Created.IsZero() {
+				t.Fatalf("inserted message has no ID or creation time: %+v", msg)
+			}
+		}
+
+		claimed, err := outbox.Claim(ctx, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed.ID != first.ID || claimed.Status != models.OutboxProcessing || claimed.Attempts != 1 {
+			t.Errorf("first claim = %+v, want the oldest message, processing, attempt 1", claimed)
+		}
+		if dup, err := outbox.HasEarlierDuplicate(ctx, claimed); err != nil || dup {
+			t.Errorf("HasEarlierDuplicate of the first message = %v, %v", dup, err)
+		}
+
+		// A retried message isn't claimed again before it is due.
+		if err := outbox.Retry(ctx, first.ID, "queue full", time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		claimed, err = outbox.Claim(ctx, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed.ID != second.ID {
+			t.Errorf("claimed %s, want the message not backing off", claimed.AccountID)
+		}
+		if _, err := outbox.Claim(ctx, time.Minute); !errors.Is(err, ErrNotFound) {
+			t.Errorf("claimed a message that is leased or backing off: %v", err)
+		}
+
+		if err := outbox.Retry(ctx, first.ID, "queue full", time.Now().Add(-time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		claimed, err = outbox.Claim(ctx, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed.ID != first.ID || claimed.Attempts != 2 || claimed.Error != "queue full" {
+			t.Errorf("claim of a due retry = %+v", claimed)
+		}
+
+		if err := outbox.SetStatus(ctx, first.ID, models.OutboxQueued, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := outbox.SetStatus(ctx, second.ID, models.OutboxDelivered, ""); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := outbox.Requeue(ctx, "alice"); err != nil || n != 1 {
+			t.Errorf("Requeue = %d, %v, want 1", n, err)
+		}
+		claimed, err = outbox.Claim(ctx, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed.ID != first.ID || claimed.Error != "" {
+			t.Errorf("claim after requeue = %+v", claimed)
+		}
+		if _, err := outbox.Claim(ctx, time.Minute); !errors.Is(err, ErrNotFound) {
+			t.Errorf("claimed a delivered message: %v", err)
+		}
+	})
+}
+
+func TestReadSeed(t *testing.T) {
+	seed, err := ReadSeed("../seed.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seed.Users) == 0 || len(seed.Friends) == 0 {
+		t.Fatalf("seed has %d users and %d friends documents", len(seed.Users), len(seed.Friends))
+	}
+
+	store := NewMemory(seed)
+	ctx := context.Background()
+	for _, user := range seed.Users {
+		if _, err := store.Users.GetUser(ctx, user.AccountID); err != nil {
+			t.Errorf("seeded user %s: %v", user.AccountID, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package structs
+
+import "container/list"
+
+// capsCacheSize bounds the verified caps a CapsCache holds. Clients choose
+// their ver strings, so without a bound they could fill memory with them.
+const capsCacheSize = 1024
+
+type DiscoIdentity struct {
+	Category string
+	Type     string
+	Lang     string
+	Name     string
+}
+
+type DiscoInfo struct {
+	Identities []DiscoIdentity
+	Features   []string
+}
+
+// CapsCache maps verified caps ver strings to the disco#info they stand for,
+// evicting the least recently used beyond capsCacheSize. It is not safe for
+// concurrent use; Server.CapsMutex guards the server's. The zero value is
+// ready to use.
+type CapsCache struct {
+	items map[string]*list.Element
+	order list.List
+}
+
+type capsEntry struct {
+	ver  string
+	info DiscoInfo
+}
+
+// Get returns the disco#info of ver, if it is cached.
+func (c *CapsCache) Get(ver string) (DiscoInfo, bool) {
+	el, ok := c.items[ver]
+	if !ok {
+		return DiscoInfo{}, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*capsEntry).info, true
+}
+
+// Add caches info as what ver stands for.
+func (c *CapsCache) Add(ver string, info DiscoInfo) {
+	if c.items == nil {
+		c.items = map[string]*list.Element{}
+	}
+	if el, ok := c.items[ver]; ok {
+		el.Value.(*capsEntry).info = info
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[ver] = c.order.PushFront(&capsEntry{ver: ver, info: info})
+	for c.order.Len() > capsCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*capsEntry).ver)
+	}
+}
+
+// Len returns the number of cached ver strings.
+func (c *CapsCache) Len() int {
+	return c.order.Len()
+}
@@ -6,6 +6,8 @@ type Message struct {
 	XMLName xml.Name `xml:"message"`
 	From    string   `xml:"from,attr"`
 	To      string   `xml:"to,attr"`
+	ID      string   `xml:"id,attr,omitempty"`
+	Type    string   `xml:"type,attr,omitempty"`
 	XMLNS   string   `xml:"xmlns,attr"`
 	Body    string   `xml:"body"`
 }
@@ -0,0 +1,181 @@
+package structs
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SessionRegistry holds a server's sessions, indexed by account ID, bare JID
+// and full JID. Lookups take a read lock. Fan-out iterates a snapshot that is
+// rebuilt only after sessions change, so it never holds the lock while
+// writing to clients. The zero value is ready to use.
+type SessionRegistry struct {
+	mu        sync.RWMutex
+	keys      map[*Client]sessionKeys
+	byAccount map[string][]*Client
+	byBareJID map[string][]*Client
+	byJID     map[string]*Client
+
+	snapshot atomic.Pointer[[]*Client]
+}
+
+// sessionKeys are the index entries of a client, kept so they can be removed
+// after the client's fields change.
+type sessionKeys struct {
+	accountID string
+	bareJID   string
+	jid       string
+}
+
+func keysOf(client *Client) sessionKeys {
+	bare, _, _ := strings.Cut(client.JID, "/")
+	return sessionKeys{
+		accountID: client.AccountID,
+		bareJID:   strings.ToLower(bare),
+		jid:       client.JID,
+	}
+}
+
+// Add registers a client. Call Update after its account or JID change.
+func (r *SessionRegistry) Add(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.keys == nil {
+		r.keys = map[*Client]sessionKeys{}
+		r.byAccount = map[string][]*Client{}
+		r.byBareJID = map[string][]*Client{}
+		r.byJID = map[string]*Client{}
+	}
+	if _, ok := r.keys[client]; ok {
+		return
+	}
+	r.index(client)
+	r.snapshot.Store(nil)
+}
+
+// Update re-indexes a registered client after its AccountID or JID changed.
+func (r *SessionRegistry) Update(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.keys[client]; !ok {
+		return
+	}
+	r.unindex(client)
+	r.index(client)
+}
+
+// Remove unregisters a client. It reports whether the client was registered.
+func (r *SessionRegistry) Remove(client *Client) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.keys[client]; !ok {
+		return false
+	}
+	r.unindex(client)
+	delete(r.keys, client)
+	r.snapshot.Store(nil)
+	return true
+}
+
+func (r *SessionRegistry) index(client *Client) {
+	keys := keysOf(client)
+	r.keys[client] = keys
+	if keys.accountID != "" {
+		r.byAccount[keys.accountID] = append(r.byAccount[keys.accountID], client)
+	}
+	if keys.jid != "" {
+		r.byBareJID[keys.bareJID] = append(r.byBareJID[keys.bareJID], client)
+		r.byJID[keys.jid] = client
+	}
+}
+
+func (r *SessionRegistry) unindex(client *Client) {
+	keys := r.keys[client]
+	if keys.accountID != "" {
+		r.byAccount[keys.accountID] = without(r.byAccount[keys.accountID], client)
+		if len(r.byAccount[keys.accountID]) == 0 {
+			delete(r.byAccount, keys.accountID)
+		}
+	}
+	if keys.jid != "" {
+		r.byBareJID[keys.bareJID] = without(r.byBareJID[keys.bareJID], client)
+		if len(r.byBareJID[keys.bareJID]) == 0 {
+			delete(r.byBareJID, keys.bareJID)
+		}
+		if r.byJID[keys.jid] == client {
+			delete(r.byJID, keys.jid)
+		}
+	}
+}
+
+func without(clients []*Client, client *Client) []*Client {
+	for i, c := range clients {
+		if c == client {
+			return append(clients[:i:i], clients[i+1:]...)
+		}
+	}
+	return clients
+}
+
+// ByAccount returns the sessions of an account.
+func (r *SessionRegistry) ByAccount(accountID string) []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byAccount[accountID]
+}
+
+// FirstByAccount returns a session of an account, or nil.
+func (r *SessionRegistry) FirstByAccount(accountID string) *Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if clients := r.byAccount[accountID]; len(clients) > 0 {
+		return clients[0]
+	}
+	return nil
+}
+
+// ByBareJID returns the bound sessions of a bare JID.
+func (r *SessionRegistry) ByBareJID(bareJID string) []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byBareJID[strings.ToLower(bareJID)]
+}
+
+// ByJID returns the session bound to a full JID, or nil.
+func (r *SessionRegistry) ByJID(jid string) *Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.byJID[jid]
+}
+
+// Len returns the number of registered sessions.
+func (r *SessionRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.keys)
+}
+
+// Snapshot returns every registered session. The slice is shared between
+// callers until sessions change, so it must not be modified.
+func (r *SessionRegistry) Snapshot() []*Client {
+	if snapshot := r.snapshot.Load(); snapshot != nil {
+		return *snapshot
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if snapshot := r.snapshot.Load(); snapshot != nil {
+		return *snapshot
+	}
+
+	clients := make([]*Client, 0, len(r.keys))
+	for client := range r.keys {
+		clients = append(clients, client)
+	}
+	r.snapshot.Store(&clients)
+	return clients
+}
@@ -0,0 +1,129 @@
+package structs_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+	"github.com/RazerFrFr/Voryn/utils"
+)
+
+const (
+	benchSessions = 50000
+	benchFriends  = 100
+	benchDomain   = "example.com"
+)
+
+func benchAccount(i int) string {
+	return fmt.Sprintf("account%05d", i)
+}
+
+// newBenchServer returns a server holding benchSessions bound sessions, one
+// per account. The first account has the next benchFriends as friends.
+func newBenchServer() *structs.Server {
+	friends := models.Friends{AccountID: benchAccount(0)}
+	for i := 1; i <= benchFriends; i++ {
+		friends.List.Accepted = append(friends.List.Accepted, models.FriendEntry{AccountID: benchAccount(i)})
+	}
+
+	server := &structs.Server{
+		Domain: benchDomain,
+		Store:  storage.NewMemory(storage.Seed{Friends: []models.Friends{friends}}),
+	}
+	for i := 0; i < benchSessions; i++ {
+		accountID := benchAccount(i)
+		server.Clients.Add(&structs.Client{
+			ID:        fmt.Sprintf("session%05d", i),
+			AccountID: accountID,
+			JID:       accountID + "@" + benchDomain + "/V2:Fortnite:WIN::",
+			Outbound:  make(chan structs.Frame, 1),
+			Done:      make(chan struct{}),
+		})
+	}
+	return server
+}
+
+func TestRegistryIndexes(t *testing.T) {
+	var r structs.SessionRegistry
+	client := &structs.Client{ID: "s1", AccountID: "a1"}
+	r.Add(client)
+
+	if got := r.FirstByAccount("a1"); got != client {
+		t.Fatalf("FirstByAccount = %v", got)
+	}
+	if got := r.ByJID("a1@example.com/res"); got != nil {
+		t.Fatalf("unbound session found by JID")
+	}
+
+	client.JID = "a1@example.com/res"
+	r.Update(client)
+	if got := r.ByJID("a1@example.com/res"); got != client {
+		t.Errorf("ByJID after bind = %v", got)
+	}
+	if got := r.ByBareJID("A1@example.com"); len(got) != 1 {
+		t.Errorf("ByBareJID is case sensitive: %v", got)
+	}
+	if n := len(r.Snapshot()); n != 1 {
+		t.Errorf("snapshot has %d sessions", n)
+	}
+
+	if !r.Remove(client) || r.Remove(client) {
+		t.Error("Remove didn't report whether the session was registered")
+	}
+	if r.Len() != 0 || r.FirstByAccount("a1") != nil || r.ByJID(client.JID) != nil || len(r.Snapshot()) != 0 {
+		t.Error("removed session is still indexed")
+	}
+}
+
+func BenchmarkRegistryLookup(b *testing.B) {
+	server := newBenchServer()
+
+	b.Run("ByAccount", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if server.Clients.FirstByAccount(benchAccount(i%benchSessions)) == nil {
+				b.Fatal("session not found")
+			}
+		}
+	})
+	b.Run("ByJID", func(b *testing.B) {
+		jids := make([]string, benchSessions)
+		for i := range jids {
+			jids[i] = benchAccount(i) + "@" + benchDomain + "/V2:Fortnite:WIN::"
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if server.Clients.ByJID(jids[i%benchSessions]) == nil {
+				b.Fatal("session not found")
+			}
+		}
+	})
+}
+
+// BenchmarkPresenceFanout measures a presence update of an account with
+// benchFriends friends online among benchSessions sessions.
+func BenchmarkPresenceFanout(b *testing.B) {
+	server := newBenchServer()
+	sender := server.Clients.FirstByAccount(benchAccount(0))
+	friends := make([]*structs.Client, 0, benchFriends)
+	for i := 1; i <= benchFriends; i++ {
+		friends = append(friends, server.Clients.FirstByAccount(benchAccount(i)))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		utils.UpdatePresenceForFriends(context.Background(), server, sender, `{"Status":"Battle Royale Lobby"}`, false, false)
+
+		b.StopTimer()
+		for _, friend := range friends {
+			select {
+			case <-friend.Outbound:
+			default:
+				b.Fatal("friend wasn't sent the presence")
+			}
+		}
+		b.StartTimer()
+	}
+}
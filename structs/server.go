@@ -1,28 +1,116 @@
 package structs
 
 import (
+	"log/slog"
 	"sync"
+	"time"
 
+	"github.com/RazerFrFr/Voryn/storage"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Client struct {
+	ID                 string
 	Conn               *websocket.Conn
+	Outbound           chan Frame
+	Done               chan struct{}
+	CloseOnce          sync.Once
 	JID                string
 	AccountID          string
 	DisplayName        string
 	Token              string
 	Resource           string
-	LastPresenceUpdate struct {
-		Away   bool
-		Status string
+	Domain             string
+	RemoteAddr         string
+	ConnectedAt        time.Time
+	AuthenticatedAt    time.Time
+	LastPresenceUpdate PresenceUpdate
+	LastActivity       time.Time
+	AutoAway           bool
+	ActivityMutex      sync.Mutex
+	Caps               Caps
+	CapsMutex          sync.Mutex
+	Blocked            map[string]bool
+	BlockedMutex       sync.RWMutex
+	Authenticated      bool
+	InitialPresence    bool
+	Invisible          bool
+	DirectedPresence   map[string]bool
+	DirectedMutex      sync.Mutex
+	ClientExists       bool
+	ConnectionClosed   bool
+	SM                 StreamManagement
+}
+
+// LogValue attaches the session's identity to log records it is passed to.
+func (c *Client) LogValue() slog.Value {
+	attrs := []slog.Attr{slog.String("id", c.ID)}
+	if c.AccountID != "" {
+		attrs = append(attrs, slog.String("accountId", c.AccountID))
+	}
+	if c.JID != "" {
+		attrs = append(attrs, slog.String("jid", c.JID))
+	}
+	if c.RemoteAddr != "" {
+		attrs = append(attrs, slog.String("remoteAddr", c.RemoteAddr))
 	}
-	Authenticated    bool
-	ClientExists     bool
-	ConnectionClosed bool
+	return slog.GroupValue(attrs...)
+}
+
+// Frame is a stanza waiting in a client's outbound queue. Span, when valid, is
+// the span of the delivery the stanza belongs to; the write is traced as its
+// child from Queued on.
+type Frame struct {
+	Data   []byte
+	Span   trace.SpanContext
+	Queued time.Time
+}
+
+// PresenceUpdate is the presence a client last broadcast. Client.ActivityMutex
+// guards it along with LastActivity and AutoAway, which the idle checker
+// updates alongside the client's own goroutine.
+type PresenceUpdate struct {
+	Away   bool
+	Status string
 }
 
+// Caps is the XEP-0115 entity capabilities advertised in a client's presence.
+// Client.CapsMutex guards a client's, which other sessions read.
+type Caps struct {
+	Node string
+	Ver  string
+	Hash string
+}
+
+// CapsQuery is a disco#info query sent to a client to learn what its caps ver means.
+type CapsQuery struct {
+	Client *Client
+	Caps   Caps
+}
+
+// ResourceInfo is what the game encodes in a session's resource string.
+type ResourceInfo struct {
+	App      string
+	Platform string
+	Build    string
+}
+
+// Server is one virtual host: the sessions and storage of a single domain.
 type Server struct {
-	Clients      []*Client
-	ClientsMutex sync.Mutex
+	Domain    string
+	Clients   SessionRegistry
+	StartedAt time.Time
+	Store     *storage.Store
+
+	// OutboxWake is signalled when there may be new work in the outbox. It is
+	// nil unless the host consumes its outbox.
+	OutboxWake chan struct{}
+
+	// CapsCache holds the verified caps ver strings of the host's clients.
+	// PendingCaps tracks the disco#info queries sent to clients, keyed by iq
+	// id; a client has at most one.
+	CapsCache   CapsCache
+	PendingCaps map[string]CapsQuery
+	CapsMutex   sync.Mutex
 }
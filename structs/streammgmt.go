@@ -0,0 +1,35 @@
+package structs
+
+import (
+	"sync"
+	"time"
+)
+
+// StreamManagement is a client's XEP-0198 state. Mutex guards it, and is held
+// while a stanza is queued for the client so that the count of stanzas sent
+// matches the order they are written in.
+type StreamManagement struct {
+	Mutex sync.Mutex
+
+	Enabled bool
+	// ID names the session for resumption. It is empty when the client didn't
+	// ask for resumption or it is turned off.
+	ID string
+	// Inbound counts the stanzas handled from the client, Outbound those sent
+	// to it. Both wrap at 2^32 as XEP-0198 counters do.
+	Inbound  uint32
+	Outbound uint32
+	// Unacked holds the stanzas sent that the client hasn't acknowledged,
+	// oldest first. Only resumable sessions keep them.
+	Unacked [][]byte
+
+	// Detached is set once the connection of a resumable session dropped;
+	// the session stays registered until Expiry fires or it is resumed.
+	Detached bool
+	Expiry   *time.Timer
+	// Resumed is set once a new connection took the session over. Stanzas
+	// queued for it afterwards go to Successor, when it was resumed in this
+	// process, or are dropped.
+	Resumed   bool
+	Successor *Client
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+const nsLast = "jabber:iq:last"
+
+// MarkActive records a stanza from the client. Keepalive pings don't count as
+// activity. A client that was marked away by the idle checker gets its
+// previous presence back.
+func MarkActive(client *structs.Client, root map[string]interface{}, server *structs.Server) {
+	if iq, ok := root["iq"].(map[string]interface{}); ok {
+		if _, ping := iq["ping"]; ping {
+			return
+		}
+	}
+
+	client.ActivityMutex.Lock()
+	client.LastActivity = time.Now()
+	wasAway := client.AutoAway
+	client.AutoAway = false
+	status := client.LastPresenceUpdate.Status
+	client.ActivityMutex.Unlock()
+
+	if wasAway && client.JID != "" {
+		UpdatePresenceForFriends(context.Background(), server, client, status, false, false)
+	}
+}
+
+// LastPresence returns the presence client last broadcast.
+func LastPresence(client *structs.Client) structs.PresenceUpdate {
+	client.ActivityMutex.Lock()
+	defer client.ActivityMutex.Unlock()
+	return client.LastPresenceUpdate
+}
+
+func setLastPresence(client *structs.Client, presence structs.PresenceUpdate) {
+	client.ActivityMutex.Lock()
+	defer client.ActivityMutex.Unlock()
+	client.LastPresenceUpdate = presence
+}
+
+// lastActivity returns when client last sent a stanza and whether the idle
+// checker marked it away.
+func lastActivity(client *structs.Client) (time.Time, bool) {
+	client.ActivityMutex.Lock()
+	defer client.ActivityMutex.Unlock()
+	return client.LastActivity, client.AutoAway
+}
+
+// markAutoAway marks client away if it has been idle for idleAfter and isn't
+// away already. It returns the status to broadcast with the away presence.
+func markAutoAway(client *structs.Client, idleAfter time.Duration) (string, bool) {
+	client.ActivityMutex.Lock()
+	defer client.ActivityMutex.Unlock()
+
+	if client.AutoAway || client.LastPresenceUpdate.Away || time.Since(client.LastActivity) < idleAfter {
+		return "", false
+	}
+	client.AutoAway = true
+	return client.LastPresenceUpdate.Status, true
+}
+
+// StartIdleChecker marks sessions away once they have been idle for longer
+// than idleAfter, broadcasting an away presence with their last status.
+func StartIdleChecker(server *structs.Server, idleAfter time.Duration) {
+	interval := idleAfter / 4
+	if interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, c := range server.Clients.Snapshot() {
+			if c.JID == "" {
+				continue
+			}
+			if status, idle := markAutoAway(c, idleAfter); idle {
+				UpdatePresenceForFriends(context.Background(), server, c, status, true, false)
+			}
+		}
+	}
+}
+
+// HandleLastActivity answers XEP-0012 queries. The server reports its uptime,
+// online contacts their idle time and offline contacts the time since they
+// logged out.
+func HandleLastActivity(ctx context.Context, client *structs.Client, id, to string, server *structs.Server) {
+	if to == "" || to == server.Domain {
+		sendLastActivity(client, id, server.Domain, time.Since(server.StartedAt))
+		return
+	}
+
+	accountID := AccountIDFromJID(to, server.Domain)
+	if accountID == "" {
+		SendIQError(client, id, to, "cancel", "service-unavailable")
+		return
+	}
+
+	if accountID != client.AccountID {
+		// The target's document holds both the friendship and whether it
+		// blocked the requester, which it may have while offline.
+		theirs, err := server.Store.Friends.GetFriends(ctx, accountID)
+		if err != nil {
+			Log.MongoDB.Error("Failed to load friends", "error", err, "session", client)
+			SendIQError(client, id, to, "wait", "internal-server-error")
+			return
+		}
+		if HasBlocked(client, accountID) || hasFriendEntry(theirs.List.Blocked, client.AccountID) ||
+			!hasFriendEntry(theirs.List.Accepted, client.AccountID) {
+			SendIQError(client, id, to, "auth", "forbidden")
+			return
+		}
+	}
+
+	var lastActive time.Time
+	online := false
+	for _, c := range server.Clients.ByAccount(accountID) {
+		if c.JID == "" {
+			continue
+		}
+		if strings.Contains(to, "/") && c.JID != to {
+			continue
+		}
+		if c.Invisible && !HasDirectedPresence(c, client.JID) && accountID != client.AccountID {
+			continue
+		}
+		online = true
+		if active, _ := lastActivity(c); active.After(lastActive) {
+			lastActive = active
+		}
+	}
+
+	if online {
+		sendLastActivity(client, id, to, time.Since(lastActive))
+		return
+	}
+
+	user, err := GetUserByAccountID(ctx, server, accountID)
+	if err != nil || user.LastLogout.IsZero() {
+		SendIQError(client, id, to, "cancel", "item-not-found")
+		return
+	}
+	sendLastActivity(client, id, to, time.Since(user.LastLogout))
+}
+
+func sendLastActivity(client *structs.Client, id, from string, elapsed time.Duration) {
+	resp := fmt.Sprintf(`<iq to="%s" from="%s" id="%s" type="result" xmlns="jabber:client"><query xmlns="%s" seconds="%d"/></iq>`,
+		client.JID, xmlEscape(from), xmlEscape(id), nsLast, int64(elapsed.Seconds()))
+	Enqueue(client, resp)
+}
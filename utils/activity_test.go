@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+func TestLastActivityRespectsBlocks(t *testing.T) {
+	store := storage.NewMemory(storage.Seed{Friends: []models.Friends{
+		{AccountID: "alice", List: models.FriendList{Accepted: []models.FriendEntry{{AccountID: "bob"}}}},
+		{AccountID: "bob", List: models.FriendList{
+			Accepted: []models.FriendEntry{{AccountID: "alice"}},
+			Blocked:  []models.FriendEntry{{AccountID: "alice"}},
+		}},
+	}})
+	server := &structs.Server{Domain: testDomain, Store: store}
+	alice := addTestSession(t, server, "", "alice")
+	addTestSession(t, server, "", "bob")
+	ctx := context.Background()
+
+	// Bob blocked alice, so she doesn't learn his idle time.
+	HandleLastActivity(ctx, alice, "l1", "bob@"+testDomain, server)
+	receive(t, alice, `id="l1"`, "forbidden")
+
+	HandleLastActivity(ctx, alice, `l2"/><message/><iq id="`, `bob@`+testDomain+`/"><message/>`, server)
+	if frame := receive(t, alice, "l2"); strings.Contains(frame, "<message") {
+		t.Errorf("client-supplied address was written raw: %s", frame)
+	}
+}
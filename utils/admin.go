@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/RazerFrFr/Voryn/structs"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	adminServerKey   = "voryn.server"
+	adminIdentityKey = "voryn.adminIdentity"
+	adminGlobalKey   = "voryn.adminGlobal"
+)
+
+// AdminAuth checks the request's bearer token against the configured admin
+// keys. Without configured keys the request is let through, unless required
+// is set.
+//
+// The host the request acts on is named by the "domain" query parameter and
+// defaults to the first one; AdminServer returns it. The top-level keys are
+// valid for every host and a host's own keys only for that host. With nil
+// hosts, only the top-level keys are accepted. Keys are read from the current
+// configuration, so reloaded ones apply to the next request.
+func AdminAuth(hosts *Hosts, required bool) gin.HandlerFunc {
+	return adminAuth(hosts, required, false)
+}
+
+// AdminStreamAuth is AdminAuth for the event streams, which always need a key.
+// The key may also be given as a "token" query parameter, for clients such as
+// EventSource and browser WebSockets that can't set headers. Only use it on
+// read-only routes: URLs end up in proxy and browser logs.
+func AdminStreamAuth(hosts *Hosts) gin.HandlerFunc {
+	return adminAuth(hosts, true, true)
+}
+
+func adminAuth(hosts *Hosts, required, queryToken bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := CurrentConfig()
+		var hostKeys []string
+		if hosts != nil {
+			server := hosts.Lookup(c.Query("domain"))
+			if server == nil {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Unknown domain"})
+				return
+			}
+			c.Set(adminServerKey, server)
+			hostKeys = cfg.HostAdminKeys(server.Domain)
+		}
+
+		if len(cfg.Admin.APIKeys) == 0 && len(hostKeys) == 0 {
+			if required {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin API keys are not configured"})
+				return
+			}
+			c.Next()
+			return
+		}
+
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if token == "" && queryToken {
+			token = c.Query("token")
+		}
+
+		for i, key := range append(cfg.Admin.APIKeys[:len(cfg.Admin.APIKeys):len(cfg.Admin.APIKeys)], hostKeys...) {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+				c.Set(adminIdentityKey, adminKeyID(key))
+				c.Set(adminGlobalKey, i < len(cfg.Admin.APIKeys))
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	}
+}
+
+// AdminIdentity names the admin key a request was authorized with, for audit
+// records. Keys are named by a fingerprint that doesn't reveal them; requests
+// let through without configured keys are "anonymous".
+func AdminIdentity(c *gin.Context) string {
+	if id, ok := c.Get(adminIdentityKey); ok {
+		return id.(string)
+	}
+	return "anonymous"
+}
+
+func adminKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
+
+// AdminGlobal reports whether a request was authorized with a top-level key,
+// which gives access to every host.
+func AdminGlobal(c *gin.Context) bool {
+	return c.GetBool(adminGlobalKey)
+}
+
+// AdminServer returns the host an admin request was authorized for.
+func AdminServer(c *gin.Context) *structs.Server {
+	return c.MustGet(adminServerKey).(*structs.Server)
+}
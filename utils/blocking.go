@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/RazerFrFr/Voryn/structs"
+	"github.com/google/uuid"
+)
+
+const nsBlocking = "urn:xmpp:blocking"
+
+// LoadBlocklist fills the client's in-memory blocklist from its friends document.
+func LoadBlocklist(ctx context.Context, client *structs.Client, server *structs.Server) error {
+	friends, err := server.Store.Friends.GetFriends(ctx, client.AccountID)
+	if err != nil {
+		return err
+	}
+
+	blocked := map[string]bool{}
+	for _, entry := range friends.List.Blocked {
+		blocked[entry.AccountID] = true
+	}
+
+	client.BlockedMutex.Lock()
+	client.Blocked = blocked
+	client.BlockedMutex.Unlock()
+	return nil
+}
+
+// HasBlocked reports whether client has blocked accountID.
+func HasBlocked(client *structs.Client, accountID string) bool {
+	client.BlockedMutex.RLock()
+	defer client.BlockedMutex.RUnlock()
+	return client.Blocked[accountID]
+}
+
+// blockedAccounts returns the accounts client has blocked.
+func blockedAccounts(client *structs.Client) []string {
+	client.BlockedMutex.RLock()
+	defer client.BlockedMutex.RUnlock()
+
+	accountIDs := make([]string, 0, len(client.Blocked))
+	for accountID := range client.Blocked {
+		accountIDs = append(accountIDs, accountID)
+	}
+	return accountIDs
+}
+
+// IsBlockedBetween reports whether either client has blocked the other.
+func IsBlockedBetween(a, b *structs.Client) bool {
+	return HasBlocked(a, b.AccountID) || HasBlocked(b, a.AccountID)
+}
+
+// HandleBlocking answers XEP-0191 iqs. It reports false when root is not a
+// blocking command.
+func HandleBlocking(ctx context.Context, client *structs.Client, id, iqType string, root map[string]interface{}, server *structs.Server) bool {
+	for _, command := range []string{"blocklist", "block", "unblock"} {
+		node, ok := root[command].(map[string]interface{})
+		if !ok || node["-xmlns"] != nsBlocking {
+			continue
+		}
+
+		switch {
+		case command == "blocklist" && iqType == "get":
+			sendBlocklist(ctx, client, id, server)
+		case command == "block" && iqType == "set":
+			handleBlock(ctx, client, id, node, server)
+		case command == "unblock" && iqType == "set":
+			handleUnblock(ctx, client, id, node, server)
+		default:
+			SendIQError(client, id, server.Domain, "modify", "bad-request")
+		}
+		return true
+	}
+	return false
+}
+
+func sendBlocklist(ctx context.Context, client *structs.Client, id string, server *structs.Server) {
+	friends, err := server.Store.Friends.GetFriends(ctx, client.AccountID)
+	if err != nil {
+		Log.MongoDB.Error("Failed to load blocklist", "error", err, "session", client)
+		SendIQError(client, id, server.Domain, "wait", "internal-server-error")
+		return
+	}
+
+	var items strings.Builder
+	for _, entry := range friends.List.Blocked {
+		fmt.Fprintf(&items, `<item jid="%s"/>`, xmlEscape(BareJID(entry.AccountID, server.Domain)))
+	}
+
+	resp := fmt.Sprintf(`<iq to="%s" from="%s" id="%s" type="result" xmlns="jabber:client"><blocklist xmlns="%s">%s</blocklist></iq>`,
+		client.JID, server.Domain, id, nsBlocking, items.String())
+	Enqueue(client, resp)
+}
+
+func handleBlock(ctx context.Context, client *structs.Client, id string, node map[string]interface{}, server *structs.Server) {
+	accountIDs := blockingItems(node, server.Domain)
+	if len(accountIDs) == 0 {
+		SendIQError(client, id, server.Domain, "modify", "bad-request")
+		return
+	}
+
+	// Accounts already blocked are left out, so a rollback doesn't unblock
+	// them.
+	var changes []friendChange
+	for _, accountID := range accountIDs {
+		if !HasBlocked(client, accountID) {
+			changes = append(changes, friendChange{Add: true, AccountID: client.AccountID, List: "blocked", FriendID: accountID})
+		}
+	}
+	if err := applyFriendChanges(ctx, server.Store.Friends, changes); err != nil {
+		Log.MongoDB.Error("Failed to block accounts", "blockedIds", accountIDs, "error", err, "session", client)
+		SendIQError(client, id, server.Domain, "wait", "internal-server-error")
+		return
+	}
+
+	sendIQResult(client, id)
+	pushBlocking(client.AccountID, "block", accountIDs, server)
+
+	for _, accountID := range acceptedFriends(ctx, client, accountIDs, server) {
+		SendPresence(client.AccountID, accountID, true, server)
+		SendPresence(accountID, client.AccountID, true, server)
+	}
+}
+
+func handleUnblock(ctx context.Context, client *structs.Client, id string, node map[string]interface{}, server *structs.Server) {
+	accountIDs := blockingItems(node, server.Domain)
+
+	if len(accountIDs) == 0 {
+		client.BlockedMutex.RLock()
+		for accountID := range client.Blocked {
+			accountIDs = append(accountIDs, accountID)
+		}
+		client.BlockedMutex.RUnlock()
+
+		if err := UnblockAccount(ctx, server, client.AccountID); err != nil {
+			Log.MongoDB.Error("Failed to unblock accounts", "error", err, "session", client)
+			SendIQError(client, id, server.Domain, "wait", "internal-server-error")
+			return
+		}
+		sendIQResult(client, id)
+		pushBlocking(client.AccountID, "unblock", nil, server)
+	} else {
+		var changes []friendChange
+		for _, accountID := range accountIDs {
+			if HasBlocked(client, accountID) {
+				changes = append(changes, friendChange{AccountID: client.AccountID, List: "blocked", FriendID: accountID})
+			}
+		}
+		if err := applyFriendChanges(ctx, server.Store.Friends, changes); err != nil {
+			Log.MongoDB.Error("Failed to unblock accounts", "blockedIds", accountIDs, "error", err, "session", client)
+			SendIQError(client, id, server.Domain, "wait", "internal-server-error")
+			return
+		}
+		sendIQResult(client, id)
+		pushBlocking(client.AccountID, "unblock", accountIDs, server)
+	}
+
+	// Only friends see each other's presence once the block is lifted.
+	for _, accountID := range acceptedFriends(ctx, client, accountIDs, server) {
+		SendPresence(client.AccountID, accountID, false, server)
+		SendPresence(accountID, client.AccountID, false, server)
+	}
+}
+
+// acceptedFriends returns those of accountIDs that are accepted friends of
+// client.
+func acceptedFriends(ctx context.Context, client *structs.Client, accountIDs []string, server *structs.Server) []string {
+	friends, err := server.Store.Friends.GetFriends(ctx, client.AccountID)
+	if err != nil {
+		Log.MongoDB.Error("Failed to load friends", "error", err, "session", client)
+		return nil
+	}
+
+	var accepted []string
+	for _, accountID := range accountIDs {
+		if hasFriendEntry(friends.List.Accepted, accountID) {
+			accepted = append(accepted, accountID)
+		}
+	}
+	return accepted
+}
+
+// pushBlocking applies a block or unblock to every session of accountID and
+// sends them the matching push. An unblock without items clears the list.
+func pushBlocking(accountID, command string, accountIDs []string, server *structs.Server) {
+	var items strings.Builder
+	for _, blockedID := range accountIDs {
+		fmt.Fprintf(&items, `<item jid="%s"/>`, xmlEscape(BareJID(blockedID, server.Domain)))
+	}
+
+	for _, c := range server.Clients.ByAccount(accountID) {
+		c.BlockedMutex.Lock()
+		if c.Blocked == nil {
+			c.Blocked = map[string]bool{}
+		}
+		switch {
+		case command == "block":
+			for _, blockedID := range accountIDs {
+				c.Blocked[blockedID] = true
+			}
+		case len(accountIDs) == 0:
+			c.Blocked = map[string]bool{}
+		default:
+			for _, blockedID := range accountIDs {
+				delete(c.Blocked, blockedID)
+			}
+		}
+		c.BlockedMutex.Unlock()
+
+		if c.JID == "" {
+			continue
+		}
+		push := fmt.Sprintf(`<iq to="%s" from="%s" id="push_%s" type="set" xmlns="jabber:client"><%s xmlns="%s">%s</%s></iq>`,
+			c.JID, BareJID(accountID, server.Domain), strings.ReplaceAll(uuid.New().String(), "-", ""), command, nsBlocking, items.String(), command)
+		Enqueue(c, push)
+	}
+}
+
+func blockingItems(node map[string]interface{}, domain string) []string {
+	var accountIDs []string
+	for _, item := range nodeList(node["item"]) {
+		jid, _ := item["-jid"].(string)
+		if accountID := AccountIDFromJID(jid, domain); accountID != "" {
+			accountIDs = append(accountIDs, accountID)
+		}
+	}
+	return accountIDs
+}
+
+func sendIQResult(client *structs.Client, id string) {
+	resp := fmt.Sprintf(`<iq to="%s" from="%s" id="%s" type="result" xmlns="jabber:client"/>`,
+		client.JID, client.Domain, id)
+	Enqueue(client, resp)
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+func blockingCommand(command string, accountIDs ...string) map[string]interface{} {
+	var items []interface{}
+	for _, accountID := range accountIDs {
+		items = append(items, map[string]interface{}{"-jid": BareJID(accountID, testDomain)})
+	}
+	return map[string]interface{}{command: map[string]interface{}{"-xmlns": nsBlocking, "item": items}}
+}
+
+// failingFriends is a friend store that fails to add entries for one friend.
+type failingFriends struct {
+	storage.FriendStore
+	friendID string
+}
+
+func (s failingFriends) AddFriendEntry(ctx context.Context, accountID, list, friendID string) error {
+	if friendID == s.friendID {
+		return errors.New("write failed")
+	}
+	return s.FriendStore.AddFriendEntry(ctx, accountID, list, friendID)
+}
+
+func TestUnblockSendsPresenceToFriendsOnly(t *testing.T) {
+	store := storage.NewMemory(storage.Seed{Friends: []models.Friends{
+		{AccountID: "alice", List: models.FriendList{Accepted: []models.FriendEntry{{AccountID: "carol"}}}},
+		{AccountID: "carol", List: models.FriendList{Accepted: []models.FriendEntry{{AccountID: "alice"}}}},
+	}})
+	server := &structs.Server{Domain: testDomain, Store: store}
+	alice := addTestSession(t, server, "", "alice")
+	bob := addTestSession(t, server, "", "bob")
+	carol := addTestSession(t, server, "", "carol")
+	ctx := context.Background()
+
+	HandleBlocking(ctx, alice, "b1", "set", blockingCommand("block", "bob", "carol"), server)
+	HandleBlocking(ctx, alice, "b2", "set", blockingCommand("unblock", "bob", "carol"), server)
+
+	receive(t, carol, `from="`+alice.JID+`"`, `type="available"`)
+	for _, frame := range sent(bob) {
+		if strings.Contains(frame, "<presence") {
+			t.Errorf("stranger was sent presence: %s", frame)
+		}
+	}
+	for _, frame := range sent(alice) {
+		if strings.Contains(frame, `from="`+bob.JID+`"`) {
+			t.Errorf("stranger's presence was sent: %s", frame)
+		}
+	}
+}
+
+func TestBlockRollsBack(t *testing.T) {
+	store := storage.NewMemory(storage.Seed{})
+	store.Friends = failingFriends{FriendStore: store.Friends, friendID: "dave"}
+	server := &structs.Server{Domain: testDomain, Store: store}
+	alice := addTestSession(t, server, "", "alice")
+	ctx := context.Background()
+
+	HandleBlocking(ctx, alice, "b1", "set", blockingCommand("block", "bob", "dave"), server)
+	receive(t, alice, `id="b1"`, `type="error"`)
+
+	friends, err := store.Friends.GetFriends(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends.List.Blocked) != 0 {
+		t.Errorf("failed block left %v stored", friendIDs(friends.List.Blocked))
+	}
+	if HasBlocked(alice, "bob") {
+		t.Error("failed block was applied to the session")
+	}
+}
+
+func friendIDs(entries []models.FriendEntry) []string {
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.AccountID)
+	}
+	return ids
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/RazerFrFr/Voryn/structs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultBroadcastConcurrency = 32
+
+// BroadcastFilter selects online accounts for a broadcast. Empty fields match
+// every authenticated session.
+type BroadcastFilter struct {
+	Platform string `json:"platform"`
+	PartyID  string `json:"partyId"`
+}
+
+// DeliveryResult is the outcome of a broadcast or multicast for one account.
+type DeliveryResult struct {
+	AccountID string `json:"accountId"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SelectAccounts returns the accounts with an online session matching filter.
+func SelectAccounts(server *structs.Server, filter BroadcastFilter) []string {
+	seen := map[string]bool{}
+	var accountIDs []string
+	for _, c := range server.Clients.Snapshot() {
+		if c.JID == "" || seen[c.AccountID] {
+			continue
+		}
+		if filter.Platform != "" && !strings.EqualFold(ParseResource(c.Resource).Platform, filter.Platform) {
+			continue
+		}
+		if filter.PartyID != "" && GetPartyID(c) != filter.PartyID {
+			continue
+		}
+		seen[c.AccountID] = true
+		accountIDs = append(accountIDs, c.AccountID)
+	}
+	return accountIDs
+}
+
+// MulticastMessage delivers body to every account in accountIDs, running at
+// most concurrency deliveries at once, and reports the result per account.
+// Each delivery is traced as a child of a fan-out span under ctx.
+func MulticastMessage(ctx context.Context, body interface{}, accountIDs []string, concurrency int, server *structs.Server) []DeliveryResult {
+	if concurrency <= 0 {
+		concurrency = defaultBroadcastConcurrency
+	}
+
+	ctx, span := tracer.Start(ctx, "message.fanout", trace.WithAttributes(attribute.Int("voryn.recipients", len(accountIDs))))
+	defer span.End()
+
+	results := make([]DeliveryResult, len(accountIDs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, accountID := range accountIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, accountID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := DeliveryResult{AccountID: accountID, Status: "delivered"}
+			err := DeliverMessage(ctx, body, accountID, server)
+			switch {
+			case err == nil:
+			case errors.Is(err, ErrClientNotFound):
+				result.Status = "offline"
+			case errors.Is(err, ErrMessageBlocked):
+				result.Status = "blocked"
+			default:
+				result.Status = "failed"
+				result.Error = err.Error()
+			}
+			results[i] = result
+		}(i, accountID)
+	}
+
+	wg.Wait()
+	return results
+}
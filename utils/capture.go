@@ -0,0 +1,464 @@
+package utils
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/structs"
+	"github.com/google/uuid"
+)
+
+const (
+	maxCaptures            = 16
+	defaultCaptureBytes    = 8 << 20
+	maxCaptureBytes        = 64 << 20
+	defaultCaptureDuration = time.Hour
+	maxCaptureDuration     = 24 * time.Hour
+
+	// maxCapturedFrame truncates larger frames in a capture.
+	maxCapturedFrame = 16 << 10
+	// captureBacklogSize is how many frames a session keeps from before it
+	// authenticated, so a capture of its account starts with the stream open
+	// and the (redacted) SASL exchange.
+	captureBacklogSize = 32
+)
+
+var ErrCaptureNotFound = errors.New("capture not found")
+
+// saslAuth matches the credentials of a SASL auth element, prefixed or not,
+// which are never stored in a capture.
+var saslAuth = regexp.MustCompile(`(?s)(<(?:[\w.-]+:)?auth\b[^>]*>).*?(</(?:[\w.-]+:)?auth\s*>)`)
+
+var lineBreaks = strings.NewReplacer("\r", `\r`, "\n", `\n`)
+
+// CaptureOptions describe a capture: either every session of AccountID, or
+// a SampleRate share (0 to 1] of the sessions that open a stream. Zero
+// MaxBytes and Duration take the defaults.
+type CaptureOptions struct {
+	AccountID  string
+	SampleRate float64
+	MaxBytes   int
+	Duration   time.Duration
+}
+
+// CaptureEntry is one frame read from or written to a captured session.
+type CaptureEntry struct {
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"sessionId"`
+	JID       string    `json:"jid,omitempty"`
+	Direction string    `json:"direction"`
+	Stanza    string    `json:"stanza"`
+}
+
+// CaptureInfo describes a capture for the admin API.
+type CaptureInfo struct {
+	ID         string    `json:"id"`
+	Domain     string    `json:"domain"`
+	AccountID  string    `json:"accountId,omitempty"`
+	SampleRate float64   `json:"sampleRate,omitempty"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires"`
+	MaxBytes   int       `json:"maxBytes"`
+	Entries    int       `json:"entries"`
+	Bytes      int       `json:"bytes"`
+	Recorded   int       `json:"recorded"`
+}
+
+// Capture is a ring buffer of a capture's frames. Once it holds MaxBytes the
+// oldest frames are dropped; after it expires nothing more is recorded, but it
+// stays available for download until stopped.
+type Capture struct {
+	info CaptureInfo
+
+	mu       sync.Mutex
+	entries  []CaptureEntry
+	head     int
+	bytes    int
+	recorded int
+}
+
+// sessionTap is the capture state of one session.
+type sessionTap struct {
+	mu      sync.Mutex
+	backlog []CaptureEntry
+	settled bool
+	sampled bool
+	sinks   []*Capture
+}
+
+var (
+	captures = struct {
+		sync.RWMutex
+		byID map[string]*Capture
+	}{byID: map[string]*Capture{}}
+	captureCount atomic.Int32
+
+	// taps holds the sessions that may be captured, by *structs.Client.
+	taps sync.Map
+)
+
+// StartCapture starts capturing the traffic of server's sessions described by
+// opts. An account capture includes the account's current sessions; a sampled
+// one also samples the sessions already open.
+func StartCapture(server *structs.Server, opts CaptureOptions) (*CaptureInfo, error) {
+	if (opts.AccountID == "") == (opts.SampleRate == 0) {
+		return nil, errors.New("set either accountId or sampleRate")
+	}
+	if opts.SampleRate < 0 || opts.SampleRate > 1 {
+		return nil, errors.New("sampleRate must be between 0 and 1")
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = defaultCaptureBytes
+	}
+	if opts.MaxBytes < 0 || opts.MaxBytes > maxCaptureBytes {
+		return nil, fmt.Errorf("maxBytes must be between 1 and %d", maxCaptureBytes)
+	}
+	if opts.Duration == 0 {
+		opts.Duration = defaultCaptureDuration
+	}
+	if opts.Duration < 0 || opts.Duration > maxCaptureDuration {
+		return nil, fmt.Errorf("duration must be at most %s", maxCaptureDuration)
+	}
+
+	now := time.Now().UTC()
+	capture := &Capture{info: CaptureInfo{
+		ID:         uuid.New().String(),
+		Domain:     server.Domain,
+		AccountID:  opts.AccountID,
+		SampleRate: opts.SampleRate,
+		Created:    now,
+		Expires:    now.Add(opts.Duration),
+		MaxBytes:   opts.MaxBytes,
+	}}
+
+	captures.Lock()
+	if len(captures.byID) >= maxCaptures {
+		captures.Unlock()
+		return nil, fmt.Errorf("at most %d captures can exist at once", maxCaptures)
+	}
+	captures.byID[capture.info.ID] = capture
+	captureCount.Add(1)
+	captures.Unlock()
+
+	if opts.AccountID != "" {
+		for _, client := range server.Clients.ByAccount(opts.AccountID) {
+			tapOpenSession(client).attach(capture)
+		}
+	} else {
+		for _, client := range server.Clients.Snapshot() {
+			if rand.Float64() < opts.SampleRate {
+				tapOpenSession(client).attach(capture)
+			}
+		}
+	}
+
+	Log.XMPP.Info("Capture started", "id", capture.info.ID, "domain", server.Domain,
+		"accountId", opts.AccountID, "sampleRate", opts.SampleRate, "expires", capture.info.Expires)
+	info := capture.Info()
+	return &info, nil
+}
+
+// StopCapture stops a capture of server and discards what it recorded.
+func StopCapture(server *structs.Server, id string) error {
+	captures.Lock()
+	defer captures.Unlock()
+
+	capture, ok := captures.byID[id]
+	if !ok || capture.info.Domain != server.Domain {
+		return ErrCaptureNotFound
+	}
+	delete(captures.byID, id)
+	captureCount.Add(-1)
+
+	// Sessions still holding the capture keep appending to it; expiring it
+	// makes those appends no-ops.
+	capture.mu.Lock()
+	capture.info.Expires = time.Now().UTC()
+	capture.entries = nil
+	capture.head = 0
+	capture.bytes = 0
+	capture.mu.Unlock()
+	return nil
+}
+
+// ListCaptures returns server's captures, oldest first.
+func ListCaptures(server *structs.Server) []CaptureInfo {
+	list := []CaptureInfo{}
+	for _, capture := range capturesOf(server.Domain) {
+		list = append(list, capture.Info())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// GetCapture returns a capture of server.
+func GetCapture(server *structs.Server, id string) (*Capture, error) {
+	captures.RLock()
+	defer captures.RUnlock()
+
+	capture, ok := captures.byID[id]
+	if !ok || capture.info.Domain != server.Domain {
+		return nil, ErrCaptureNotFound
+	}
+	return capture, nil
+}
+
+func capturesOf(domain string) []*Capture {
+	captures.RLock()
+	defer captures.RUnlock()
+
+	var list []*Capture
+	for _, capture := range captures.byID {
+		if capture.info.Domain == domain {
+			list = append(list, capture)
+		}
+	}
+	return list
+}
+
+// Info returns the capture's description and counters.
+func (c *Capture) Info() CaptureInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := c.info
+	info.Entries = len(c.entries) - c.head
+	info.Bytes = c.bytes
+	info.Recorded = c.recorded
+	return info
+}
+
+// Entries returns the frames the capture holds, oldest first.
+func (c *Capture) Entries() []CaptureEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]CaptureEntry(nil), c.entries[c.head:]...)
+}
+
+// WriteText writes the capture as one line per frame: time, direction,
+// session ID, JID and the stanza, with its line breaks escaped.
+func (c *Capture) WriteText(w io.Writer) error {
+	for _, entry := range c.Entries() {
+		jid := entry.JID
+		if jid == "" {
+			jid = "-"
+		}
+		_, err := fmt.Fprintf(w, "%s %s %s %s %s\n",
+			entry.Time.Format(time.RFC3339Nano), entry.Direction, entry.SessionID, jid, lineBreaks.Replace(entry.Stanza))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Capture) record(entry CaptureEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry.Time.After(c.info.Expires) {
+		return
+	}
+
+	c.entries = append(c.entries, entry)
+	c.bytes += len(entry.Stanza)
+	c.recorded++
+	for c.bytes > c.info.MaxBytes && c.head < len(c.entries) {
+		c.bytes -= len(c.entries[c.head].Stanza)
+		c.entries[c.head] = CaptureEntry{}
+		c.head++
+	}
+	if c.head > len(c.entries)/2 {
+		c.entries = append(c.entries[:0], c.entries[c.head:]...)
+		c.head = 0
+	}
+}
+
+// tapSession starts buffering a new session's traffic while any capture
+// exists, until it is known whether a capture wants it.
+func tapSession(client *structs.Client) {
+	if captureCount.Load() > 0 {
+		tapFor(client)
+	}
+}
+
+func tapFor(client *structs.Client) *sessionTap {
+	tap, _ := taps.LoadOrStore(client, &sessionTap{})
+	return tap.(*sessionTap)
+}
+
+// tapOpenSession taps a session that was open before a capture started. It
+// isn't sampled again, and once authenticated it keeps no backlog.
+func tapOpenSession(client *structs.Client) *sessionTap {
+	tap := tapFor(client)
+	tap.mu.Lock()
+	tap.sampled = true
+	if client.Authenticated {
+		tap.settled = true
+		tap.backlog = nil
+	}
+	tap.mu.Unlock()
+	return tap
+}
+
+func untapSession(client *structs.Client) {
+	taps.Delete(client)
+}
+
+// sampleSession adds a session that opened a stream to the sampled captures
+// of its host that pick it.
+func sampleSession(client *structs.Client) {
+	if captureCount.Load() == 0 {
+		return
+	}
+	tap := tapFor(client)
+
+	tap.mu.Lock()
+	if tap.sampled {
+		tap.mu.Unlock()
+		return
+	}
+	tap.sampled = true
+	tap.mu.Unlock()
+
+	for _, capture := range capturesOf(client.Domain) {
+		if capture.info.SampleRate > 0 && rand.Float64() < capture.info.SampleRate {
+			tap.attach(capture)
+		}
+	}
+}
+
+// settleCapture adds an authenticated session to the captures of its account
+// and drops its backlog. Sessions no capture wants are no longer tapped.
+func settleCapture(client *structs.Client) {
+	var matching []*Capture
+	if captureCount.Load() > 0 {
+		for _, capture := range capturesOf(client.Domain) {
+			if capture.info.AccountID == client.AccountID {
+				matching = append(matching, capture)
+			}
+		}
+	}
+
+	value, ok := taps.Load(client)
+	if !ok && len(matching) == 0 {
+		return
+	}
+	if !ok {
+		value = tapFor(client)
+	}
+	tap := value.(*sessionTap)
+	for _, capture := range matching {
+		tap.attach(capture)
+	}
+
+	tap.mu.Lock()
+	tap.settled = true
+	tap.backlog = nil
+	idle := len(tap.sinks) == 0
+	tap.mu.Unlock()
+
+	if idle {
+		untapSession(client)
+	}
+}
+
+func (t *sessionTap) attach(capture *Capture) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, sink := range t.sinks {
+		if sink == capture {
+			return
+		}
+	}
+	t.sinks = append(t.sinks, capture)
+	for _, entry := range t.backlog {
+		capture.record(entry)
+	}
+}
+
+func (t *sessionTap) record(entry CaptureEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.settled && len(t.backlog) < captureBacklogSize {
+		t.backlog = append(t.backlog, entry)
+	}
+	for _, sink := range t.sinks {
+		sink.record(entry)
+	}
+}
+
+// CaptureInbound records a frame read from the client if it is captured.
+func CaptureInbound(client *structs.Client, data []byte) {
+	captureFrame(client, "in", data)
+}
+
+func captureFrame(client *structs.Client, direction string, data []byte) {
+	if captureCount.Load() == 0 {
+		return
+	}
+	value, ok := taps.Load(client)
+	if !ok {
+		return
+	}
+
+	stanza := string(data)
+	if direction == "in" {
+		stanza = redactInbound(client, stanza)
+	}
+	if len(stanza) > maxCapturedFrame {
+		stanza = stanza[:maxCapturedFrame] + "[truncated]"
+	}
+
+	value.(*sessionTap).record(CaptureEntry{
+		Time:      time.Now().UTC(),
+		SessionID: client.ID,
+		JID:       client.JID,
+		Direction: direction,
+		Stanza:    stanza,
+	})
+}
+
+// redactInbound strips the credentials from a frame read from client. Auth
+// elements are found by their local name, so a namespace prefix doesn't hide
+// them. Before the client authenticated, frames other than stream headers are
+// left out whole, as they may carry credentials in a form not matched here.
+func redactInbound(client *structs.Client, stanza string) string {
+	name := rootElement(stanza)
+	if name == "auth" {
+		if redacted := saslAuth.ReplaceAllString(stanza, "${1}[redacted]${2}"); redacted != stanza {
+			return redacted
+		}
+		return "[redacted]"
+	}
+	if !client.Authenticated && name != "open" && name != "close" {
+		return "[redacted]"
+	}
+	return stanza
+}
+
+// rootElement returns the local name of the first element in stanza, or an
+// empty string when it has none.
+func rootElement(stanza string) string {
+	decoder := xml.NewDecoder(strings.NewReader(stanza))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local
+		}
+	}
+}
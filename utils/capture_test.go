@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+func TestCaptureRedactsCredentials(t *testing.T) {
+	const secret = "AGFsaWNlAGVnMX5zZWNyZXQ="
+
+	unauthenticated := &structs.Client{}
+	authenticated := &structs.Client{Authenticated: true}
+
+	for _, tc := range []struct {
+		name   string
+		client *structs.Client
+		frame  string
+		want   string
+	}{
+		{
+			name:   "auth",
+			client: unauthenticated,
+			frame:  `<auth mechanism="PLAIN" xmlns="urn:ietf:params:xml:ns:xmpp-sasl">` + secret + `</auth>`,
+			want:   `<auth mechanism="PLAIN" xmlns="urn:ietf:params:xml:ns:xmpp-sasl">[redacted]</auth>`,
+		},
+		{
+			name:   "prefixed auth",
+			client: unauthenticated,
+			frame:  `<sasl:auth xmlns:sasl="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="PLAIN">` + secret + `</sasl:auth>`,
+			want:   `<sasl:auth xmlns:sasl="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="PLAIN">[redacted]</sasl:auth>`,
+		},
+		{
+			name:   "auth after authenticating",
+			client: authenticated,
+			frame:  `<sasl:auth xmlns:sasl="urn:ietf:params:xml:ns:xmpp-sasl">` + secret + `</sasl:auth>`,
+			want:   `<sasl:auth xmlns:sasl="urn:ietf:params:xml:ns:xmpp-sasl">[redacted]</sasl:auth>`,
+		},
+		{
+			name:   "unmatched auth",
+			client: unauthenticated,
+			frame:  `<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl">` + secret,
+			want:   "[redacted]",
+		},
+		{
+			name:   "other element before authenticating",
+			client: unauthenticated,
+			frame:  `<x:response xmlns:x="urn:ietf:params:xml:ns:xmpp-sasl">` + secret + `</x:response>`,
+			want:   "[redacted]",
+		},
+		{
+			name:   "stream header",
+			client: unauthenticated,
+			frame:  `<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" to="example.com" version="1.0"/>`,
+			want:   `<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" to="example.com" version="1.0"/>`,
+		},
+		{
+			name:   "stanza",
+			client: authenticated,
+			frame:  `<message to="bob@example.com"><body>hi</body></message>`,
+			want:   `<message to="bob@example.com"><body>hi</body></message>`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := redactInbound(tc.client, tc.frame)
+			if got != tc.want {
+				t.Errorf("redactInbound = %s, want %s", got, tc.want)
+			}
+			if strings.Contains(got, secret) {
+				t.Error("credentials were kept")
+			}
+		})
+	}
+}
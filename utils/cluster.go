@@ -0,0 +1,543 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/config"
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/structs"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// ClusterRoutePath is where nodes accept routes from each other.
+	ClusterRoutePath = "/internal/cluster/route"
+
+	clusterKeyHeader = "X-Voryn-Cluster-Key"
+
+	// Nodes and their sessions are gone once they miss this many heartbeats.
+	clusterMissedHeartbeats = 3
+
+	// Routes waiting for a node past this many are dropped.
+	clusterQueueSize = 1024
+
+	routeKindStanza   = "stanza"
+	routeKindPresence = "presence"
+	routeKindProbe    = "probe"
+	routeKindAdmin    = "admin"
+	routeKindKick     = "kick"
+)
+
+type clusterSettings struct {
+	nodeID    string
+	address   string
+	secret    string
+	heartbeat time.Duration
+}
+
+// cluster is set by StartCluster before the server accepts connections and
+// not changed afterwards. Cluster mode is off while it is nil.
+var cluster *clusterSettings
+
+// clusterPeers holds the other live nodes of each host, refreshed on every
+// heartbeat.
+var clusterPeers atomic.Pointer[map[*structs.Server]map[string]models.ClusterNode]
+
+var clusterClient = &http.Client{Timeout: 5 * time.Second}
+
+// peerQueues holds the route queue of each node routes were sent to, keyed by
+// node ID.
+var peerQueues sync.Map
+
+// ClusterRoute is a stanza, presence update or admin message handed to the
+// node holding the sessions it is for.
+type ClusterRoute struct {
+	Domain string `json:"domain"`
+	Kind   string `json:"kind"`
+
+	// A stanza route delivers Stanza to the session bound to JID, unless it
+	// has blocked FromAccount, then publishes Event if set.
+	JID       string                 `json:"jid,omitempty"`
+	Stanza    string                 `json:"stanza,omitempty"`
+	Event     string                 `json:"event,omitempty"`
+	EventData map[string]interface{} `json:"eventData,omitempty"`
+
+	// A presence route fans a presence update out to the node's sessions.
+	// Blocked are the accounts the sender blocked, Except the JIDs of
+	// sessions left out.
+	FromAccount string   `json:"fromAccount,omitempty"`
+	FromJID     string   `json:"fromJid,omitempty"`
+	Status      string   `json:"status,omitempty"`
+	Away        bool     `json:"away,omitempty"`
+	Offline     bool     `json:"offline,omitempty"`
+	Blocked     []string `json:"blocked,omitempty"`
+	Except      []string `json:"except,omitempty"`
+
+	// A probe route asks the node to send JID, a session of FromAccount on
+	// node FromNode, the presence of its sessions of Accounts.
+	Accounts []string `json:"accounts,omitempty"`
+	FromNode string   `json:"fromNode,omitempty"`
+
+	// An admin route delivers an admin message to AccountID.
+	AccountID string `json:"accountId,omitempty"`
+	Body      string `json:"body,omitempty"`
+
+	// A kick route ends the sessions of AccountID with a stream error.
+	Reason    string `json:"reason,omitempty"`
+	Condition string `json:"condition,omitempty"`
+}
+
+// StartCluster joins the cluster described by cfg. Every host registers this
+// node in its session directory and keeps it alive with heartbeats; sessions
+// a previous run of the node left behind are dropped first.
+func StartCluster(hosts *Hosts, cfg config.ClusterConfig) error {
+	nodeID := cfg.NodeID
+	if nodeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("cluster.nodeId is not set and the host name is unknown: %w", err)
+		}
+		nodeID = hostname
+	}
+
+	cluster = &clusterSettings{
+		nodeID:    nodeID,
+		address:   strings.TrimSuffix(cfg.Advertise, "/"),
+		secret:    cfg.Secret,
+		heartbeat: cfg.Heartbeat,
+	}
+
+	// After a handoff the previous process still holds sessions under this
+	// node ID while it drains.
+	if !Inherited() {
+		for _, server := range hosts.List {
+			if err := server.Store.Sessions.ReleaseNode(context.Background(), nodeID); err != nil {
+				return fmt.Errorf("releasing old sessions of %s: %w", server.Domain, err)
+			}
+		}
+	}
+	clusterHeartbeat(hosts)
+
+	go func() {
+		ticker := time.NewTicker(cluster.heartbeat)
+		defer ticker.Stop()
+		for range ticker.C {
+			if ShuttingDown() {
+				return
+			}
+			clusterHeartbeat(hosts)
+		}
+	}()
+
+	Log.Cluster.Info("Joined cluster", "node", nodeID, "address", cluster.address)
+	return nil
+}
+
+func clusterStale() time.Time {
+	return time.Now().Add(-clusterMissedHeartbeats * cluster.heartbeat)
+}
+
+func clusterHeartbeat(hosts *Hosts) {
+	peers := map[*structs.Server]map[string]models.ClusterNode{}
+	if current := clusterPeers.Load(); current != nil {
+		for server, nodes := range *current {
+			peers[server] = nodes
+		}
+	}
+
+	node := models.ClusterNode{ID: cluster.nodeID, Address: cluster.address, Seen: time.Now()}
+	for _, server := range hosts.List {
+		if err := server.Store.Sessions.Heartbeat(context.Background(), node); err != nil {
+			Log.Cluster.Error("Heartbeat failed", "domain", server.Domain, "error", err)
+			continue
+		}
+
+		nodes, err := server.Store.Sessions.Nodes(context.Background(), clusterStale())
+		if err != nil {
+			Log.Cluster.Error("Failed to list cluster nodes", "domain", server.Domain, "error", err)
+			continue
+		}
+		others := map[string]models.ClusterNode{}
+		for _, n := range nodes {
+			if n.ID != cluster.nodeID {
+				others[n.ID] = n
+			}
+		}
+		peers[server] = others
+	}
+	clusterPeers.Store(&peers)
+}
+
+func peerNodes(server *structs.Server) map[string]models.ClusterNode {
+	if peers := clusterPeers.Load(); peers != nil {
+		return (*peers)[server]
+	}
+	return nil
+}
+
+// claimSession records client's session for accountID in the directory, so
+// the account can't log in on another node at the same time.
+func claimSession(ctx context.Context, server *structs.Server, client *structs.Client, accountID string) error {
+	if cluster == nil {
+		return nil
+	}
+
+	return server.Store.Sessions.Claim(ctx, models.SessionEntry{
+		ID:        client.ID,
+		AccountID: accountID,
+		NodeID:    cluster.nodeID,
+		Seen:      time.Now(),
+	}, clusterStale())
+}
+
+func bindSession(ctx context.Context, server *structs.Server, client *structs.Client) {
+	if cluster == nil {
+		return
+	}
+	if err := server.Store.Sessions.SetJID(ctx, client.ID, client.JID); err != nil {
+		Log.Cluster.Error("Failed to record bound JID in the session directory", "error", err, "session", client)
+	}
+}
+
+func releaseSession(ctx context.Context, server *structs.Server, client *structs.Client) {
+	if cluster == nil || client.AccountID == "" {
+		return
+	}
+	if err := server.Store.Sessions.Release(ctx, client.ID); err != nil {
+		Log.Cluster.Error("Failed to release session from the directory", "error", err, "session", client)
+	}
+}
+
+// remoteSessions returns the bound sessions of accountID held by other live
+// nodes.
+func remoteSessions(ctx context.Context, server *structs.Server, accountID string) []models.SessionEntry {
+	if cluster == nil {
+		return nil
+	}
+
+	entries, err := server.Store.Sessions.Sessions(ctx, accountID, clusterStale())
+	if err != nil {
+		Log.Cluster.Error("Failed to look up sessions in the directory", "accountId", accountID, "error", err)
+		return nil
+	}
+
+	peers := peerNodes(server)
+	remote := entries[:0]
+	for _, entry := range entries {
+		if _, ok := peers[entry.NodeID]; ok && entry.JID != "" {
+			remote = append(remote, entry)
+		}
+	}
+	return remote
+}
+
+// forwardRoute sends route to a node, carrying the trace in ctx over. It
+// returns ErrClientNotFound and ErrMessageBlocked when the node reports them.
+func forwardRoute(ctx context.Context, node models.ClusterNode, route ClusterRoute) error {
+	data, err := json.Marshal(route)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, node.Address+ClusterRoutePath, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(clusterKeyHeader, cluster.secret)
+	injectTrace(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := clusterClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("routing to node %s: %w", node.ID, err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return ErrClientNotFound
+	case http.StatusConflict:
+		return ErrMessageBlocked
+	}
+	return fmt.Errorf("routing to node %s: %s", node.ID, resp.Status)
+}
+
+// queuedRoute is a route waiting in a node's queue.
+type queuedRoute struct {
+	ctx   context.Context
+	node  models.ClusterNode
+	route ClusterRoute
+}
+
+// sendRoute queues route for node and returns without waiting for it, so a
+// slow node doesn't hold up the sender. Routes to a node are sent one at a
+// time in the order they were queued; failures are only logged.
+func sendRoute(ctx context.Context, node models.ClusterNode, route ClusterRoute) {
+	v, ok := peerQueues.Load(node.ID)
+	if !ok {
+		v, ok = peerQueues.LoadOrStore(node.ID, make(chan queuedRoute, clusterQueueSize))
+		if !ok {
+			go sendRoutes(v.(chan queuedRoute))
+		}
+	}
+
+	// The caller may be done by the time the route is sent, so only its
+	// trace is carried over.
+	ctx = trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+	select {
+	case v.(chan queuedRoute) <- queuedRoute{ctx: ctx, node: node, route: route}:
+	default:
+		Log.Cluster.Warn("Route queue full, dropping route", "node", node.ID, "kind", route.Kind)
+	}
+}
+
+func sendRoutes(queue chan queuedRoute) {
+	for r := range queue {
+		err := forwardRoute(r.ctx, r.node, r.route)
+		if err != nil && !errors.Is(err, ErrClientNotFound) && !errors.Is(err, ErrMessageBlocked) {
+			Log.Cluster.Error("Failed to route", "node", r.node.ID, "kind", r.route.Kind, "from", r.route.FromJID, "error", err)
+		}
+	}
+}
+
+// routeMessage forwards a chat message to the nodes holding the sessions of
+// accountID that to addresses. It reports whether any session was found.
+func routeMessage(ctx context.Context, server *structs.Server, sender *structs.Client, to, accountID, id, msgType, body string) bool {
+	found := false
+	for _, entry := range remoteSessions(ctx, server, accountID) {
+		if strings.Contains(to, "/") && entry.JID != to {
+			continue
+		}
+		found = true
+
+		stanza, err := xml.Marshal(structs.Message{
+			From:  sender.JID,
+			To:    entry.JID,
+			ID:    id,
+			Type:  msgType,
+			XMLNS: "jabber:client",
+			Body:  body,
+		})
+		if err != nil {
+			Log.XMPP.Error("Failed to marshal message XML", "error", err, "session", sender)
+			return true
+		}
+
+		sendRoute(ctx, peerNodes(server)[entry.NodeID], ClusterRoute{
+			Domain:      server.Domain,
+			Kind:        routeKindStanza,
+			JID:         entry.JID,
+			Stanza:      string(stanza),
+			FromAccount: sender.AccountID,
+			FromJID:     sender.JID,
+			Event:       EventMessageDelivered,
+			EventData:   map[string]interface{}{"from": sender.JID, "type": msgType},
+		})
+	}
+	return found
+}
+
+// routePresence forwards a presence update to every other node, which send it
+// to the sessions of the sender's friends but those whose JID is in except.
+func routePresence(ctx context.Context, server *structs.Server, sender *structs.Client, body string, away, offline bool, except []string) {
+	if cluster == nil || sender.JID == "" {
+		return
+	}
+
+	route := ClusterRoute{
+		Domain:      server.Domain,
+		Kind:        routeKindPresence,
+		FromAccount: sender.AccountID,
+		FromJID:     sender.JID,
+		Status:      body,
+		Away:        away,
+		Offline:     offline,
+		Blocked:     blockedAccounts(sender),
+		Except:      except,
+	}
+	for _, node := range peerNodes(server) {
+		sendRoute(ctx, node, route)
+	}
+}
+
+// probeFriends asks the other nodes for the presence of client's friends
+// among accountIDs, which they send to client as routed stanzas.
+func probeFriends(ctx context.Context, server *structs.Server, client *structs.Client, accountIDs []string) {
+	if cluster == nil || len(accountIDs) == 0 {
+		return
+	}
+
+	route := ClusterRoute{
+		Domain:      server.Domain,
+		Kind:        routeKindProbe,
+		JID:         client.JID,
+		FromAccount: client.AccountID,
+		FromNode:    cluster.nodeID,
+		Accounts:    accountIDs,
+	}
+	for _, node := range peerNodes(server) {
+		sendRoute(ctx, node, route)
+	}
+}
+
+// answerProbe sends the prober the presence of the sessions it asked about
+// that this node holds and the prober may see.
+func answerProbe(ctx context.Context, server *structs.Server, route ClusterRoute) error {
+	origin, ok := peerNodes(server)[route.FromNode]
+	if !ok {
+		return fmt.Errorf("probe from unknown node %q", route.FromNode)
+	}
+
+	for _, accountID := range route.Accounts {
+		for _, friend := range server.Clients.ByAccount(accountID) {
+			if friend.JID == "" || HasBlocked(friend, route.FromAccount) ||
+				(friend.Invisible && !HasDirectedPresence(friend, route.JID)) {
+				continue
+			}
+			sendRoute(ctx, origin, ClusterRoute{
+				Domain:      server.Domain,
+				Kind:        routeKindStanza,
+				JID:         route.JID,
+				Stanza:      availablePresence(friend, route.JID),
+				FromAccount: friend.AccountID,
+				FromJID:     friend.JID,
+			})
+		}
+	}
+	return nil
+}
+
+// sendToAccount sends the stanza built by stanza for each bound session of
+// accountID, local or held by another node. Sessions that blocked fromAccount,
+// when it is set, are skipped.
+func sendToAccount(ctx context.Context, server *structs.Server, accountID, fromAccount string, stanza func(jid string) string) {
+	for _, c := range server.Clients.ByAccount(accountID) {
+		if c.JID == "" || (fromAccount != "" && HasBlocked(c, fromAccount)) {
+			continue
+		}
+		Enqueue(c, stanza(c.JID))
+	}
+
+	for _, entry := range remoteSessions(ctx, server, accountID) {
+		sendRoute(ctx, peerNodes(server)[entry.NodeID], ClusterRoute{
+			Domain:      server.Domain,
+			Kind:        routeKindStanza,
+			JID:         entry.JID,
+			Stanza:      stanza(entry.JID),
+			FromAccount: fromAccount,
+		})
+	}
+}
+
+// routeAdminMessage delivers an admin message through the node holding the
+// session of accountID.
+func routeAdminMessage(ctx context.Context, server *structs.Server, accountID, body string) error {
+	entries := remoteSessions(ctx, server, accountID)
+	if len(entries) == 0 {
+		return ErrClientNotFound
+	}
+
+	return forwardRoute(ctx, peerNodes(server)[entries[0].NodeID], ClusterRoute{
+		Domain:    server.Domain,
+		Kind:      routeKindAdmin,
+		AccountID: accountID,
+		Body:      body,
+	})
+}
+
+// ClusterHandler accepts routes from other nodes and delivers them to the
+// sessions held by this one.
+func ClusterHandler(hosts *Hosts) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader(clusterKeyHeader)), []byte(cluster.secret)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		var route ClusterRoute
+		if err := c.ShouldBindJSON(&route); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		server := hosts.Lookup(route.Domain)
+		if server == nil || route.Domain == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unknown domain"})
+			return
+		}
+
+		var err error
+		switch route.Kind {
+		case routeKindStanza:
+			err = deliverRoutedStanza(server, route)
+		case routeKindPresence:
+			fanOutPresence(c.Request.Context(), server, route.FromAccount, route.FromJID, route.Status, route.Away, route.Offline,
+				func(c *structs.Client) bool {
+					return containsString(route.Blocked, c.AccountID) || containsString(route.Except, c.JID)
+				})
+		case routeKindProbe:
+			err = answerProbe(c.Request.Context(), server, route)
+		case routeKindAdmin:
+			err = deliverLocalMessage(c.Request.Context(), route.Body, route.AccountID, server)
+		case routeKindKick:
+			err = endSessions(server, route.AccountID, route.Condition, route.Reason)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown route kind"})
+			return
+		}
+
+		switch {
+		case err == nil:
+			c.Status(http.StatusNoContent)
+		case errors.Is(err, ErrClientNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, ErrMessageBlocked):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+	}
+}
+
+func deliverRoutedStanza(server *structs.Server, route ClusterRoute) error {
+	receiver := server.Clients.ByJID(route.JID)
+	if receiver == nil {
+		return ErrClientNotFound
+	}
+	if route.FromAccount != "" && HasBlocked(receiver, route.FromAccount) {
+		return ErrMessageBlocked
+	}
+
+	if err := Enqueue(receiver, route.Stanza); err != nil {
+		return err
+	}
+	if route.Event != "" {
+		publishSessionEvent(route.Event, receiver, route.EventData)
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+	"github.com/gin-gonic/gin"
+)
+
+const testDomain = "example.com"
+
+// testCluster sets the cluster settings once: routes still queued from an
+// earlier test may be reading them.
+var testCluster sync.Once
+
+// startTestCluster makes this process node "a" of a cluster whose nodes share
+// store's session directory, as nodes share a database. It returns the host
+// of node a and that of node b, which accepts routes over HTTP like a node in
+// another process would.
+func startTestCluster(t *testing.T, store *storage.Store) (a, b *structs.Server) {
+	gin.SetMode(gin.TestMode)
+
+	a = &structs.Server{Domain: testDomain, Store: store}
+	b = &structs.Server{Domain: testDomain, Store: store}
+	nodeA := startTestNode(t, "a", a)
+	nodeB := startTestNode(t, "b", b)
+
+	testCluster.Do(func() {
+		cluster = &clusterSettings{nodeID: "a", secret: "secret", heartbeat: time.Minute}
+	})
+	clusterPeers.Store(&map[*structs.Server]map[string]models.ClusterNode{
+		a: {"b": nodeB},
+		b: {"a": nodeA},
+	})
+	t.Cleanup(func() { clusterPeers.Store(nil) })
+	return a, b
+}
+
+func startTestNode(t *testing.T, id string, server *structs.Server) models.ClusterNode {
+	r := gin.New()
+	r.POST(ClusterRoutePath, ClusterHandler(NewHosts(server)))
+	ts := httptest.NewServer(r)
+	t.Cleanup(ts.Close)
+	return models.ClusterNode{ID: id, Address: ts.URL, Seen: time.Now()}
+}
+
+// addTestSession registers a bound session of accountID on server and, when
+// nodeID is set, in the session directory as held by that node.
+func addTestSession(t *testing.T, server *structs.Server, nodeID, accountID string) *structs.Client {
+	client := &structs.Client{
+		ID:            accountID + "-session",
+		AccountID:     accountID,
+		JID:           accountID + "@" + testDomain + "/V2:Fortnite:WIN::test",
+		Domain:        testDomain,
+		Outbound:      make(chan structs.Frame, 16),
+		Done:          make(chan struct{}),
+		Authenticated: true,
+		ClientExists:  true,
+	}
+	server.Clients.Add(client)
+
+	if nodeID != "" {
+		entry := models.SessionEntry{ID: client.ID, AccountID: accountID, NodeID: nodeID, Seen: time.Now()}
+		if err := server.Store.Sessions.Claim(context.Background(), entry, time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.Store.Sessions.SetJID(context.Background(), client.ID, client.JID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return client
+}
+
+// receive waits for client to be sent a stanza containing every one of want.
+func receive(t *testing.T, client *structs.Client, want ...string) string {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case frame := <-client.Outbound:
+			data := string(frame.Data)
+			matched := true
+			for _, w := range want {
+				if !strings.Contains(data, w) {
+					matched = false
+				}
+			}
+			if matched {
+				return data
+			}
+		case <-timeout:
+			t.Fatalf("%s was not sent a stanza with %q", client.AccountID, want)
+			return ""
+		}
+	}
+}
+
+func TestClusterRoutesMessage(t *testing.T) {
+	a, b := startTestCluster(t, storage.NewMemory(storage.Seed{}))
+	alice := addTestSession(t, a, "", "alice")
+	bob := addTestSession(t, b, "b", "bob")
+
+	if !routeMessage(context.Background(), a, alice, "bob@"+testDomain, "bob", "m1", "chat", "hello") {
+		t.Fatal("bob's session on node b wasn't found")
+	}
+	receive(t, bob, `from="`+alice.JID+`"`, "<body>hello</body>")
+
+	if routeMessage(context.Background(), a, alice, "carol@"+testDomain, "carol", "m2", "chat", "hello") {
+		t.Error("routeMessage found a session for an account without one")
+	}
+}
+
+func TestClusterInitialPresence(t *testing.T) {
+	store := storage.NewMemory(storage.Seed{Friends: []models.Friends{{
+		AccountID: "alice",
+		List: models.FriendList{Accepted: []models.FriendEntry{
+			{AccountID: "bob"}, {AccountID: "carol"}, {AccountID: "dave"},
+		}},
+	}}})
+	a, b := startTestCluster(t, store)
+
+	alice := addTestSession(t, a, "", "alice")
+	carol := addTestSession(t, a, "", "carol")
+	bob := addTestSession(t, b, "b", "bob")
+	dave := addTestSession(t, b, "b", "dave")
+	setLastPresence(carol, structs.PresenceUpdate{Status: "carol-status"})
+	setLastPresence(bob, structs.PresenceUpdate{Status: "bob-status", Away: true})
+	dave.Invisible = true
+
+	SendFriendsPresence(context.Background(), a, alice)
+
+	seen := map[string]string{}
+	timeout := time.After(2 * time.Second)
+	for len(seen) < 2 {
+		select {
+		case frame := <-alice.Outbound:
+			data := string(frame.Data)
+			for _, friend := range []*structs.Client{bob, carol, dave} {
+				if strings.Contains(data, `from="`+friend.JID+`"`) {
+					seen[friend.AccountID] = data
+				}
+			}
+		case <-timeout:
+			t.Fatalf("alice got the presence of %v, want bob's and carol's", seen)
+		}
+	}
+
+	if !strings.Contains(seen["carol"], "carol-status") {
+		t.Errorf("carol's presence = %s", seen["carol"])
+	}
+	if !strings.Contains(seen["bob"], "bob-status") || !strings.Contains(seen["bob"], "<show>away</show>") {
+		t.Errorf("bob's presence from node b = %s", seen["bob"])
+	}
+
+	// Invisible friends stay hidden across nodes too.
+	select {
+	case frame := <-alice.Outbound:
+		t.Errorf("alice was sent %s", frame.Data)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestClusterRoutingDoesNotWait(t *testing.T) {
+	a, _ := startTestCluster(t, storage.NewMemory(storage.Seed{}))
+	alice := addTestSession(t, a, "", "alice")
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+
+	clusterPeers.Store(&map[*structs.Server]map[string]models.ClusterNode{
+		a: {"slow": {ID: "slow", Address: slow.URL, Seen: time.Now()}},
+	})
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		routePresence(context.Background(), a, alice, "status", false, false, nil)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("routing presence waited %v for a slow node", elapsed)
+	}
+}
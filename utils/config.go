@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"sync/atomic"
+
+	"github.com/RazerFrFr/Voryn/config"
+)
+
+var currentConfig atomic.Pointer[config.Config]
+
+func init() {
+	currentConfig.Store(config.Default())
+}
+
+// Configure makes cfg the configuration the utils package runs with. It is
+// called once before the server starts, and again on every reload with the
+// result of config.Reload, so settings that can't change live must already
+// match the running ones.
+func Configure(cfg *config.Config) {
+	currentConfig.Store(cfg)
+	configureLogging(cfg.Log)
+	configureWebhooks(cfg.Webhooks)
+}
+
+// CurrentConfig returns the configuration in effect. Callers must not modify it.
+func CurrentConfig() *config.Config {
+	return currentConfig.Load()
+}
@@ -0,0 +1,315 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+
+	"github.com/RazerFrFr/Voryn/structs"
+	"github.com/google/uuid"
+)
+
+const (
+	nsDiscoInfo  = "http://jabber.org/protocol/disco#info"
+	nsDiscoItems = "http://jabber.org/protocol/disco#items"
+	nsCaps       = "http://jabber.org/protocol/caps"
+	nsPing       = "urn:xmpp:ping"
+
+	capsNode = "https://github.com/RazerFrFr/Voryn"
+)
+
+type discoComponent struct {
+	Prefix string
+	Info   structs.DiscoInfo
+}
+
+var serverInfo = structs.DiscoInfo{
+	Identities: []structs.DiscoIdentity{
+		{Category: "server", Type: "im", Name: "Voryn"},
+	},
+	Features: []string{nsDiscoInfo, nsDiscoItems, nsCaps, nsPing, nsBlocking, nsInvisible, nsLast},
+}
+
+var discoComponents = []discoComponent{
+	{
+		Prefix: "muc",
+		Info: structs.DiscoInfo{
+			Identities: []structs.DiscoIdentity{{Category: "conference", Type: "text", Name: "Party Chat"}},
+			Features:   []string{nsDiscoInfo, nsDiscoItems, "http://jabber.org/protocol/muc"},
+		},
+	},
+	{
+		Prefix: "pubsub",
+		Info: structs.DiscoInfo{
+			Identities: []structs.DiscoIdentity{{Category: "pubsub", Type: "service", Name: "Publish-Subscribe"}},
+			Features:   []string{nsDiscoInfo, nsDiscoItems, "http://jabber.org/protocol/pubsub"},
+		},
+	},
+}
+
+func HandleDiscoInfo(ctx context.Context, client *structs.Client, id, to string, query map[string]interface{}, server *structs.Server) {
+	node, _ := query["-node"].(string)
+	from := to
+	if from == "" {
+		from = server.Domain
+	}
+
+	var info *structs.DiscoInfo
+	switch {
+	case from == server.Domain:
+		if node == "" || node == capsNode+"#"+ServerCapsVer() {
+			info = &serverInfo
+		}
+	case strings.Contains(from, "@"):
+		info = discoInfoForJID(ctx, client, from, server)
+	default:
+		for i := range discoComponents {
+			if from == discoComponents[i].Prefix+"."+server.Domain && node == "" {
+				info = &discoComponents[i].Info
+				break
+			}
+		}
+	}
+
+	if info == nil {
+		SendIQError(client, id, from, "cancel", "item-not-found")
+		return
+	}
+
+	nodeAttr := ""
+	if node != "" {
+		nodeAttr = fmt.Sprintf(` node="%s"`, xmlEscape(node))
+	}
+
+	var b strings.Builder
+	for _, identity := range info.Identities {
+		fmt.Fprintf(&b, `<identity category="%s" type="%s" name="%s"/>`,
+			xmlEscape(identity.Category), xmlEscape(identity.Type), xmlEscape(identity.Name))
+	}
+	for _, feature := range info.Features {
+		fmt.Fprintf(&b, `<feature var="%s"/>`, xmlEscape(feature))
+	}
+
+	resp := fmt.Sprintf(`<iq to="%s" from="%s" id="%s" type="result" xmlns="jabber:client"><query xmlns="%s"%s>%s</query></iq>`,
+		client.JID, xmlEscape(from), xmlEscape(id), nsDiscoInfo, nodeAttr, b.String())
+	Enqueue(client, resp)
+}
+
+func HandleDiscoItems(client *structs.Client, id, to string, query map[string]interface{}, server *structs.Server) {
+	node, _ := query["-node"].(string)
+	from := to
+	if from == "" {
+		from = server.Domain
+	}
+
+	var b strings.Builder
+	if from == server.Domain && node == "" {
+		for _, component := range discoComponents {
+			name := ""
+			if len(component.Info.Identities) > 0 {
+				name = component.Info.Identities[0].Name
+			}
+			fmt.Fprintf(&b, `<item jid="%s.%s" name="%s"/>`, component.Prefix, server.Domain, xmlEscape(name))
+		}
+	}
+
+	resp := fmt.Sprintf(`<iq to="%s" from="%s" id="%s" type="result" xmlns="jabber:client"><query xmlns="%s">%s</query></iq>`,
+		client.JID, xmlEscape(from), xmlEscape(id), nsDiscoItems, b.String())
+	Enqueue(client, resp)
+}
+
+// discoInfoForJID answers a disco#info query addressed to a user. Bare JIDs
+// are answered on behalf of the account whether or not it is online, so the
+// answer doesn't reveal its presence. Full JIDs are answered from the caps
+// cache, and only to sessions allowed to see the target's presence.
+func discoInfoForJID(ctx context.Context, client *structs.Client, jid string, server *structs.Server) *structs.DiscoInfo {
+	bare, _, hasResource := strings.Cut(jid, "/")
+	if !strings.HasSuffix(bare, "@"+server.Domain) {
+		return nil
+	}
+
+	if !hasResource {
+		return &structs.DiscoInfo{
+			Identities: []structs.DiscoIdentity{{Category: "account", Type: "registered"}},
+			Features:   []string{nsDiscoInfo},
+		}
+	}
+
+	target := server.Clients.ByJID(jid)
+	if target == nil || !canSeePresence(ctx, client, target, server) {
+		return nil
+	}
+
+	ver := clientCaps(target).Ver
+	server.CapsMutex.Lock()
+	defer server.CapsMutex.Unlock()
+	info, ok := server.CapsCache.Get(ver)
+	if !ok {
+		return nil
+	}
+	return &info
+}
+
+// clientCaps returns the caps client last advertised.
+func clientCaps(client *structs.Client) structs.Caps {
+	client.CapsMutex.Lock()
+	defer client.CapsMutex.Unlock()
+	return client.Caps
+}
+
+func setClientCaps(client *structs.Client, caps structs.Caps) {
+	client.CapsMutex.Lock()
+	client.Caps = caps
+	client.CapsMutex.Unlock()
+}
+
+// HandleCaps records the caps a client advertised in its presence and, when the
+// ver string is not cached yet, asks the client what it stands for. A client
+// has one query outstanding at most; a new ver replaces the one it was asked
+// about before.
+func HandleCaps(client *structs.Client, msg map[string]interface{}, server *structs.Server) {
+	c, ok := msg["c"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if xmlns, _ := c["-xmlns"].(string); xmlns != nsCaps {
+		return
+	}
+
+	caps := structs.Caps{}
+	caps.Node, _ = c["-node"].(string)
+	caps.Ver, _ = c["-ver"].(string)
+	caps.Hash, _ = c["-hash"].(string)
+
+	// Legacy caps without a hash can't be verified, so they are not cached.
+	if caps.Ver == "" || capsHashFunc(caps.Hash) == nil {
+		return
+	}
+	setClientCaps(client, caps)
+
+	server.CapsMutex.Lock()
+	if _, cached := server.CapsCache.Get(caps.Ver); cached {
+		server.CapsMutex.Unlock()
+		return
+	}
+	for id, pending := range server.PendingCaps {
+		if pending.Caps.Ver == caps.Ver {
+			server.CapsMutex.Unlock()
+			return
+		}
+		if pending.Client == client {
+			delete(server.PendingCaps, id)
+		}
+	}
+	id := "caps_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	server.PendingCaps[id] = structs.CapsQuery{Client: client, Caps: caps}
+	server.CapsMutex.Unlock()
+
+	query := fmt.Sprintf(`<iq to="%s" from="%s" id="%s" type="get" xmlns="jabber:client"><query xmlns="%s" node="%s#%s"/></iq>`,
+		client.JID, server.Domain, id, nsDiscoInfo, xmlEscape(caps.Node), xmlEscape(caps.Ver))
+	Enqueue(client, query)
+}
+
+// HandleIQResult processes result and error iqs sent by a client in reply to a
+// query from the server.
+func HandleIQResult(client *structs.Client, id, iqType string, root map[string]interface{}, server *structs.Server) {
+	server.CapsMutex.Lock()
+	defer server.CapsMutex.Unlock()
+
+	pending, ok := server.PendingCaps[id]
+	if !ok || pending.Client != client {
+		return
+	}
+	delete(server.PendingCaps, id)
+
+	if iqType != "result" {
+		return
+	}
+
+	query, ok := root["query"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	info := structs.DiscoInfo{}
+	for _, node := range nodeList(query["identity"]) {
+		identity := structs.DiscoIdentity{}
+		identity.Category, _ = node["-category"].(string)
+		identity.Type, _ = node["-type"].(string)
+		identity.Name, _ = node["-name"].(string)
+		if lang, ok := node["-xml:lang"].(string); ok {
+			identity.Lang = lang
+		} else {
+			identity.Lang, _ = node["-lang"].(string)
+		}
+		info.Identities = append(info.Identities, identity)
+	}
+	for _, node := range nodeList(query["feature"]) {
+		if feature, ok := node["-var"].(string); ok {
+			info.Features = append(info.Features, feature)
+		}
+	}
+
+	if ver := CapsVer(info, pending.Caps.Hash); ver != pending.Caps.Ver {
+		Log.Stream.Warn("Caps verification failed", "session", client)
+		return
+	}
+
+	server.CapsCache.Add(pending.Caps.Ver, info)
+}
+
+// ServerCapsVer returns the sha-1 caps ver string of the server's own disco#info.
+func ServerCapsVer() string {
+	return CapsVer(serverInfo, "sha-1")
+}
+
+// CapsVer computes the XEP-0115 verification string for info.
+func CapsVer(info structs.DiscoInfo, hashName string) string {
+	newHash := capsHashFunc(hashName)
+	if newHash == nil {
+		return ""
+	}
+
+	identities := append([]structs.DiscoIdentity(nil), info.Identities...)
+	sort.Slice(identities, func(i, j int) bool {
+		a, b := identities[i], identities[j]
+		if a.Category != b.Category {
+			return a.Category < b.Category
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Lang < b.Lang
+	})
+
+	features := append([]string(nil), info.Features...)
+	sort.Strings(features)
+
+	var s strings.Builder
+	for _, identity := range identities {
+		fmt.Fprintf(&s, "%s/%s/%s/%s<", identity.Category, identity.Type, identity.Lang, identity.Name)
+	}
+	for _, feature := range features {
+		s.WriteString(feature)
+		s.WriteString("<")
+	}
+
+	h := newHash()
+	h.Write([]byte(s.String()))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func capsHashFunc(name string) func() hash.Hash {
+	switch name {
+	case "sha-1":
+		return sha1.New
+	case "sha-256":
+		return sha256.New
+	}
+	return nil
+}
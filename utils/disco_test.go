@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+func capsPresence(ver string) map[string]interface{} {
+	return map[string]interface{}{
+		"c": map[string]interface{}{"-xmlns": nsCaps, "-node": "https://example.com/client", "-ver": ver, "-hash": "sha-1"},
+	}
+}
+
+func TestCapsQueries(t *testing.T) {
+	server := &structs.Server{Domain: testDomain, Store: storage.NewMemory(storage.Seed{}), PendingCaps: map[string]structs.CapsQuery{}}
+	client := addTestSession(t, server, "", "alice")
+
+	// Each new ver replaces the query still outstanding.
+	for i := 0; i < 5; i++ {
+		HandleCaps(client, capsPresence(fmt.Sprintf("ver%d", i)), server)
+		receive(t, client, "caps_", fmt.Sprintf("#ver%d", i))
+	}
+	if n := len(server.PendingCaps); n != 1 {
+		t.Fatalf("%d caps queries pending, want 1", n)
+	}
+	for _, pending := range server.PendingCaps {
+		if pending.Caps.Ver != "ver4" {
+			t.Errorf("pending query is about %s, want the latest ver", pending.Caps.Ver)
+		}
+	}
+
+	forgetPendingCaps(server, client)
+	if n := len(server.PendingCaps); n != 0 {
+		t.Errorf("%d caps queries pending for a removed client", n)
+	}
+}
+
+func TestCapsCacheIsBounded(t *testing.T) {
+	var cache structs.CapsCache
+	for i := 0; i < 5000; i++ {
+		cache.Add(fmt.Sprintf("ver%d", i), structs.DiscoInfo{})
+		if i == 0 {
+			continue
+		}
+		// Keep the first entry in use.
+		if _, ok := cache.Get("ver0"); !ok {
+			t.Fatalf("recently used entry evicted after %d adds", i)
+		}
+	}
+	if cache.Len() > 1024 {
+		t.Errorf("cache holds %d entries", cache.Len())
+	}
+	if _, ok := cache.Get("ver1"); ok {
+		t.Error("least recently used entry wasn't evicted")
+	}
+}
+
+func TestDiscoEscapesAddresses(t *testing.T) {
+	server := &structs.Server{Domain: testDomain, Store: storage.NewMemory(storage.Seed{})}
+	client := addTestSession(t, server, "", "alice")
+
+	id := `q1"><message to="bob@example.com"><body>spoofed</body></message><iq id="`
+	to := `chat.example.com"><message/><x a="`
+	HandleDiscoInfo(context.Background(), client, id, to, map[string]interface{}{}, server)
+	HandleDiscoItems(client, id, to, map[string]interface{}{}, server)
+
+	for _, frame := range sent(client) {
+		if strings.Contains(frame, "<message") {
+			t.Errorf("client-supplied address was written raw: %s", frame)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+const (
+	EventSessionConnect    = "session.connect"
+	EventSessionAuth       = "session.auth"
+	EventSessionBind       = "session.bind"
+	EventSessionResume     = "session.resume"
+	EventSessionDisconnect = "session.disconnect"
+	EventSessionKick       = "session.kick"
+	EventPresenceChange    = "presence.change"
+	EventPartyJoin         = "party.join"
+	EventPartyExit         = "party.exit"
+	EventMessageDelivered  = "message.delivered"
+
+	eventBufferSize = 256
+)
+
+type Event struct {
+	Type      string                 `json:"type"`
+	Domain    string                 `json:"domain,omitempty"`
+	AccountID string                 `json:"accountId,omitempty"`
+	JID       string                 `json:"jid,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+// EventFilter limits a subscription to one domain and to some accounts and
+// event types. A type also matches every event below it, so "session" matches
+// "session.auth".
+type EventFilter struct {
+	Domain     string
+	AccountIDs []string
+	Types      []string
+}
+
+func (f EventFilter) matches(event Event) bool {
+	if f.Domain != "" && !strings.EqualFold(f.Domain, event.Domain) {
+		return false
+	}
+
+	if len(f.AccountIDs) > 0 {
+		found := false
+		for _, accountID := range f.AccountIDs {
+			if accountID == event.AccountID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(f.Types) > 0 {
+		for _, t := range f.Types {
+			if event.Type == t || strings.HasPrefix(event.Type, t+".") {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+type EventSubscription struct {
+	C      chan Event
+	filter EventFilter
+}
+
+var eventSubscribers = struct {
+	sync.RWMutex
+	subs map[*EventSubscription]struct{}
+}{subs: map[*EventSubscription]struct{}{}}
+
+// SubscribeEvents registers a listener for events matching filter. Slow
+// listeners miss events rather than holding up the server.
+func SubscribeEvents(filter EventFilter) *EventSubscription {
+	sub := &EventSubscription{C: make(chan Event, eventBufferSize), filter: filter}
+
+	eventSubscribers.Lock()
+	eventSubscribers.subs[sub] = struct{}{}
+	eventSubscribers.Unlock()
+	return sub
+}
+
+func UnsubscribeEvents(sub *EventSubscription) {
+	eventSubscribers.Lock()
+	delete(eventSubscribers.subs, sub)
+	eventSubscribers.Unlock()
+}
+
+// PublishEvent hands event to every matching subscriber without blocking.
+// Webhook deliveries aren't subscribers: the event is handed to the webhook
+// writer, which saves them to the store of the event's host.
+func PublishEvent(event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	if webhookHosts.Load() != nil {
+		sendToWebhooks(event)
+	}
+
+	eventSubscribers.RLock()
+	defer eventSubscribers.RUnlock()
+
+	for sub := range eventSubscribers.subs {
+		if !sub.filter.matches(event) {
+			continue
+		}
+		select {
+		case sub.C <- event:
+		default:
+		}
+	}
+}
+
+func publishSessionEvent(eventType string, client *structs.Client, data map[string]interface{}) {
+	PublishEvent(Event{
+		Type:      eventType,
+		Domain:    client.Domain,
+		AccountID: client.AccountID,
+		JID:       client.JID,
+		Data:      data,
+	})
+}
+
+// publishPresenceEvents reports a presence update, plus the party join or exit
+// it implies when the party in the status changed.
+func publishPresenceEvents(client *structs.Client, previousParty string, offline bool) {
+	presence := LastPresence(client)
+	publishSessionEvent(EventPresenceChange, client, map[string]interface{}{
+		"status":    presence.Status,
+		"away":      presence.Away,
+		"offline":   offline,
+		"invisible": client.Invisible,
+	})
+
+	party := GetPartyID(client)
+	if party == previousParty {
+		return
+	}
+	if previousParty != "" {
+		publishSessionEvent(EventPartyExit, client, map[string]interface{}{"partyId": previousParty})
+	}
+	if party != "" {
+		publishSessionEvent(EventPartyJoin, client, map[string]interface{}{"partyId": party})
+	}
+}
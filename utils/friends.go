@@ -0,0 +1,12 @@
+package utils
+
+import (
+	"context"
+
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+// UnblockAccount clears the blocked list of accountID.
+func UnblockAccount(ctx context.Context, server *structs.Server, accountID string) error {
+	return server.Store.Friends.ClearFriendList(ctx, accountID, "blocked")
+}
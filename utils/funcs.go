@@ -4,156 +4,214 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
-	"log"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/RazerFrFr/Voryn/config"
 	"github.com/RazerFrFr/Voryn/models"
 	"github.com/RazerFrFr/Voryn/structs"
-	"github.com/gorilla/websocket"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var DB *mongo.Database
+const connectBackoffMax = 30 * time.Second
 
-func InitDB() {
-	uri := os.Getenv("MONGO_URI")
-	dbName := os.Getenv("DB_NAME")
+// InitDB connects to MongoDB, retrying with backoff up to cfg.ConnectRetries
+// times. With cfg.FailFast it makes a single attempt. Voryn exits if no
+// attempt succeeds rather than starting without a database.
+func InitDB(cfg config.MongoConfig) *mongo.Database {
+	fullURI := fmt.Sprintf("%s%s", cfg.URI, cfg.Database)
 
-	if uri == "" || dbName == "" {
-		log.Fatal("MONGO_URI or DB_NAME environment variable not set")
+	retries := cfg.ConnectRetries
+	if cfg.FailFast {
+		retries = 0
 	}
 
-	fullURI := fmt.Sprintf("%s%s", uri, dbName)
-
 	clientOptions := options.Client().
 		ApplyURI(fullURI).
-		SetServerSelectionTimeout(10 * time.Second)
+		SetServerSelectionTimeout(10 * time.Second).
+		SetMonitor(MongoMonitor)
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		client, err := connectDB(clientOptions)
+		if err == nil {
+			Log.MongoDB.Info("Connection established", "uri", config.RedactURI(fullURI))
+			return client.Database(cfg.Database)
+		}
 
-	client, err := mongo.NewClient(clientOptions)
-	if err != nil {
-		Logger.Error("Failed to create MongoDB client:", err)
+		if attempt >= retries {
+			Log.MongoDB.Error("Giving up on MongoDB", "uri", config.RedactURI(fullURI), "attempts", attempt+1, "error", err)
+			os.Exit(1)
+		}
+
+		Log.MongoDB.Warn("Connection failed, retrying", "attempt", attempt+1, "of", retries+1, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > connectBackoffMax {
+			backoff = connectBackoffMax
+		}
 	}
+}
 
+func connectDB(clientOptions *options.ClientOptions) (*mongo.Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	err = client.Connect(ctx)
+	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		Logger.Error("MongoDB connection failed:", err)
+		return nil, err
 	}
 
-	err = client.Ping(ctx, nil)
-	if err != nil {
-		Logger.Error("MongoDB ping failed:", err)
+	if err := client.Ping(ctx, nil); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, err
 	}
-
-	DB = client.Database(dbName)
-	Logger.MongoDB(fmt.Sprintf("Connection to %s successfully established.", fullURI))
+	return client, nil
 }
 
 func SendError(client *structs.Client) {
 	closeXML := `<close xmlns="urn:ietf:params:xml:ns:xmpp-framing"/>`
-	client.Conn.WriteMessage(1, []byte(closeXML))
-	client.Conn.Close()
+	Enqueue(client, closeXML)
+	CloseClient(client)
 }
 
-func GetUserByAccountID(accountID string) (*models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	collection := DB.Collection("users")
-
-	var user models.User
-	err := collection.FindOne(ctx, bson.M{"accountId": accountID}).Decode(&user)
+func GetUserByAccountID(ctx context.Context, server *structs.Server, accountID string) (*models.User, error) {
+	user, err := server.Store.Users.GetUser(ctx, accountID)
 	if err != nil {
 		return nil, fmt.Errorf("user not found: %w", err)
 	}
 
 	if user.Banned {
-		return nil, fmt.Errorf("user is banned")
+		return nil, ErrUserBanned
 	}
 
-	return &user, nil
+	return user, nil
 }
 
 func RemoveClient(server *structs.Server, client *structs.Client) {
-	server.ClientsMutex.Lock()
-	for i, c := range server.Clients {
-		if c == client {
-			server.Clients = append(server.Clients[:i], server.Clients[i+1:]...)
-			break
-		}
+	if !endResumption(client) {
+		return
+	}
+	// A kicked client is removed by the kick, then again when its read loop
+	// ends.
+	if !server.Clients.Remove(client) {
+		return
 	}
-	server.ClientsMutex.Unlock()
+	forgetPendingCaps(server, client)
 
-	UpdatePresenceForFriends(server, client, "{}", false, true)
+	// The fan-out below resets the status the party is read from.
+	partyID := GetPartyID(client)
+	UpdatePresenceForFriends(context.Background(), server, client, "{}", false, true)
 
-	partyID := ""
-	var clientStatus map[string]interface{}
-	if err := json.Unmarshal([]byte(client.LastPresenceUpdate.Status), &clientStatus); err == nil {
-		if props, ok := clientStatus["Properties"].(map[string]interface{}); ok {
-			for key, val := range props {
-				if len(key) >= 14 && strings.ToLower(key[:14]) == "party.joininfo" {
-					if obj, ok := val.(map[string]interface{}); ok {
-						if pid, ok := obj["partyId"].(string); ok {
-							partyID = pid
-							break
-						}
-					}
-				}
-			}
+	releaseSession(context.Background(), server, client)
+
+	if client.AccountID != "" {
+		if err := server.Store.Users.SetLastLogout(context.Background(), client.AccountID, time.Now().UTC()); err != nil {
+			Log.MongoDB.Error("Failed to save logout time", "error", err, "session", client)
 		}
 	}
 
 	if partyID != "" {
-		for _, c := range server.Clients {
-			if c.AccountID == client.AccountID {
+		msg := map[string]interface{}{
+			"type": "com.epicgames.party.memberexited",
+			"payload": map[string]interface{}{
+				"partyId":   partyID,
+				"memberId":  client.AccountID,
+				"wasKicked": false,
+			},
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+		}
+		data, _ := json.Marshal(msg)
+
+		for _, c := range server.Clients.Snapshot() {
+			if c.AccountID == client.AccountID || c.JID == "" || GetPartyID(c) != partyID {
 				continue
 			}
 
-			go func(c *structs.Client) {
-				msg := map[string]interface{}{
-					"type": "com.epicgames.party.memberexited",
-					"payload": map[string]interface{}{
-						"partyId":   partyID,
-						"memberId":  client.AccountID,
-						"wasKicked": false,
-					},
-					"timestamp": time.Now().UTC().Format(time.RFC3339),
-				}
-				data, _ := json.Marshal(msg)
-				xmlMsg := fmt.Sprintf(`<message from="%s" to="%s"><body>%s</body></message>`,
-					client.JID, c.JID, string(data))
-
-				c.Conn.SetWriteDeadline(time.Now().Add(2 * time.Second))
-				if err := c.Conn.WriteMessage(websocket.TextMessage, []byte(xmlMsg)); err != nil {
-					Logger.Error("Failed to send party exit:", err)
-				}
-			}(c)
+			xmlMsg := fmt.Sprintf(`<message from="%s" to="%s"><body>%s</body></message>`,
+				client.JID, c.JID, string(data))
+			if err := Enqueue(c, xmlMsg); err != nil {
+				Log.Stream.Warn("Failed to send party exit", "error", err, "session", c)
+			}
 		}
 	}
 
+	if client.ClientExists {
+		publishSessionEvent(EventSessionDisconnect, client, nil)
+	}
+
 	client.AccountID = ""
 	client.JID = ""
 	client.Resource = ""
 	client.Token = ""
 	client.Authenticated = false
+	client.AuthenticatedAt = time.Time{}
+	client.InitialPresence = false
+	client.Invisible = false
+	client.ActivityMutex.Lock()
+	client.AutoAway = false
+	client.ActivityMutex.Unlock()
 	client.ClientExists = false
 }
 
-func GetFriendsClients(server *structs.Server, accountID string) ([]*structs.Client, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// forgetPendingCaps drops the disco#info queries sent to client.
+func forgetPendingCaps(server *structs.Server, client *structs.Client) {
+	server.CapsMutex.Lock()
+	defer server.CapsMutex.Unlock()
+	for id, pending := range server.PendingCaps {
+		if pending.Client == client {
+			delete(server.PendingCaps, id)
+		}
+	}
+}
+
+// GetPartyID returns the party the client advertises in its presence status,
+// or an empty string when it isn't in one.
+func GetPartyID(client *structs.Client) string {
+	var clientStatus map[string]interface{}
+	if err := json.Unmarshal([]byte(LastPresence(client).Status), &clientStatus); err != nil {
+		return ""
+	}
+
+	props, ok := clientStatus["Properties"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for key, val := range props {
+		if len(key) >= 14 && strings.ToLower(key[:14]) == "party.joininfo" {
+			if obj, ok := val.(map[string]interface{}); ok {
+				if pid, ok := obj["partyId"].(string); ok {
+					return pid
+				}
+			}
+		}
+	}
+	return ""
+}
 
-	collection := DB.Collection("users")
+// ParseResource splits a game resource such as "V2:Fortnite:WIN::<id>" into
+// its app, platform and build parts. Unknown formats yield empty fields.
+func ParseResource(resource string) structs.ResourceInfo {
+	parts := strings.Split(resource, ":")
+	if len(parts) < 3 || !strings.HasPrefix(parts[0], "V") {
+		return structs.ResourceInfo{}
+	}
 
-	var friendsDoc models.Friends
-	err := collection.FindOne(ctx, bson.M{"accountId": accountID}).Decode(&friendsDoc)
+	info := structs.ResourceInfo{App: parts[1], Platform: parts[2]}
+	if len(parts) > 4 {
+		info.Build = parts[3]
+	}
+	return info
+}
+
+func GetFriendsClients(ctx context.Context, server *structs.Server, accountID string) ([]*structs.Client, error) {
+	friendsDoc, err := server.Store.Friends.GetFriends(ctx, accountID)
 	if err != nil {
 		return nil, err
 	}
@@ -161,11 +219,8 @@ func GetFriendsClients(server *structs.Server, accountID string) ([]*structs.Cli
 	var friendsClients []*structs.Client
 
 	for _, f := range friendsDoc.List.Accepted {
-		for _, c := range server.Clients {
-			if c.AccountID == f.AccountID {
-				friendsClients = append(friendsClients, c)
-				break
-			}
+		if c := server.Clients.FirstByAccount(f.AccountID); c != nil {
+			friendsClients = append(friendsClients, c)
 		}
 	}
 
@@ -174,61 +229,200 @@ func GetFriendsClients(server *structs.Server, accountID string) ([]*structs.Cli
 
 func GetFriendsPresence(server *structs.Server, ws *structs.Client, friends []*structs.Client) {
 	for _, friend := range friends {
-		presenceXML := fmt.Sprintf(`<presence from="%s" to="%s" type="available"><status>%s</status></presence>`,
-			friend.JID, ws.JID, friend.LastPresenceUpdate.Status)
-		if friend.LastPresenceUpdate.Away {
-			presenceXML = fmt.Sprintf(`<presence from="%s" to="%s" type="available"><show>away</show><status>%s</status></presence>`,
-				friend.JID, ws.JID, friend.LastPresenceUpdate.Status)
+		if IsBlockedBetween(ws, friend) || (friend.Invisible && !HasDirectedPresence(friend, ws.JID)) {
+			continue
 		}
-		ws.Conn.WriteMessage(1, []byte(presenceXML))
+		Enqueue(ws, availablePresence(friend, ws.JID))
 	}
 }
 
-func UpdatePresenceForFriends(server *structs.Server, sender *structs.Client, body string, away, offline bool) {
-	sender.LastPresenceUpdate.Away = away
-	sender.LastPresenceUpdate.Status = body
+// availablePresence is friend's last presence, addressed to the JID to.
+func availablePresence(friend *structs.Client, to string) string {
+	presence := LastPresence(friend)
+	if presence.Away {
+		return fmt.Sprintf(`<presence from="%s" to="%s" type="available"><show>away</show><status>%s</status></presence>`,
+			friend.JID, to, xmlEscape(presence.Status))
+	}
+	return fmt.Sprintf(`<presence from="%s" to="%s" type="available"><status>%s</status></presence>`,
+		friend.JID, to, xmlEscape(presence.Status))
+}
 
-	server.ClientsMutex.Lock()
-	defer server.ClientsMutex.Unlock()
+// SendFriendsPresence sends client the presence of its friends' sessions, on
+// this node and, in cluster mode, on the others. It is called on the client's
+// initial presence.
+func SendFriendsPresence(ctx context.Context, server *structs.Server, client *structs.Client) {
+	friendsDoc, err := server.Store.Friends.GetFriends(ctx, client.AccountID)
+	if err != nil {
+		Log.MongoDB.Error("Failed to load friends", "error", err, "session", client)
+		return
+	}
 
-	for _, client := range server.Clients {
-		if client.AccountID == sender.AccountID {
-			continue
+	var local []*structs.Client
+	var remote []string
+	for _, f := range friendsDoc.List.Accepted {
+		if c := server.Clients.FirstByAccount(f.AccountID); c != nil {
+			local = append(local, c)
+		} else {
+			remote = append(remote, f.AccountID)
 		}
-		presenceType := "available"
+	}
+
+	GetFriendsPresence(server, client, local)
+	probeFriends(ctx, server, client, remote)
+}
+
+func UpdatePresenceForFriends(ctx context.Context, server *structs.Server, sender *structs.Client, body string, away, offline bool) {
+	defer observePresenceFanout(time.Now())
+
+	previousParty := GetPartyID(sender)
+	setLastPresence(sender, structs.PresenceUpdate{Away: away, Status: body})
+	publishPresenceEvents(sender, previousParty, offline)
+
+	if sender.Invisible {
 		if offline {
-			presenceType = "unavailable"
-		}
-		statusXML := body
-		if away {
-			presenceXML := fmt.Sprintf(`<presence from="%s" to="%s" type="%s"><show>away</show><status>%s</status></presence>`,
-				sender.JID, client.JID, presenceType, statusXML)
-			client.Conn.WriteMessage(1, []byte(presenceXML))
-		} else {
-			presenceXML := fmt.Sprintf(`<presence from="%s" to="%s" type="%s"><status>%s</status></presence>`,
-				sender.JID, client.JID, presenceType, statusXML)
-			client.Conn.WriteMessage(1, []byte(presenceXML))
+			sendDirectedUnavailable(ctx, sender, server)
 		}
+		return
 	}
+
+	routePresence(ctx, server, sender, body, away, offline, nil)
+	if offline && ShuttingDown() {
+		// Local sessions are all being closed; telling each of them about
+		// the others would only eat into the shutdown deadline.
+		return
+	}
+	fanOutPresence(ctx, server, sender.AccountID, sender.JID, body, away, offline,
+		func(c *structs.Client) bool { return HasBlocked(sender, c.AccountID) })
 }
 
-func FindClientByAccountID(server *structs.Server, accountID string) *structs.Client {
-	server.ClientsMutex.Lock()
-	defer server.ClientsMutex.Unlock()
+// fanOutPresence sends a presence update to the local sessions of the sender's
+// accepted friends, found through the account index, so its cost follows the
+// size of the friend list rather than the number of sessions. Sessions that
+// blocked the sender or that skip rejects, such as those of friends the sender
+// blocked, are skipped. The fan-out is traced as one span; the writes to each
+// session are not.
+func fanOutPresence(ctx context.Context, server *structs.Server, senderAccount, senderJID, body string, away, offline bool, skip func(receiver *structs.Client) bool) {
+	ctx, span := tracer.Start(ctx, "presence.fanout", trace.WithAttributes(attribute.String("xmpp.account.id", senderAccount)))
+	defer span.End()
+
+	friends, err := server.Store.Friends.GetFriends(ctx, senderAccount)
+	if err != nil {
+		Log.MongoDB.Error("Failed to load friends", "accountId", senderAccount, "error", err)
+		failSpan(span, err)
+		return
+	}
 
-	for _, c := range server.Clients {
-		if c.AccountID == accountID {
-			return c
+	recipients := 0
+	for _, friend := range friends.List.Accepted {
+		if friend.AccountID == senderAccount {
+			continue
+		}
+		for _, client := range server.Clients.ByAccount(friend.AccountID) {
+			if client.JID == "" || HasBlocked(client, senderAccount) || skip(client) {
+				continue
+			}
+			recipients++
+			presenceType := "available"
+			if offline {
+				presenceType = "unavailable"
+			}
+			statusXML := xmlEscape(body)
+			if away {
+				presenceXML := fmt.Sprintf(`<presence from="%s" to="%s" type="%s"><show>away</show><status>%s</status></presence>`,
+					senderJID, client.JID, presenceType, statusXML)
+				Enqueue(client, presenceXML)
+			} else {
+				presenceXML := fmt.Sprintf(`<presence from="%s" to="%s" type="%s"><status>%s</status></presence>`,
+					senderJID, client.JID, presenceType, statusXML)
+				Enqueue(client, presenceXML)
+			}
 		}
 	}
-	return nil
+	span.SetAttributes(attribute.Int("voryn.recipients", recipients))
+}
+
+func FindClientByAccountID(server *structs.Server, accountID string) *structs.Client {
+	return server.Clients.FirstByAccount(accountID)
 }
 
 func SendSASLError(client *structs.Client, condition string) {
 	errXML := fmt.Sprintf(
 		`<failure xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><%s/></failure>`, condition,
 	)
-	client.Conn.WriteMessage(websocket.TextMessage, []byte(errXML))
+	Enqueue(client, errXML)
+}
+
+func SendSASLErrorText(client *structs.Client, condition, text string) {
+	if text == "" {
+		SendSASLError(client, condition)
+		return
+	}
+	errXML := fmt.Sprintf(
+		`<failure xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><%s/><text xml:lang="en">%s</text></failure>`, condition, xmlEscape(text),
+	)
+	Enqueue(client, errXML)
+}
+
+// SendStreamError ends the client's stream with an RFC 6120 stream error and
+// optional text, then closes the socket once both have been written.
+func SendStreamError(client *structs.Client, condition, text string) {
+	textXML := ""
+	if text != "" {
+		textXML = fmt.Sprintf(`<text xmlns="urn:ietf:params:xml:ns:xmpp-streams" xml:lang="en">%s</text>`, xmlEscape(text))
+	}
+
+	errXML := fmt.Sprintf(
+		`<stream:error xmlns:stream="http://etherx.jabber.org/streams"><%s xmlns="urn:ietf:params:xml:ns:xmpp-streams"/>%s</stream:error>`,
+		condition, textXML,
+	)
+	Enqueue(client, errXML)
+	SendError(client)
+}
+
+func SendIQError(client *structs.Client, id, from, errType, condition string) {
+	errXML := fmt.Sprintf(
+		`<iq to="%s" from="%s" id="%s" type="error" xmlns="jabber:client"><error type="%s"><%s xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></iq>`,
+		client.JID, xmlEscape(from), xmlEscape(id), errType, condition,
+	)
+	Enqueue(client, errXML)
+}
+
+func BareJID(accountID, domain string) string {
+	return fmt.Sprintf("%s@%s", accountID, domain)
+}
+
+// AccountIDFromJID returns the local part of a bare or full JID on domain.
+func AccountIDFromJID(jid, domain string) string {
+	bare, _, _ := strings.Cut(jid, "/")
+	accountID, jidDomain, ok := strings.Cut(bare, "@")
+	if !ok || !strings.EqualFold(jidDomain, domain) {
+		return ""
+	}
+	return accountID
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// nodeList normalizes a parsed child element, which mxj returns as a map for a
+// single occurrence and as a slice for repeated ones.
+func nodeList(v interface{}) []map[string]interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{node}
+	case []interface{}:
+		nodes := make([]map[string]interface{}, 0, len(node))
+		for _, n := range node {
+			if m, ok := n.(map[string]interface{}); ok {
+				nodes = append(nodes, m)
+			}
+		}
+		return nodes
+	}
+	return nil
 }
 
 type TokenPayload struct {
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+func partyStatus(partyID string) structs.PresenceUpdate {
+	return structs.PresenceUpdate{Status: `{"Status":"","Properties":{"party.joininfodata.286331153_j":{"partyId":"` + partyID + `"}}}`}
+}
+
+func TestRemoveClientNotifiesParty(t *testing.T) {
+	server := &structs.Server{Domain: testDomain, Store: storage.NewMemory(storage.Seed{})}
+	alice := addTestSession(t, server, "", "alice")
+	bob := addTestSession(t, server, "", "bob")
+	carol := addTestSession(t, server, "", "carol")
+	setLastPresence(alice, partyStatus("p1"))
+	setLastPresence(bob, partyStatus("p1"))
+	setLastPresence(carol, partyStatus("p2"))
+
+	RemoveClient(server, alice)
+
+	receive(t, bob, "com.epicgames.party.memberexited", `"partyId":"p1"`, `"memberId":"alice"`)
+	for _, frame := range sent(carol) {
+		if strings.Contains(frame, "memberexited") {
+			t.Errorf("member of another party was told: %s", frame)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	listenerFDEnv = "VORYN_LISTENER_FD"
+	readyFDEnv    = "VORYN_READY_FD"
+	sessionsFDEnv = "VORYN_SESSIONS_FD"
+
+	// handoffTimeout bounds how long the new process may take to start
+	// serving before it is killed and the handoff abandoned.
+	handoffTimeout = time.Minute
+
+	// takeoverTimeout bounds a request for a session of the previous process.
+	takeoverTimeout = 5 * time.Second
+)
+
+var (
+	// startEnv is the environment the process started with, before .env was
+	// loaded, so a new process reads .env again.
+	startEnv = os.Environ()
+
+	// previous is the connection to the process that handed its listener
+	// over, through which sessions it detached are resumed here. conn is nil
+	// after a fresh start and once that process exited.
+	previous struct {
+		sync.Mutex
+		conn net.Conn
+		enc  *json.Encoder
+		dec  *json.Decoder
+	}
+)
+
+// takeoverRequest asks the previous process for one of its detached sessions.
+type takeoverRequest struct {
+	ID        string `json:"id"`
+	Domain    string `json:"domain"`
+	AccountID string `json:"accountId"`
+	H         uint32 `json:"h"`
+}
+
+type takeoverResponse struct {
+	State *resumeState `json:"state,omitempty"`
+	Error string       `json:"error,omitempty"`
+}
+
+// Listen returns the listener the previous process handed over, or a new one
+// on address. listen.address only applies when nothing was handed over.
+func Listen(address string) (net.Listener, error) {
+	fd := os.Getenv(listenerFDEnv)
+	if fd == "" {
+		return net.Listen("tcp", address)
+	}
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", listenerFDEnv, err)
+	}
+	file := os.NewFile(uintptr(n), "listener")
+	defer file.Close()
+	connectPrevious()
+	return net.FileListener(file)
+}
+
+// connectPrevious opens the connection to the previous process for taking
+// its sessions over.
+func connectPrevious() {
+	fd := os.Getenv(sessionsFDEnv)
+	if fd == "" {
+		return
+	}
+	os.Unsetenv(sessionsFDEnv)
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		Log.XMPP.Error("Invalid "+sessionsFDEnv, "error", err)
+		return
+	}
+	file := os.NewFile(uintptr(n), "sessions")
+	defer file.Close()
+	conn, err := net.FileConn(file)
+	if err != nil {
+		Log.XMPP.Error("Failed to connect to the previous process", "error", err)
+		return
+	}
+
+	setPrevious(conn)
+}
+
+func setPrevious(conn net.Conn) {
+	previous.Lock()
+	defer previous.Unlock()
+	previous.conn = conn
+	previous.enc = json.NewEncoder(conn)
+	previous.dec = json.NewDecoder(conn)
+}
+
+// resumeFromPrevious reports whether the process that handed its listener
+// over may still hold detached sessions.
+func resumeFromPrevious() bool {
+	previous.Lock()
+	defer previous.Unlock()
+	return previous.conn != nil
+}
+
+// takeFromPrevious takes a detached session over from the previous process.
+func takeFromPrevious(req takeoverRequest) (*resumeState, error) {
+	previous.Lock()
+	defer previous.Unlock()
+	if previous.conn == nil {
+		return nil, errNotResumable
+	}
+
+	var resp takeoverResponse
+	_ = previous.conn.SetDeadline(time.Now().Add(takeoverTimeout))
+	err := previous.enc.Encode(req)
+	if err == nil {
+		err = previous.dec.Decode(&resp)
+	}
+	if err != nil {
+		// The previous process exited, or a late reply would be read as the
+		// answer to the next request.
+		_ = previous.conn.Close()
+		previous.conn, previous.enc, previous.dec = nil, nil, nil
+		return nil, fmt.Errorf("%w: previous process: %v", errNotResumable, err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.State, nil
+}
+
+// serveTakeovers hands the sessions this process detached over to the
+// process it handed its listener to, until that one closes conn.
+func serveTakeovers(conn net.Conn) {
+	defer conn.Close()
+	in, out := json.NewDecoder(conn), json.NewEncoder(conn)
+	for {
+		var req takeoverRequest
+		if err := in.Decode(&req); err != nil {
+			return
+		}
+
+		var resp takeoverResponse
+		state, err := takeSession(req.ID, req.Domain, req.AccountID, req.H, nil)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.State = state
+			Log.XMPP.Debug("Session taken over by the new process", "accountId", req.AccountID, "jid", state.JID)
+		}
+		if err := out.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// Inherited reports whether this process was started by a handoff.
+func Inherited() bool {
+	return os.Getenv(listenerFDEnv) != ""
+}
+
+// HandoffReady tells the process that handed its listener over that this one
+// is serving, so it can start draining. It does nothing after a fresh start.
+func HandoffReady() {
+	fd := os.Getenv(readyFDEnv)
+	if fd == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		Log.XMPP.Error("Invalid "+readyFDEnv, "error", err)
+		return
+	}
+	file := os.NewFile(uintptr(n), "handoff")
+	defer file.Close()
+	if _, err := file.Write([]byte{1}); err != nil {
+		Log.XMPP.Error("Failed to report readiness to the previous process", "error", err)
+	}
+}
+
+// NotifyHandoff relays the handoff signal (SIGUSR2) to c. On platforms
+// without it, handoff is not available and c never receives.
+func NotifyHandoff(c chan<- os.Signal) {
+	if handoffSignal != nil {
+		signal.Notify(c, handoffSignal)
+	}
+}
+
+// Handoff starts the binary at os.Args[0] again with the same arguments and
+// passes it listener. It returns once the new process is serving; from then
+// on both accept connections until this one closes its listener.
+func Handoff(listener net.Listener) error {
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok {
+		return errors.New("listener can't be handed over")
+	}
+	listenerFile, err := tcp.File()
+	if err != nil {
+		return err
+	}
+	defer listenerFile.Close()
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	sessions, sessionsRemote, err := socketPair()
+	if err != nil {
+		return err
+	}
+	defer sessions.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(handoffEnv(), listenerFDEnv+"=3", readyFDEnv+"=4", sessionsFDEnv+"=5")
+	cmd.ExtraFiles = []*os.File{listenerFile, readyWriter, sessionsRemote}
+	err = cmd.Start()
+	readyWriter.Close()
+	sessionsRemote.Close()
+	if err != nil {
+		return err
+	}
+	go func() { _ = cmd.Wait() }()
+
+	result := make(chan error, 1)
+	go func() {
+		if _, err := ready.Read(make([]byte, 1)); err != nil {
+			result <- errors.New("new process exited before it was ready")
+			return
+		}
+		result <- nil
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return err
+		}
+		conn, err := net.FileConn(sessions)
+		if err != nil {
+			Log.XMPP.Error("Sessions can't be resumed in the new process", "error", err)
+			return nil
+		}
+		go serveTakeovers(conn)
+		return nil
+	case <-time.After(handoffTimeout):
+		_ = cmd.Process.Kill()
+		return errors.New("new process did not become ready in time")
+	}
+}
+
+func handoffEnv() []string {
+	env := make([]string, 0, len(startEnv))
+	for _, kv := range startEnv {
+		if !strings.HasPrefix(kv, listenerFDEnv+"=") && !strings.HasPrefix(kv, readyFDEnv+"=") && !strings.HasPrefix(kv, sessionsFDEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
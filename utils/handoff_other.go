@@ -0,0 +1,14 @@
+//go:build !unix
+
+package utils
+
+import (
+	"errors"
+	"os"
+)
+
+var handoffSignal os.Signal
+
+func socketPair() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("handoff is not supported on this platform")
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"strings"
+
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+// Hosts are the virtual hosts one process serves. Each is a separate
+// structs.Server, so sessions, caches and storage never mix between domains.
+type Hosts struct {
+	// Default serves streams that don't name a domain. It is the first host.
+	Default *structs.Server
+	List    []*structs.Server
+
+	byDomain map[string]*structs.Server
+}
+
+func NewHosts(servers ...*structs.Server) *Hosts {
+	hosts := &Hosts{
+		Default:  servers[0],
+		List:     servers,
+		byDomain: map[string]*structs.Server{},
+	}
+	for _, server := range servers {
+		hosts.byDomain[strings.ToLower(server.Domain)] = server
+	}
+	return hosts
+}
+
+// Lookup returns the host serving domain, the default host when domain is
+// empty, or nil when no host serves it.
+func (h *Hosts) Lookup(domain string) *structs.Server {
+	if domain == "" {
+		return h.Default
+	}
+	return h.byDomain[strings.ToLower(domain)]
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+// streamErrorConditions are the defined stream error conditions of RFC 6120
+// section 4.9.3.
+var streamErrorConditions = map[string]bool{
+	"bad-format":               true,
+	"bad-namespace-prefix":     true,
+	"conflict":                 true,
+	"connection-timeout":       true,
+	"host-gone":                true,
+	"host-unknown":             true,
+	"improper-addressing":      true,
+	"internal-server-error":    true,
+	"invalid-from":             true,
+	"invalid-namespace":        true,
+	"invalid-xml":              true,
+	"not-authorized":           true,
+	"not-well-formed":          true,
+	"policy-violation":         true,
+	"remote-connection-failed": true,
+	"reset":                    true,
+	"resource-constraint":      true,
+	"restricted-xml":           true,
+	"see-other-host":           true,
+	"system-shutdown":          true,
+	"undefined-condition":      true,
+	"unsupported-encoding":     true,
+	"unsupported-feature":      true,
+	"unsupported-stanza-type":  true,
+	"unsupported-version":      true,
+}
+
+func IsStreamErrorCondition(condition string) bool {
+	return streamErrorConditions[condition]
+}
+
+type KickOptions struct {
+	Reason    string
+	Condition string
+	KickedBy  string
+	Cooldown  time.Duration
+}
+
+// KickAccount ends every session of accountID with a stream error, on this
+// node and on the nodes holding its other sessions, and records the kick with
+// its optional reconnect cooldown. It returns the kick record, or
+// ErrClientNotFound when the account has no sessions.
+func KickAccount(ctx context.Context, server *structs.Server, accountID string, opts KickOptions) (*models.Kick, error) {
+	if opts.Condition == "" {
+		opts.Condition = "policy-violation"
+	}
+	if !IsStreamErrorCondition(opts.Condition) {
+		return nil, fmt.Errorf("unknown stream error condition %q", opts.Condition)
+	}
+
+	local := server.Clients.ByAccount(accountID)
+	remote := remoteSessions(ctx, server, accountID)
+	if len(local) == 0 && len(remote) == 0 {
+		return nil, ErrClientNotFound
+	}
+
+	kick := &models.Kick{
+		AccountID: accountID,
+		KickedBy:  opts.KickedBy,
+		Reason:    opts.Reason,
+		Condition: opts.Condition,
+		Sessions:  len(local) + len(remote),
+		Created:   time.Now().UTC(),
+	}
+	if opts.Cooldown > 0 {
+		kick.CooldownUntil = kick.Created.Add(opts.Cooldown)
+	}
+
+	// The cooldown is read from the kick record, so it is saved before the
+	// sessions end and can't reconnect in between, on any node.
+	if err := server.Store.Kicks.SaveKick(ctx, kick); err != nil {
+		Log.MongoDB.Error("Failed to record kick", "accountId", accountID, "error", err)
+	}
+
+	endSessions(server, accountID, opts.Condition, opts.Reason)
+	routeKick(ctx, server, remote, accountID, opts)
+
+	Log.XMPP.Info("Kicked account", "accountId", accountID, "domain", server.Domain, "kickedBy", opts.KickedBy, "condition", opts.Condition, "reason", opts.Reason)
+	PublishEvent(Event{
+		Type:      EventSessionKick,
+		Domain:    server.Domain,
+		AccountID: accountID,
+		Data: map[string]interface{}{
+			"kickedBy":  opts.KickedBy,
+			"reason":    opts.Reason,
+			"condition": opts.Condition,
+			"sessions":  kick.Sessions,
+		},
+	})
+
+	return kick, nil
+}
+
+// endSessions ends the sessions of accountID held by this node with a stream
+// error. It returns ErrClientNotFound when there are none.
+func endSessions(server *structs.Server, accountID, condition, reason string) error {
+	if !IsStreamErrorCondition(condition) {
+		return fmt.Errorf("unknown stream error condition %q", condition)
+	}
+	clients := server.Clients.ByAccount(accountID)
+	if len(clients) == 0 {
+		return ErrClientNotFound
+	}
+	for _, client := range clients {
+		SendStreamError(client, condition, reason)
+		RemoveClient(server, client)
+	}
+	return nil
+}
+
+// routeKick asks each node holding one of the given sessions to end the
+// sessions of accountID it holds.
+func routeKick(ctx context.Context, server *structs.Server, sessions []models.SessionEntry, accountID string, opts KickOptions) {
+	peers := peerNodes(server)
+	done := map[string]bool{}
+	for _, entry := range sessions {
+		if done[entry.NodeID] {
+			continue
+		}
+		done[entry.NodeID] = true
+
+		err := forwardRoute(ctx, peers[entry.NodeID], ClusterRoute{
+			Domain:    server.Domain,
+			Kind:      routeKindKick,
+			AccountID: accountID,
+			Reason:    opts.Reason,
+			Condition: opts.Condition,
+		})
+		if err != nil && !errors.Is(err, ErrClientNotFound) {
+			Log.Cluster.Error("Failed to route kick", "node", entry.NodeID, "accountId", accountID, "error", err)
+		}
+	}
+}
+
+// KickCooldownRemaining returns how long accountID is still barred from
+// logging in after a kick. Cooldowns are read from the kick records, so they
+// hold on every node.
+func KickCooldownRemaining(ctx context.Context, server *structs.Server, accountID string) time.Duration {
+	now := time.Now()
+	until, err := server.Store.Kicks.CooldownUntil(ctx, accountID, now)
+	if err != nil {
+		Log.MongoDB.Error("Failed to read kick cooldown", "accountId", accountID, "error", err)
+		return 0
+	}
+	if until.IsZero() {
+		return 0
+	}
+	return until.Sub(now)
+}
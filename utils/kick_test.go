@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+// recordingFriends is a friend store that remembers whose friends were read.
+type recordingFriends struct {
+	storage.FriendStore
+
+	mu    sync.Mutex
+	reads []string
+}
+
+func (s *recordingFriends) GetFriends(ctx context.Context, accountID string) (*models.Friends, error) {
+	s.mu.Lock()
+	s.reads = append(s.reads, accountID)
+	s.mu.Unlock()
+	return s.FriendStore.GetFriends(ctx, accountID)
+}
+
+func TestKickedClientIsRemovedOnce(t *testing.T) {
+	store := storage.NewMemory(storage.Seed{})
+	friends := &recordingFriends{FriendStore: store.Friends}
+	store.Friends = friends
+	server := &structs.Server{Domain: testDomain, Store: store}
+	alice := addTestSession(t, server, "", "alice")
+
+	if _, err := KickAccount(context.Background(), server, "alice", KickOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	friends.mu.Lock()
+	reads := len(friends.reads)
+	friends.mu.Unlock()
+
+	// The read loop of the kicked client ends and removes it again.
+	RemoveClient(server, alice)
+
+	friends.mu.Lock()
+	defer friends.mu.Unlock()
+	if len(friends.reads) != reads {
+		t.Errorf("second removal read friends of %q", friends.reads[reads:])
+	}
+}
+
+func TestKickReachesOtherNodes(t *testing.T) {
+	store := storage.NewMemory(storage.Seed{})
+	a, b := startTestCluster(t, store)
+	bob := addTestSession(t, b, "b", "bob")
+	ctx := context.Background()
+
+	kick, err := KickAccount(ctx, a, "bob", KickOptions{Reason: "spam", Cooldown: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kick.Sessions != 1 {
+		t.Errorf("kick ended %d sessions, want 1", kick.Sessions)
+	}
+	receive(t, bob, "<stream:error", "policy-violation", "spam")
+	if b.Clients.ByJID(bob.JID) != nil {
+		t.Error("kicked session is still registered on its node")
+	}
+
+	// The cooldown holds on the node that didn't kick.
+	if remaining := KickCooldownRemaining(ctx, b, "bob"); remaining <= 0 || remaining > time.Minute {
+		t.Errorf("cooldown on node b = %v, want up to a minute", remaining)
+	}
+	if remaining := KickCooldownRemaining(ctx, b, "alice"); remaining != 0 {
+		t.Errorf("cooldown of an account that wasn't kicked = %v", remaining)
+	}
+}
@@ -1,35 +1,196 @@
 package utils
 
 import (
-	"fmt"
+	"context"
+	"log/slog"
+	"os"
+	"sync"
 	"time"
+
+	"github.com/RazerFrFr/Voryn/config"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Sampled loggers pass the first logSampleBurst records with the same
+	// level and message in each logSampleWindow, then every logSampleEvery-th.
+	logSampleWindow = time.Second
+	logSampleBurst  = 10
+	logSampleEvery  = 100
+)
+
+// Loggers holds a logger per subsystem. Every record carries a "subsystem"
+// attribute; pass a *structs.Client as "session" to attach its session ID,
+// account ID, JID and remote address.
+type Loggers struct {
+	XMPP     *slog.Logger
+	MongoDB  *slog.Logger
+	HTTP     *slog.Logger
+	Auth     *slog.Logger
+	Cluster  *slog.Logger
+	Webhooks *slog.Logger
+	Outbox   *slog.Logger
+	Tracing  *slog.Logger
+
+	// Stream logs per-connection failures (write errors, full queues,
+	// malformed XML) that can flood the log when many clients misbehave at
+	// once, so it is sampled.
+	Stream *slog.Logger
+}
+
+var (
+	Log Loggers
+
+	logLevel  slog.LevelVar
+	logFormat string
 )
 
-func getTimestamp() string {
-	now := time.Now()
-	return now.Format("01/02/2006 15:04:05")
+func init() {
+	setupLogging("text")
+}
+
+// configureLogging applies log.level, and log.format the first time it
+// differs from the running one; the format can't change after startup.
+func configureLogging(cfg config.LogConfig) {
+	logLevel.Set(parseLogLevel(cfg.Level))
+	if cfg.Format != "" && cfg.Format != logFormat {
+		setupLogging(cfg.Format)
+	}
+}
+
+func setupLogging(format string) {
+	opts := &slog.HandlerOptions{Level: &logLevel}
+
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	}
+	logFormat = format
+
+	root := slog.New(handler)
+	slog.SetDefault(root)
+
+	subsystem := func(name string) *slog.Logger {
+		return root.With("subsystem", name)
+	}
+	Log = Loggers{
+		XMPP:     subsystem("xmpp"),
+		MongoDB:  subsystem("mongodb"),
+		HTTP:     subsystem("http"),
+		Auth:     subsystem("auth"),
+		Cluster:  subsystem("cluster"),
+		Webhooks: subsystem("webhooks"),
+		Outbox:   subsystem("outbox"),
+		Tracing:  subsystem("tracing"),
+		Stream:   slog.New(newSampleHandler(handler)).With("subsystem", "xmpp"),
+	}
+}
+
+func parseLogLevel(level string) slog.Level {
+	switch level {
+	case "info":
+		return slog.LevelInfo
+	case "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelDebug
+	}
 }
 
-type LoggerFunc func(v ...any)
+// LogRequests logs each HTTP request once it has been handled. Requests that
+// fail with a server error are logged as errors.
+func LogRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
 
-func createLogger(prefix string) LoggerFunc {
-	return func(v ...any) {
-		fmt.Print("[", getTimestamp(), "] ")
-		fmt.Print("[", prefix, "] ")
-		fmt.Println(v...)
+		level := slog.LevelInfo
+		if c.Writer.Status() >= 500 {
+			level = slog.LevelError
+		}
+		Log.HTTP.Log(c.Request.Context(), level, "Request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration", time.Since(start),
+			"clientIp", c.ClientIP(),
+		)
 	}
 }
 
-var Logger = struct {
-	XMPP    LoggerFunc
-	MongoDB LoggerFunc
-	Warning LoggerFunc
-	Error   LoggerFunc
-	Debug   LoggerFunc
-}{
-	XMPP:    createLogger("XMPP"),
-	MongoDB: createLogger("MONGODB"),
-	Warning: createLogger("WARNING"),
-	Error:   createLogger("ERROR"),
-	Debug:   createLogger("DEBUG"),
+// sampleHandler drops records past the sampling limits. A record that passes
+// after others were dropped carries their count as "dropped".
+type sampleHandler struct {
+	slog.Handler
+	state *sampleState
+}
+
+type sampleState struct {
+	mu     sync.Mutex
+	counts map[sampleKey]*sampleCount
+}
+
+type sampleKey struct {
+	level   slog.Level
+	message string
+}
+
+type sampleCount struct {
+	start   time.Time
+	seen    int
+	dropped int
+}
+
+func newSampleHandler(next slog.Handler) *sampleHandler {
+	return &sampleHandler{Handler: next, state: &sampleState{counts: map[sampleKey]*sampleCount{}}}
+}
+
+func (h *sampleHandler) Handle(ctx context.Context, r slog.Record) error {
+	dropped, ok := h.state.allow(sampleKey{r.Level, r.Message}, r.Time)
+	if !ok {
+		return nil
+	}
+	if dropped > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("dropped", dropped))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *sampleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sampleHandler{Handler: h.Handler.WithAttrs(attrs), state: h.state}
+}
+
+func (h *sampleHandler) WithGroup(name string) slog.Handler {
+	return &sampleHandler{Handler: h.Handler.WithGroup(name), state: h.state}
+}
+
+// allow reports whether a record may pass and, if so, how many with the same
+// key were dropped since the last one that did. Messages are constants, so the
+// map stays small.
+func (s *sampleState) allow(key sampleKey, now time.Time) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := s.counts[key]
+	if count == nil {
+		count = &sampleCount{start: now}
+		s.counts[key] = count
+	} else if now.Sub(count.start) >= logSampleWindow {
+		count.start = now
+		count.seen = 0
+	}
+
+	count.seen++
+	if count.seen <= logSampleBurst || (count.seen-logSampleBurst)%logSampleEvery == 0 {
+		dropped := count.dropped
+		count.dropped = 0
+		return dropped, true
+	}
+	count.dropped++
+	return 0, false
 }
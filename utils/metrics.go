@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/structs"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Metrics is the registry served on /metrics.
+var Metrics = prometheus.NewRegistry()
+
+var (
+	stanzasIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "voryn_stanzas_in_total",
+		Help: "Top-level elements received from clients, by element name.",
+	}, []string{"type"})
+
+	stanzasOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "voryn_stanzas_out_total",
+		Help: "Top-level elements written to clients, by element name.",
+	}, []string{"type"})
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "voryn_auth_failures_total",
+		Help: "Rejected SASL authentications, by reason.",
+	}, []string{"reason"})
+
+	presenceFanout = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "voryn_presence_fanout_seconds",
+		Help:    "Time taken to fan a presence update out to other sessions.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+
+	mongoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "voryn_mongo_command_seconds",
+		Help:    "MongoDB command latency, by command.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"command"})
+
+	mongoErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "voryn_mongo_command_errors_total",
+		Help: "Failed MongoDB commands, by command.",
+	}, []string{"command"})
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "voryn_http_requests_total",
+		Help: "Admin HTTP requests, by method, route and status.",
+	}, []string{"method", "route", "status"})
+)
+
+func init() {
+	Metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		stanzasIn, stanzasOut, authFailures, presenceFanout,
+		mongoDuration, mongoErrors, httpRequests,
+	)
+}
+
+// RegisterServerMetrics exposes the session, queue and cache state of every
+// host, read at scrape time.
+func RegisterServerMetrics(hosts *Hosts) {
+	Metrics.MustRegister(&serverCollector{hosts: hosts})
+}
+
+var (
+	sessionsDesc = prometheus.NewDesc("voryn_sessions",
+		"Connected sessions, by domain, platform and authenticated state.",
+		[]string{"domain", "platform", "authenticated"}, nil)
+
+	queueDepthDesc = prometheus.NewDesc("voryn_outbound_queue_depth",
+		"Stanzas waiting in outbound queues across all sessions.", nil, nil)
+
+	queueDepthMaxDesc = prometheus.NewDesc("voryn_outbound_queue_depth_max",
+		"Largest outbound queue of any single session.", nil, nil)
+
+	cacheLookupsDesc = prometheus.NewDesc("voryn_cache_lookups_total",
+		"Storage cache lookups, by domain, cache and result (hit, miss, or stale when an expired entry covered a failed read).",
+		[]string{"domain", "cache", "result"}, nil)
+
+	cacheEvictionsDesc = prometheus.NewDesc("voryn_cache_evictions_total",
+		"Entries evicted from a storage cache to stay within its size limit.",
+		[]string{"domain", "cache"}, nil)
+
+	cacheEntriesDesc = prometheus.NewDesc("voryn_cache_entries",
+		"Entries currently held in a storage cache.",
+		[]string{"domain", "cache"}, nil)
+)
+
+type serverCollector struct {
+	hosts *Hosts
+}
+
+func (c *serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sessionsDesc
+	ch <- queueDepthDesc
+	ch <- queueDepthMaxDesc
+	ch <- cacheLookupsDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheEntriesDesc
+}
+
+func (c *serverCollector) Collect(ch chan<- prometheus.Metric) {
+	depth, maxDepth := 0, 0
+	for _, server := range c.hosts.List {
+		d, m := collectServer(ch, server)
+		depth += d
+		if m > maxDepth {
+			maxDepth = m
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(depth))
+	ch <- prometheus.MustNewConstMetric(queueDepthMaxDesc, prometheus.GaugeValue, float64(maxDepth))
+}
+
+// collectServer sends the session and cache metrics of one host and returns
+// the total and largest outbound queue depth of its sessions.
+func collectServer(ch chan<- prometheus.Metric, server *structs.Server) (depth, maxDepth int) {
+	type sessionKey struct {
+		platform      string
+		authenticated bool
+	}
+	sessions := map[sessionKey]int{}
+
+	for _, client := range server.Clients.Snapshot() {
+		platform := ParseResource(client.Resource).Platform
+		if platform == "" {
+			platform = "unknown"
+		}
+		sessions[sessionKey{platform, client.Authenticated}]++
+
+		d := QueueDepth(client)
+		depth += d
+		if d > maxDepth {
+			maxDepth = d
+		}
+	}
+
+	for key, count := range sessions {
+		ch <- prometheus.MustNewConstMetric(sessionsDesc, prometheus.GaugeValue, float64(count),
+			server.Domain, key.platform, strconv.FormatBool(key.authenticated))
+	}
+
+	if server.Store == nil {
+		return depth, maxDepth
+	}
+	for _, cache := range server.Store.Caches {
+		stats := cache.Stats()
+		ch <- prometheus.MustNewConstMetric(cacheLookupsDesc, prometheus.CounterValue, float64(stats.Hits), server.Domain, cache.Name(), "hit")
+		ch <- prometheus.MustNewConstMetric(cacheLookupsDesc, prometheus.CounterValue, float64(stats.Misses), server.Domain, cache.Name(), "miss")
+		ch <- prometheus.MustNewConstMetric(cacheLookupsDesc, prometheus.CounterValue, float64(stats.Stale), server.Domain, cache.Name(), "stale")
+		ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions), server.Domain, cache.Name())
+		ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(stats.Entries), server.Domain, cache.Name())
+	}
+	return depth, maxDepth
+}
+
+// MongoMonitor times and traces every command sent to MongoDB.
+var MongoMonitor = &event.CommandMonitor{
+	Started: startMongoSpan,
+	Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+		mongoDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+		endMongoSpan(e.RequestID, nil)
+	},
+	Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+		mongoDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+		mongoErrors.WithLabelValues(e.CommandName).Inc()
+		endMongoSpan(e.RequestID, errors.New(e.Failure))
+	},
+}
+
+// MetricsMiddleware counts admin HTTP requests by route.
+func MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	}
+}
+
+// CountStanzaIn counts an element received from a client. Names outside the
+// stanzas Voryn handles are grouped so clients can't inflate label cardinality.
+func CountStanzaIn(name string) {
+	switch name {
+	case "open", "auth", "iq", "message", "presence", "close":
+	default:
+		name = "other"
+	}
+	stanzasIn.WithLabelValues(name).Inc()
+}
+
+func countStanzaOut(data []byte) {
+	stanzasOut.WithLabelValues(stanzaName(data)).Inc()
+}
+
+func countAuthFailure(reason string) {
+	authFailures.WithLabelValues(reason).Inc()
+}
+
+func observePresenceFanout(start time.Time) {
+	presenceFanout.Observe(time.Since(start).Seconds())
+}
+
+// stanzaName returns the local name of the first element in data.
+func stanzaName(data []byte) string {
+	s := strings.TrimLeft(string(data), " \t\r\n")
+	if !strings.HasPrefix(s, "<") {
+		return "unknown"
+	}
+	s = s[1:]
+	if end := strings.IndexAny(s, " />\t\r\n"); end >= 0 {
+		s = s[:end]
+	}
+	if _, local, ok := strings.Cut(s, ":"); ok {
+		s = local
+	}
+	return s
+}
@@ -1,18 +1,28 @@
 package utils
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/RazerFrFr/Voryn/storage"
 	"github.com/RazerFrFr/Voryn/structs"
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const XMPPDomain string = "prod.ol.epicgames.com"
+var (
+	ErrClientNotFound = errors.New("client not found")
+	ErrMessageBlocked = errors.New("message blocked by recipient")
+	ErrUserBanned     = errors.New("user is banned")
+)
 
 func HandleOpen(client *structs.Client, data map[string]string, rawOpen map[string]string) {
 	id := rawOpen["id"]
@@ -20,7 +30,7 @@ func HandleOpen(client *structs.Client, data map[string]string, rawOpen map[stri
 		id = strings.ReplaceAll(uuid.New().String(), "-", "")
 	}
 
-	from := XMPPDomain
+	from := client.Domain
 	version := rawOpen["version"]
 	if version == "" {
 		version = "1.0"
@@ -30,7 +40,8 @@ func HandleOpen(client *structs.Client, data map[string]string, rawOpen map[stri
 		`<open xmlns="urn:ietf:params:xml:ns:xmpp-framing" from="%s" id="%s" version="%s" xml:lang="en"/>`,
 		from, id, version,
 	)
-	client.Conn.WriteMessage(websocket.TextMessage, []byte(openXML))
+	Enqueue(client, openXML)
+	sampleSession(client)
 
 	var features string
 	if client.Authenticated {
@@ -42,6 +53,8 @@ func HandleOpen(client *structs.Client, data map[string]string, rawOpen map[stri
                 <method>zlib</method>
             </compression>
             <session xmlns="urn:ietf:params:xml:ns:xmpp-session"/>
+            <sm xmlns="urn:xmpp:sm:3"/>
+            <c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="%s" ver="%s"/>
         </stream:features>`
 	} else {
 		features = `<stream:features xmlns:stream="http://etherx.jabber.org/streams">
@@ -54,32 +67,46 @@ func HandleOpen(client *structs.Client, data map[string]string, rawOpen map[stri
                 <method>zlib</method>
             </compression>
             <auth xmlns="http://jabber.org/features:iq-auth"/>
+            <c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="%s" ver="%s"/>
         </stream:features>`
 	}
+	features = fmt.Sprintf(features, capsNode, ServerCapsVer())
 
-	client.Conn.WriteMessage(websocket.TextMessage, []byte(features))
+	Enqueue(client, features)
 }
 
 func HandleAuth(client *structs.Client, content string, server *structs.Server) error {
+	ctx, span := startSessionSpan(context.Background(), client, "xmpp.auth")
+	defer span.End()
+
+	err := handleAuth(ctx, client, content, server)
+	failSpan(span, err)
+	return err
+}
+
+func handleAuth(ctx context.Context, client *structs.Client, content string, server *structs.Server) error {
 	if client.AccountID != "" {
 		return nil
 	}
 	if content == "" {
-		Logger.Error("Auth content missing")
+		Log.Auth.Warn("Login refused", "reason", "missing_content", "session", client)
+		countAuthFailure("missing_content")
 		SendSASLError(client, "not-authorized")
 		return fmt.Errorf("content missing")
 	}
 
 	decoded, err := base64.StdEncoding.DecodeString(content)
 	if err != nil {
-		Logger.Error("Base64 decode failed:", err)
+		Log.Auth.Warn("Login refused", "reason", "bad_encoding", "error", err, "session", client)
+		countAuthFailure("bad_encoding")
 		SendSASLError(client, "not-authorized")
 		return err
 	}
 
 	parts := strings.Split(string(decoded), "\x00")
 	if len(parts) != 3 {
-		Logger.Error("Decoded auth parts invalid")
+		Log.Auth.Warn("Login refused", "reason", "bad_format", "session", client)
+		countAuthFailure("bad_format")
 		SendSASLError(client, "not-authorized")
 		return fmt.Errorf("invalid auth format")
 	}
@@ -87,49 +114,96 @@ func HandleAuth(client *structs.Client, content string, server *structs.Server)
 	tokenStr := strings.TrimPrefix(parts[2], "eg1~")
 	claims, err := DecodeToken(tokenStr)
 	if err != nil {
-		Logger.Error("Access token is Invalid:", err)
+		Log.Auth.Warn("Login refused", "reason", "invalid_token", "error", err, "session", client)
+		countAuthFailure("invalid_token")
 		SendSASLError(client, "not-authorized")
 		return fmt.Errorf("invalid token")
 	}
 
 	accountID := claims.Sub
 
-	for _, c := range server.Clients {
-		if c.AccountID == accountID {
-			Logger.Error("Client already connected")
-			SendSASLError(client, "conflict")
-			return fmt.Errorf("already connected")
-		}
+	if remaining := KickCooldownRemaining(ctx, server, accountID); remaining > 0 {
+		Log.Auth.Warn("Login refused", "reason", "kick_cooldown", "accountId", accountID, "session", client)
+		countAuthFailure("kick_cooldown")
+		text := strings.ReplaceAll(CurrentConfig().Messages.KickCooldown, "{seconds}", strconv.Itoa(int(remaining.Seconds())+1))
+		SendSASLErrorText(client, "account-disabled", text)
+		return fmt.Errorf("kick cooldown")
+	}
+
+	if hasAttachedSession(server, accountID) {
+		Log.Auth.Warn("Login refused", "reason", "conflict", "accountId", accountID, "session", client)
+		countAuthFailure("conflict")
+		SendSASLError(client, "conflict")
+		return fmt.Errorf("already connected")
 	}
 
-	user, err := GetUserByAccountID(accountID)
-	if err != nil || user.Banned {
-		Logger.Error("User not found or banned")
+	user, err := GetUserByAccountID(ctx, server, accountID)
+	if errors.Is(err, ErrUserBanned) {
+		Log.Auth.Warn("Login refused", "reason", "banned", "accountId", accountID, "session", client)
+		countAuthFailure("banned")
+		SendSASLErrorText(client, "not-authorized", CurrentConfig().Messages.Banned)
+		return err
+	}
+	if err != nil {
+		Log.Auth.Warn("Login refused", "reason", "invalid_user", "accountId", accountID, "error", err, "session", client)
+		countAuthFailure("invalid_user")
 		SendSASLError(client, "not-authorized")
 		return fmt.Errorf("invalid user")
 	}
 
+	if err := claimSession(ctx, server, client, user.AccountID); errors.Is(err, storage.ErrConflict) {
+		Log.Auth.Warn("Login refused", "reason", "conflict", "accountId", accountID, "onOtherNode", true, "session", client)
+		countAuthFailure("conflict")
+		SendSASLError(client, "conflict")
+		return fmt.Errorf("already connected")
+	} else if err != nil {
+		Log.Cluster.Error("Failed to claim session in the directory", "error", err, "session", client)
+	}
+
 	client.AccountID = user.AccountID
+	server.Clients.Update(client)
+	settleCapture(client)
 	client.DisplayName = user.Username
 	client.Token = tokenStr
 	client.Authenticated = true
+	client.AuthenticatedAt = time.Now()
+
+	if err := LoadBlocklist(ctx, client, server); err != nil {
+		Log.MongoDB.Error("Failed to load blocklist", "error", err, "session", client)
+	}
 
 	successXML := `<success xmlns="urn:ietf:params:xml:ns:xmpp-sasl"/>`
-	client.Conn.WriteMessage(websocket.TextMessage, []byte(successXML))
+	EnqueueContext(ctx, client, successXML)
+	publishSessionEvent(EventSessionAuth, client, map[string]interface{}{"displayName": client.DisplayName})
+	Log.Auth.Info("Logged in", "displayName", client.DisplayName, "session", client)
 	return nil
 }
 
 func HandleIQ(client *structs.Client, root map[string]interface{}, server *structs.Server) {
 	id, _ := root["-id"].(string)
+	iqType, _ := root["-type"].(string)
+	ctx, span := startSessionSpan(context.Background(), client, "xmpp.iq",
+		trace.WithAttributes(attribute.String("xmpp.iq.id", id), attribute.String("xmpp.iq.type", iqType)))
+	defer span.End()
+
+	handleIQ(ctx, client, id, iqType, root, server)
+}
+
+func handleIQ(ctx context.Context, client *structs.Client, id, iqType string, root map[string]interface{}, server *structs.Server) {
 	if id == "" {
 		SendError(client)
 		return
 	}
 
+	if iqType == "result" || iqType == "error" {
+		HandleIQResult(client, id, iqType, root, server)
+		return
+	}
+
 	if _, ok := root["ping"]; ok {
 		resp := fmt.Sprintf(`<iq to="%s" from="%s" id="%s" type="result" xmlns="jabber:client"/>`,
-			client.JID, XMPPDomain, id)
-		client.Conn.WriteMessage(websocket.TextMessage, []byte(resp))
+			client.JID, server.Domain, id)
+		Enqueue(client, resp)
 		return
 	}
 
@@ -156,14 +230,18 @@ func HandleIQ(client *structs.Client, root map[string]interface{}, server *struc
 			return
 		}
 
+		EndDetachedSessions(server, client.AccountID)
 		client.Resource = resource
-		client.JID = fmt.Sprintf("%s@%s/%s", client.AccountID, XMPPDomain, client.Resource)
+		client.JID = fmt.Sprintf("%s@%s/%s", client.AccountID, server.Domain, client.Resource)
+		server.Clients.Update(client)
 
 		bindXML := fmt.Sprintf(`<iq to="%s" id="_xmpp_bind1" type="result" xmlns="jabber:client">
             <bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><jid>%s</jid></bind>
         </iq>`, client.JID, client.JID)
 
-		client.Conn.WriteMessage(websocket.TextMessage, []byte(bindXML))
+		Enqueue(client, bindXML)
+		bindSession(ctx, server, client)
+		publishSessionEvent(EventSessionBind, client, map[string]interface{}{"resource": client.Resource})
 
 	case "_xmpp_session1":
 		if client.AccountID == "" || client.Resource == "" {
@@ -172,31 +250,74 @@ func HandleIQ(client *structs.Client, root map[string]interface{}, server *struc
 		}
 
 		sessionXML := fmt.Sprintf(`<iq to="%s" from="%s" id="_xmpp_session1" type="result" xmlns="jabber:client"/>`,
-			client.JID, XMPPDomain)
-		client.Conn.WriteMessage(websocket.TextMessage, []byte(sessionXML))
+			client.JID, server.Domain)
+		Enqueue(client, sessionXML)
 
 	default:
 		if client.AccountID == "" || client.Resource == "" {
 			SendError(client)
 			return
 		}
+
+		if HandleBlocking(ctx, client, id, iqType, root, server) {
+			return
+		}
+		if HandleInvisibility(client, id, iqType, root, server) {
+			return
+		}
+
+		to, _ := root["-to"].(string)
+		if query, ok := root["query"].(map[string]interface{}); ok {
+			switch query["-xmlns"] {
+			case nsDiscoInfo:
+				HandleDiscoInfo(ctx, client, id, to, query, server)
+				return
+			case nsDiscoItems:
+				HandleDiscoItems(client, id, to, query, server)
+				return
+			case nsLast:
+				HandleLastActivity(ctx, client, id, to, server)
+				return
+			}
+		}
+
 		iqXML := fmt.Sprintf(`<iq to="%s" from="%s" id="%s" type="result" xmlns="jabber:client"/>`,
-			client.JID, XMPPDomain, id)
-		client.Conn.WriteMessage(websocket.TextMessage, []byte(iqXML))
+			client.JID, server.Domain, id)
+		Enqueue(client, iqXML)
 	}
 }
 
 func HandlePresence(client *structs.Client, msg map[string]interface{}, server *structs.Server) {
+	presenceType, _ := msg["-type"].(string)
+	ctx, span := startSessionSpan(context.Background(), client, "xmpp.presence",
+		trace.WithAttributes(attribute.String("xmpp.presence.type", presenceType)))
+	defer span.End()
+
+	handlePresence(ctx, client, presenceType, msg, server)
+}
+
+func handlePresence(ctx context.Context, client *structs.Client, presenceType string, msg map[string]interface{}, server *structs.Server) {
 	if !client.ClientExists {
 		SendError(client)
 		return
 	}
 
-	presenceType, _ := msg["@_type"].(string)
+	to, _ := msg["-to"].(string)
+	switch presenceType {
+	case "subscribe", "subscribed", "unsubscribe", "unsubscribed":
+		HandleSubscription(ctx, client, presenceType, to, server)
+		return
+	}
+
 	status, _ := msg["status"].(string)
 
 	show, _ := msg["show"].(string)
 
+	if AccountIDFromJID(to, server.Domain) != "" {
+		HandleDirectedPresence(ctx, client, to, presenceType, show, status, server)
+		return
+	}
+
 	resp := fmt.Sprintf(
 		`<presence from="%s" xmlns="jabber:client"%s>
 			%s
@@ -205,29 +326,161 @@ func HandlePresence(client *structs.Client, msg map[string]interface{}, server *
 		client.JID,
 		func() string {
 			if presenceType != "" {
-				return fmt.Sprintf(` type="%s"`, presenceType)
+				return fmt.Sprintf(` type="%s"`, xmlEscape(presenceType))
 			}
 			return ""
 		}(),
 		func() string {
 			if show != "" {
-				return fmt.Sprintf("<show>%s</show>", show)
+				return fmt.Sprintf("<show>%s</show>", xmlEscape(show))
 			}
 			return ""
 		}(),
-		status,
+		xmlEscape(status),
 	)
 
-	if err := client.Conn.WriteMessage(1, []byte(resp)); err != nil {
-		Logger.Error("Failed to send presence:", err)
+	if err := Enqueue(client, resp); err != nil {
+		Log.Stream.Warn("Failed to send presence", "error", err, "session", client)
 	}
 
-	client.LastPresenceUpdate.Status = status
-	client.LastPresenceUpdate.Away = (show == "away")
-	UpdatePresenceForFriends(server, client, status, client.LastPresenceUpdate.Away, presenceType == "unavailable")
+	HandleCaps(client, msg, server)
+
+	UpdatePresenceForFriends(ctx, server, client, status, show == "away", presenceType == "unavailable")
+
+	if !client.InitialPresence && presenceType == "" {
+		client.InitialPresence = true
+		SendFriendsPresence(ctx, server, client)
+		DeliverPendingSubscriptions(ctx, client, server)
+		RequeueOutbox(ctx, server, client.AccountID)
+	}
+}
+
+func HandleMessage(client *structs.Client, msg map[string]interface{}, server *structs.Server) {
+	if client.JID == "" {
+		SendError(client)
+		return
+	}
+
+	id, _ := msg["-id"].(string)
+	msgType, _ := msg["-type"].(string)
+	ctx, span := startSessionSpan(context.Background(), client, "xmpp.message",
+		trace.WithAttributes(attribute.String("xmpp.message.id", id), attribute.String("xmpp.message.type", msgType)))
+	defer span.End()
+
+	handleMessage(ctx, client, id, msgType, msg, server)
 }
 
-func SendMessage(body interface{}, accountID string, server *structs.Server) error {
+func handleMessage(ctx context.Context, client *structs.Client, id, msgType string, msg map[string]interface{}, server *structs.Server) {
+	to, _ := msg["-to"].(string)
+	body, _ := msg["body"].(string)
+
+	accountID := AccountIDFromJID(to, server.Domain)
+	if accountID == "" || body == "" || msgType == "error" {
+		return
+	}
+
+	if HasBlocked(client, accountID) {
+		errXML := fmt.Sprintf(
+			`<message to="%s" from="%s" id="%s" type="error" xmlns="jabber:client"><error type="cancel"><not-acceptable xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/><blocked xmlns="urn:xmpp:blocking:errors"/></error></message>`,
+			client.JID, to, id,
+		)
+		Enqueue(client, errXML)
+		return
+	}
+
+	// An account has one session across the cluster, so a recipient without
+	// a session here can only be on another node.
+	receivers := server.Clients.ByAccount(accountID)
+	if len(receivers) == 0 {
+		routeMessage(ctx, server, client, to, accountID, id, msgType, body)
+		return
+	}
+
+	for _, receiver := range receivers {
+		if receiver.JID == "" {
+			continue
+		}
+		if strings.Contains(to, "/") && receiver.JID != to {
+			continue
+		}
+		if HasBlocked(receiver, client.AccountID) {
+			return
+		}
+
+		xmlBytes, err := xml.Marshal(structs.Message{
+			From:  client.JID,
+			To:    receiver.JID,
+			ID:    id,
+			Type:  msgType,
+			XMLNS: "jabber:client",
+			Body:  body,
+		})
+		if err != nil {
+			Log.XMPP.Error("Failed to marshal message XML", "error", err, "session", client)
+			return
+		}
+
+		if err := EnqueueContext(ctx, receiver, string(xmlBytes)); err != nil {
+			Log.Stream.Warn("Failed to deliver message", "error", err, "session", receiver)
+			continue
+		}
+		publishSessionEvent(EventMessageDelivered, receiver, map[string]interface{}{"from": client.JID, "type": msgType})
+	}
+}
+
+// partyInviteSender returns the account behind a party invite or ping body, or
+// an empty string for any other message.
+func partyInviteSender(body string) string {
+	var notification map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &notification); err != nil {
+		return ""
+	}
+
+	notificationType, _ := notification["type"].(string)
+	if !strings.Contains(strings.ToLower(notificationType), "party") {
+		return ""
+	}
+
+	fields := []map[string]interface{}{notification}
+	if payload, ok := notification["payload"].(map[string]interface{}); ok {
+		fields = append(fields, payload)
+	}
+	for _, f := range fields {
+		for _, key := range []string{"inviter_id", "pinger_id"} {
+			if id, ok := f[key].(string); ok && id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// SendMessage delivers an admin message to accountID. A recipient that is
+// offline, or that blocked the party member behind an invite, is not an error.
+func SendMessage(ctx context.Context, body interface{}, accountID string, server *structs.Server) error {
+	err := DeliverMessage(ctx, body, accountID, server)
+	if errors.Is(err, ErrClientNotFound) || errors.Is(err, ErrMessageBlocked) {
+		return nil
+	}
+	return err
+}
+
+// DeliverMessage is SendMessage reporting why a message was not delivered. The
+// delivery is traced as a child of the span in ctx, down to the client write.
+func DeliverMessage(ctx context.Context, body interface{}, accountID string, server *structs.Server) (err error) {
+	ctx, span := tracer.Start(ctx, "message.deliver", trace.WithAttributes(attribute.String("xmpp.account.id", accountID)))
+	defer func() {
+		switch {
+		case errors.Is(err, ErrClientNotFound):
+			span.SetAttributes(attribute.String("voryn.delivery.status", "offline"))
+		case errors.Is(err, ErrMessageBlocked):
+			span.SetAttributes(attribute.String("voryn.delivery.status", "blocked"))
+		default:
+			failSpan(span, err)
+		}
+		span.End()
+	}()
+
 	if server == nil {
 		return fmt.Errorf("server is nil")
 	}
@@ -244,22 +497,27 @@ func SendMessage(body interface{}, accountID string, server *structs.Server) err
 		bodyStr = string(bytes)
 	}
 
-	server.ClientsMutex.Lock()
-	defer server.ClientsMutex.Unlock()
-
-	var receiver *structs.Client
-	for _, cl := range server.Clients {
-		if cl.AccountID == accountID {
-			receiver = cl
-			break
-		}
+	err = deliverLocalMessage(ctx, bodyStr, accountID, server)
+	if errors.Is(err, ErrClientNotFound) && cluster != nil {
+		return routeAdminMessage(ctx, server, accountID, bodyStr)
 	}
+	return err
+}
+
+// deliverLocalMessage delivers an admin message to a session held by this
+// node.
+func deliverLocalMessage(ctx context.Context, bodyStr, accountID string, server *structs.Server) error {
+	receiver := server.Clients.FirstByAccount(accountID)
 	if receiver == nil {
-		return nil
+		return ErrClientNotFound
+	}
+
+	if inviterID := partyInviteSender(bodyStr); inviterID != "" && HasBlocked(receiver, inviterID) {
+		return ErrMessageBlocked
 	}
 
 	msg := structs.Message{
-		From:  fmt.Sprintf("xmpp-admin@%s", XMPPDomain),
+		From:  fmt.Sprintf("xmpp-admin@%s", server.Domain),
 		To:    receiver.JID,
 		XMLNS: "jabber:client",
 		Body:  bodyStr,
@@ -273,9 +531,10 @@ func SendMessage(body interface{}, accountID string, server *structs.Server) err
 	xmlStr := string(xmlBytes)
 	xmlStr = strings.Replace(xmlStr, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>", "", 1)
 
-	if err := receiver.Conn.WriteMessage(1, []byte(xmlStr)); err != nil {
+	if err := EnqueueContext(ctx, receiver, xmlStr); err != nil {
 		return fmt.Errorf("failed to send message: %w", err)
 	}
+	publishSessionEvent(EventMessageDelivered, receiver, map[string]interface{}{"from": msg.From})
 
 	return nil
 }
@@ -285,29 +544,27 @@ func SendPresence(fromID, toID string, offline bool, server *structs.Server) err
 		return fmt.Errorf("server is nil")
 	}
 
-	server.ClientsMutex.Lock()
-	defer server.ClientsMutex.Unlock()
+	sender := server.Clients.FirstByAccount(fromID)
+	receiver := server.Clients.FirstByAccount(toID)
+	if sender == nil || receiver == nil {
+		return nil
+	}
 
-	var sender, receiver *structs.Client
-	for _, cl := range server.Clients {
-		if cl.AccountID == fromID {
-			sender = cl
-		}
-		if cl.AccountID == toID {
-			receiver = cl
-		}
+	if !offline && IsBlockedBetween(sender, receiver) {
+		return nil
 	}
 
-	if sender == nil || receiver == nil {
+	if !offline && sender.Invisible && !HasDirectedPresence(sender, receiver.JID) {
 		return nil
 	}
 
+	last := LastPresence(sender)
 	presence := structs.Presence{
 		To:     receiver.JID,
 		From:   sender.JID,
 		XMLNS:  "jabber:client",
 		Type:   "",
-		Status: sender.LastPresenceUpdate.Status,
+		Status: last.Status,
 	}
 
 	if offline {
@@ -316,7 +573,7 @@ func SendPresence(fromID, toID string, offline bool, server *structs.Server) err
 		presence.Type = "available"
 	}
 
-	if sender.LastPresenceUpdate.Away {
+	if last.Away {
 		presence.Show = "away"
 	}
 
@@ -328,7 +585,7 @@ func SendPresence(fromID, toID string, offline bool, server *structs.Server) err
 	xmlStr := string(xmlBytes)
 	xmlStr = strings.Replace(xmlStr, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>", "", 1)
 
-	if err := receiver.Conn.WriteMessage(1, []byte(xmlStr)); err != nil {
+	if err := Enqueue(receiver, xmlStr); err != nil {
 		return fmt.Errorf("failed to send presence: %w", err)
 	}
 
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	outboxPollInterval = 2 * time.Second
+	outboxLease        = 30 * time.Second
+	outboxMaxAttempts  = 10
+	outboxBaseBackoff  = 5 * time.Second
+	outboxMaxBackoff   = 10 * time.Minute
+)
+
+// StartOutbox consumes the server's outbox store. New messages are picked up
+// as soon as the store reports them when it can, and by polling otherwise.
+//
+// Each message is leased before delivery and only marked once it is queued for
+// the client, so a crash mid-delivery leads to a redelivery rather than a lost
+// message. Messages for offline accounts are marked queued and retried when
+// the account next sends its initial presence. Deliveries that fail for a
+// passing reason, such as a full client queue or an unreachable node, are
+// retried with backoff; only bad bodies and messages out of attempts fail.
+func StartOutbox(server *structs.Server) {
+	server.OutboxWake = make(chan struct{}, 1)
+
+	go watchOutbox(server)
+	go consumeOutbox(server)
+}
+
+// RequeueOutbox makes the queued outbox messages of accountID pending again.
+func RequeueOutbox(ctx context.Context, server *structs.Server, accountID string) {
+	if server.OutboxWake == nil {
+		return
+	}
+
+	n, err := server.Store.Outbox.Requeue(ctx, accountID)
+	if err != nil {
+		Log.Outbox.Error("Failed to requeue outbox messages", "accountId", accountID, "error", err)
+		return
+	}
+	if n > 0 {
+		wakeOutbox(server)
+	}
+}
+
+func wakeOutbox(server *structs.Server) {
+	select {
+	case server.OutboxWake <- struct{}{}:
+	default:
+	}
+}
+
+func watchOutbox(server *structs.Server) {
+	inserted, err := server.Store.Outbox.Watch()
+	if err != nil {
+		Log.Outbox.Warn("Change streams unavailable, polling xmpp_outbox instead", "domain", server.Domain, "error", err)
+		return
+	}
+
+	for range inserted {
+		wakeOutbox(server)
+	}
+	Log.Outbox.Warn("xmpp_outbox change stream ended, polling instead", "domain", server.Domain)
+}
+
+func consumeOutbox(server *structs.Server) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	// Once the server is draining or shutting down, messages stay in the
+	// outbox for the next process rather than failing against closing
+	// sessions.
+	for !Draining() && !ShuttingDown() {
+		for !Draining() && !ShuttingDown() {
+			msg, err := server.Store.Outbox.Claim(context.Background(), outboxLease)
+			if err != nil {
+				if !errors.Is(err, storage.ErrNotFound) {
+					Log.Outbox.Error("Failed to read xmpp_outbox", "domain", server.Domain, "error", err)
+				}
+				break
+			}
+			deliverOutboxMessage(context.Background(), server, msg)
+		}
+
+		select {
+		case <-server.OutboxWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func deliverOutboxMessage(ctx context.Context, server *structs.Server, msg *models.OutboxMessage) {
+	store := server.Store.Outbox
+
+	// The unique index already rejects most duplicates; this covers databases
+	// where it could not be created.
+	if msg.IdempotencyKey != "" {
+		if dup, err := store.HasEarlierDuplicate(ctx, msg); err != nil {
+			Log.Outbox.Error("Failed to check outbox idempotency key", "id", msg.ID.Hex(), "error", err)
+			return
+		} else if dup {
+			setOutboxStatus(ctx, store, msg, models.OutboxDuplicate, "duplicate idempotency key")
+			return
+		}
+	}
+
+	body, err := outboxBody(msg.Body)
+	if err != nil {
+		setOutboxStatus(ctx, store, msg, models.OutboxFailed, err.Error())
+		return
+	}
+
+	err = DeliverMessage(ctx, body, msg.AccountID, server)
+	switch {
+	case err == nil:
+		setOutboxStatus(ctx, store, msg, models.OutboxDelivered, "")
+	case errors.Is(err, ErrClientNotFound):
+		setOutboxStatus(ctx, store, msg, models.OutboxQueued, "")
+	case errors.Is(err, ErrMessageBlocked):
+		setOutboxStatus(ctx, store, msg, models.OutboxFailed, err.Error())
+	case msg.Attempts >= outboxMaxAttempts:
+		setOutboxStatus(ctx, store, msg, models.OutboxFailed, fmt.Sprintf("giving up after %d attempts: %v", msg.Attempts, err))
+	default:
+		next := time.Now().Add(outboxBackoff(msg.Attempts))
+		if err := store.Retry(ctx, msg.ID, err.Error(), next); err != nil {
+			Log.Outbox.Error("Failed to reschedule outbox message", "id", msg.ID.Hex(), "error", err)
+		}
+	}
+}
+
+// outboxBackoff is the wait before a message's next attempt, doubling with
+// each failed one.
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= outboxMaxBackoff {
+			return outboxMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// outboxBody returns the message body as DeliverMessage expects it: strings as
+// they are and documents as JSON.
+func outboxBody(raw bson.RawValue) (string, error) {
+	switch raw.Type {
+	case bson.TypeString:
+		return raw.StringValue(), nil
+	case bson.TypeEmbeddedDocument:
+		data, err := bson.MarshalExtJSON(raw.Document(), false, false)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode body: %w", err)
+		}
+		return string(data), nil
+	}
+	return "", fmt.Errorf("body must be a string or document")
+}
+
+func setOutboxStatus(ctx context.Context, store storage.OutboxStore, msg *models.OutboxMessage, status, reason string) {
+	if err := store.SetStatus(ctx, msg.ID, status, reason); err != nil {
+		Log.Outbox.Error("Failed to update outbox message", "id", msg.ID.Hex(), "status", status, "error", err)
+	}
+}
@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+const nsInvisible = "urn:xmpp:invisible:0"
+
+// HandleDirectedPresence delivers a presence addressed to one user instead of
+// broadcasting it, to its sessions on this node and on others. Directed
+// presence still goes out while the sender is invisible, which is how a player
+// appears online to specific friends only.
+func HandleDirectedPresence(ctx context.Context, client *structs.Client, to, presenceType, show, status string, server *structs.Server) {
+	accountID := AccountIDFromJID(to, server.Domain)
+	if accountID == "" || accountID == client.AccountID || HasBlocked(client, accountID) {
+		return
+	}
+
+	typeAttr := ""
+	if presenceType != "" {
+		typeAttr = fmt.Sprintf(` type="%s"`, xmlEscape(presenceType))
+	}
+	showXML := ""
+	if show != "" {
+		showXML = fmt.Sprintf("<show>%s</show>", xmlEscape(show))
+	}
+	presence := func(jid string) string {
+		return fmt.Sprintf(`<presence from="%s" to="%s" xmlns="jabber:client"%s>%s<status>%s</status></presence>`,
+			xmlEscape(client.JID), xmlEscape(jid), typeAttr, showXML, xmlEscape(status))
+	}
+	addressed := func(jid string) bool {
+		return !strings.Contains(to, "/") || jid == to
+	}
+
+	for _, receiver := range server.Clients.ByAccount(accountID) {
+		if receiver.JID == "" || !addressed(receiver.JID) {
+			continue
+		}
+		if HasBlocked(receiver, client.AccountID) {
+			return
+		}
+		setDirectedPresence(client, receiver.JID, presenceType != "unavailable")
+		Enqueue(receiver, presence(receiver.JID))
+	}
+
+	// Sessions on other nodes that blocked the sender refuse the route.
+	for _, entry := range remoteSessions(ctx, server, accountID) {
+		if !addressed(entry.JID) {
+			continue
+		}
+		setDirectedPresence(client, entry.JID, presenceType != "unavailable")
+		sendRoute(ctx, peerNodes(server)[entry.NodeID], ClusterRoute{
+			Domain:      server.Domain,
+			Kind:        routeKindStanza,
+			JID:         entry.JID,
+			Stanza:      presence(entry.JID),
+			FromAccount: client.AccountID,
+			FromJID:     client.JID,
+		})
+	}
+}
+
+func setDirectedPresence(client *structs.Client, jid string, available bool) {
+	client.DirectedMutex.Lock()
+	defer client.DirectedMutex.Unlock()
+
+	if !available {
+		delete(client.DirectedPresence, jid)
+		return
+	}
+	if client.DirectedPresence == nil {
+		client.DirectedPresence = map[string]bool{}
+	}
+	client.DirectedPresence[jid] = true
+}
+
+// HandleInvisibility answers XEP-0186 invisible/visible commands. It reports
+// false when root is not one.
+func HandleInvisibility(client *structs.Client, id, iqType string, root map[string]interface{}, server *structs.Server) bool {
+	for _, command := range []string{"invisible", "visible"} {
+		node, ok := root[command].(map[string]interface{})
+		if !ok || node["-xmlns"] != nsInvisible {
+			continue
+		}
+
+		if iqType != "set" {
+			SendIQError(client, id, server.Domain, "modify", "bad-request")
+			return true
+		}
+
+		sendIQResult(client, id)
+		SetInvisible(client, command == "invisible", server)
+		return true
+	}
+	return false
+}
+
+// SetInvisible switches the client in or out of invisible mode. Going
+// invisible shows the client as unavailable to every friend it has not sent
+// directed presence to, on this node and on others; going visible broadcasts
+// its last presence again.
+func SetInvisible(client *structs.Client, invisible bool, server *structs.Server) {
+	if client.Invisible == invisible {
+		return
+	}
+	ctx := context.Background()
+
+	if !invisible {
+		client.Invisible = false
+		presence := LastPresence(client)
+		UpdatePresenceForFriends(ctx, server, client, presence.Status, presence.Away, false)
+		return
+	}
+
+	client.Invisible = true
+
+	routePresence(ctx, server, client, "{}", false, true, directedTargets(client))
+	fanOutPresence(ctx, server, client.AccountID, client.JID, "{}", false, true,
+		func(c *structs.Client) bool { return HasBlocked(client, c.AccountID) || HasDirectedPresence(client, c.JID) })
+}
+
+// directedTargets returns the JIDs client has sent directed presence to.
+func directedTargets(client *structs.Client) []string {
+	client.DirectedMutex.Lock()
+	defer client.DirectedMutex.Unlock()
+
+	jids := make([]string, 0, len(client.DirectedPresence))
+	for jid := range client.DirectedPresence {
+		jids = append(jids, jid)
+	}
+	return jids
+}
+
+// HasDirectedPresence reports whether client has sent directed presence to jid.
+func HasDirectedPresence(client *structs.Client, jid string) bool {
+	client.DirectedMutex.Lock()
+	defer client.DirectedMutex.Unlock()
+	return client.DirectedPresence[jid]
+}
+
+// canSeePresence reports whether viewer may learn about target's session: it
+// is viewer's own, or target is an accepted friend, neither blocked the other
+// and target isn't invisible to viewer.
+func canSeePresence(ctx context.Context, viewer, target *structs.Client, server *structs.Server) bool {
+	if viewer.AccountID == target.AccountID {
+		return true
+	}
+	if IsBlockedBetween(viewer, target) {
+		return false
+	}
+	if target.Invisible && !HasDirectedPresence(target, viewer.JID) {
+		return false
+	}
+
+	friends, err := server.Store.Friends.GetFriends(ctx, viewer.AccountID)
+	if err != nil {
+		Log.MongoDB.Error("Failed to load friends", "error", err, "session", viewer)
+		return false
+	}
+	return hasFriendEntry(friends.List.Accepted, target.AccountID)
+}
+
+// sendDirectedUnavailable tells everyone client sent directed presence to that
+// it went offline, on this node and on others.
+func sendDirectedUnavailable(ctx context.Context, client *structs.Client, server *structs.Server) {
+	client.DirectedMutex.Lock()
+	targets := client.DirectedPresence
+	client.DirectedPresence = nil
+	client.DirectedMutex.Unlock()
+
+	if len(targets) == 0 {
+		return
+	}
+
+	unavailable := func(jid string) string {
+		return fmt.Sprintf(`<presence from="%s" to="%s" type="unavailable" xmlns="jabber:client"/>`,
+			xmlEscape(client.JID), xmlEscape(jid))
+	}
+	for jid := range targets {
+		if c := server.Clients.ByJID(jid); c != nil {
+			Enqueue(c, unavailable(c.JID))
+			continue
+		}
+		for _, entry := range remoteSessions(ctx, server, AccountIDFromJID(jid, server.Domain)) {
+			if entry.JID != jid {
+				continue
+			}
+			sendRoute(ctx, peerNodes(server)[entry.NodeID], ClusterRoute{
+				Domain:      server.Domain,
+				Kind:        routeKindStanza,
+				JID:         entry.JID,
+				Stanza:      unavailable(entry.JID),
+				FromAccount: client.AccountID,
+				FromJID:     client.JID,
+			})
+		}
+	}
+}
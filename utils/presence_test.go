@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+func TestPresenceStatusIsEscaped(t *testing.T) {
+	store := storage.NewMemory(storage.Seed{Friends: []models.Friends{
+		{AccountID: "alice", List: models.FriendList{Accepted: []models.FriendEntry{{AccountID: "bob"}, {AccountID: "carol"}}}},
+		{AccountID: "bob", List: models.FriendList{Accepted: []models.FriendEntry{{AccountID: "alice"}}}},
+		{AccountID: "carol", List: models.FriendList{Accepted: []models.FriendEntry{{AccountID: "alice"}}}},
+	}})
+	a, b := startTestCluster(t, store)
+	alice := addTestSession(t, a, "", "alice")
+	bob := addTestSession(t, a, "", "bob")
+	carol := addTestSession(t, b, "b", "carol")
+
+	spoof := `</status><message to="bob@` + testDomain + `" from="admin@` + testDomain + `"><body>spoofed</body></message><status>`
+	setLastPresence(carol, structs.PresenceUpdate{Status: spoof})
+
+	HandlePresence(alice, map[string]interface{}{"status": spoof, "show": `away"/><message/><show>`}, a)
+
+	check := func(name, frame string) {
+		t.Helper()
+		if strings.Contains(frame, "<message") {
+			t.Errorf("%s was sent a raw status: %s", name, frame)
+		}
+	}
+	check("alice", receive(t, alice, "<presence", `from="`+alice.JID+`"`))
+	check("bob", receive(t, bob, "<presence", `from="`+alice.JID+`"`))
+	check("carol", receive(t, carol, "<presence", `from="`+alice.JID+`"`))
+	// Carol's status reaches alice through the probe of her node.
+	check("alice", receive(t, alice, "<presence", `from="`+carol.JID+`"`))
+}
+
+func TestInvisiblePresenceReachesOtherNodes(t *testing.T) {
+	store := storage.NewMemory(storage.Seed{Friends: []models.Friends{
+		{AccountID: "alice", List: models.FriendList{Accepted: []models.FriendEntry{{AccountID: "bob"}, {AccountID: "carol"}}}},
+		{AccountID: "bob", List: models.FriendList{Accepted: []models.FriendEntry{{AccountID: "alice"}}}},
+		{AccountID: "carol", List: models.FriendList{Accepted: []models.FriendEntry{{AccountID: "alice"}}}},
+	}})
+	a, b := startTestCluster(t, store)
+	alice := addTestSession(t, a, "", "alice")
+	bob := addTestSession(t, b, "b", "bob")
+	carol := addTestSession(t, b, "b", "carol")
+	ctx := context.Background()
+
+	HandleDirectedPresence(ctx, alice, "bob@"+testDomain, "", "", "just bob", a)
+	receive(t, bob, "<presence", `from="`+alice.JID+`"`, "<status>just bob</status>")
+
+	// Going invisible hides alice from carol but not from bob, whom she sent
+	// directed presence to.
+	SetInvisible(alice, true, a)
+	receive(t, carol, `from="`+alice.JID+`"`, `type="unavailable"`)
+	for _, frame := range sent(bob) {
+		if strings.Contains(frame, "unavailable") {
+			t.Errorf("bob saw alice go invisible: %s", frame)
+		}
+	}
+
+	UpdatePresenceForFriends(ctx, a, alice, "{}", false, true)
+	receive(t, bob, `from="`+alice.JID+`"`, `type="unavailable"`)
+}
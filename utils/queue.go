@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/structs"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	ErrQueueFull    = errors.New("outbound queue is full")
+	ErrClientClosed = errors.New("client connection is closed")
+)
+
+// StartWriter gives the client its outbound queue and the goroutine that owns
+// writes to its socket. Every stanza for a client goes through Enqueue so that
+// concurrent senders never write to the same websocket at once.
+func StartWriter(client *structs.Client) {
+	client.Outbound = make(chan structs.Frame, CurrentConfig().Limits.OutboundQueue)
+	client.Done = make(chan struct{})
+	liveClients.Store(client, struct{}{})
+	liveWriters.Add(1)
+	tapSession(client)
+	go writeLoop(client)
+}
+
+func writeLoop(client *structs.Client) {
+	defer func() {
+		liveClients.Delete(client)
+		liveWriters.Done()
+		untapSession(client)
+	}()
+
+	for {
+		select {
+		case frame := <-client.Outbound:
+			if err := writeFrame(client, frame); err != nil {
+				Log.Stream.Warn("Failed to write to client", "error", err, "session", client)
+				_ = client.Conn.Close()
+				return
+			}
+		case <-client.Done:
+			for {
+				select {
+				case frame := <-client.Outbound:
+					if err := writeFrame(client, frame); err != nil {
+						_ = client.Conn.Close()
+						return
+					}
+				default:
+					_ = client.Conn.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func writeFrame(client *structs.Client, frame structs.Frame) (err error) {
+	if frame.Span.IsValid() {
+		span := startWriteSpan(client, frame)
+		defer func() {
+			failSpan(span, err)
+			span.End()
+		}()
+	}
+
+	client.Conn.SetWriteDeadline(time.Now().Add(CurrentConfig().Timeouts.Write))
+	if err := client.Conn.WriteMessage(websocket.TextMessage, frame.Data); err != nil {
+		return err
+	}
+	countStanzaOut(frame.Data)
+	captureFrame(client, "out", frame.Data)
+	return nil
+}
+
+// Enqueue queues data for the client's writer. It never blocks: a full queue
+// drops the stanza and reports ErrQueueFull.
+func Enqueue(client *structs.Client, data string) error {
+	return enqueue(client, structs.Frame{Data: []byte(data)})
+}
+
+// EnqueueContext is Enqueue for a stanza sent on behalf of the span in ctx, so
+// that its write to the socket shows up in the same trace.
+func EnqueueContext(ctx context.Context, client *structs.Client, data string) error {
+	frame := structs.Frame{Data: []byte(data)}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsSampled() {
+		frame.Span = sc
+		frame.Queued = time.Now()
+	}
+	return enqueue(client, frame)
+}
+
+func enqueue(client *structs.Client, frame structs.Frame) error {
+	sm := &client.SM
+	sm.Mutex.Lock()
+	defer sm.Mutex.Unlock()
+
+	if sm.Resumed {
+		if sm.Successor != nil {
+			return enqueue(sm.Successor, frame)
+		}
+		return ErrClientClosed
+	}
+	if !sm.Enabled {
+		return send(client, frame)
+	}
+
+	stanza := isStanza(frame.Data)
+	if sm.Detached {
+		if !stanza {
+			return ErrClientClosed
+		}
+		if len(sm.Unacked) >= CurrentConfig().Limits.OutboundQueue {
+			Log.Stream.Warn("Outbound queue full", "session", client)
+			return ErrQueueFull
+		}
+		trackStanza(client, frame.Data)
+		return nil
+	}
+
+	if err := send(client, frame); err != nil || !stanza {
+		return err
+	}
+	trackStanza(client, frame.Data)
+	return nil
+}
+
+// send puts frame on the client's outbound queue.
+func send(client *structs.Client, frame structs.Frame) error {
+	if client.Outbound == nil {
+		return ErrClientClosed
+	}
+
+	select {
+	case <-client.Done:
+		return ErrClientClosed
+	default:
+	}
+
+	select {
+	case client.Outbound <- frame:
+		return nil
+	default:
+		Log.Stream.Warn("Outbound queue full", "session", client)
+		return ErrQueueFull
+	}
+}
+
+// CloseClient stops the client's writer once the stanzas already queued have
+// been flushed, then closes the socket.
+func CloseClient(client *structs.Client) {
+	if client.Done == nil {
+		if client.Conn != nil {
+			_ = client.Conn.Close()
+		}
+		return
+	}
+	client.CloseOnce.Do(func() { close(client.Done) })
+}
+
+// QueueDepth returns how many stanzas are waiting to be written to the client.
+func QueueDepth(client *structs.Client) int {
+	return len(client.Outbound)
+}
@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+const (
+	defaultSessionLimit = 100
+	maxSessionLimit     = 1000
+)
+
+// SessionInfo is the admin view of one connected session.
+type SessionInfo struct {
+	ID              string      `json:"id"`
+	AccountID       string      `json:"accountId"`
+	DisplayName     string      `json:"displayName"`
+	JID             string      `json:"jid"`
+	Resource        string      `json:"resource"`
+	App             string      `json:"app"`
+	Platform        string      `json:"platform"`
+	Build           string      `json:"build"`
+	RemoteAddr      string      `json:"remoteAddr"`
+	ConnectedAt     time.Time   `json:"connectedAt"`
+	AuthenticatedAt *time.Time  `json:"authenticatedAt,omitempty"`
+	Authenticated   bool        `json:"authenticated"`
+	LastPresence    interface{} `json:"lastPresence"`
+	Away            bool        `json:"away"`
+	AutoAway        bool        `json:"autoAway"`
+	Invisible       bool        `json:"invisible"`
+	PartyID         string      `json:"partyId,omitempty"`
+	QueueDepth      int         `json:"queueDepth"`
+}
+
+// SessionQuery filters, sorts and pages the session list. Empty filters match
+// everything; Authenticated and Away are tri-state.
+type SessionQuery struct {
+	Platform      string
+	PartyID       string
+	DisplayName   string
+	Authenticated *bool
+	Away          *bool
+	Sort          string
+	Desc          bool
+	Limit         int
+	Cursor        string
+}
+
+type SessionPage struct {
+	Sessions   []SessionInfo `json:"sessions"`
+	Total      int           `json:"total"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+type sessionCursor struct {
+	Key string `json:"k"`
+	ID  string `json:"id"`
+}
+
+func NewSessionInfo(client *structs.Client) SessionInfo {
+	resource := ParseResource(client.Resource)
+	presence := LastPresence(client)
+	_, autoAway := lastActivity(client)
+
+	info := SessionInfo{
+		ID:            client.ID,
+		AccountID:     client.AccountID,
+		DisplayName:   client.DisplayName,
+		JID:           client.JID,
+		Resource:      client.Resource,
+		App:           resource.App,
+		Platform:      resource.Platform,
+		Build:         resource.Build,
+		RemoteAddr:    client.RemoteAddr,
+		ConnectedAt:   client.ConnectedAt,
+		Authenticated: client.Authenticated,
+		Away:          presence.Away,
+		AutoAway:      autoAway,
+		Invisible:     client.Invisible,
+		PartyID:       GetPartyID(client),
+		QueueDepth:    QueueDepth(client),
+	}
+
+	if !client.AuthenticatedAt.IsZero() {
+		authenticatedAt := client.AuthenticatedAt
+		info.AuthenticatedAt = &authenticatedAt
+	}
+
+	var status interface{}
+	if err := json.Unmarshal([]byte(presence.Status), &status); err == nil {
+		info.LastPresence = status
+	} else if presence.Status != "" {
+		info.LastPresence = presence.Status
+	}
+
+	return info
+}
+
+// GetAccountSessions returns every session of accountID.
+func GetAccountSessions(server *structs.Server, accountID string) []SessionInfo {
+	sessions := []SessionInfo{}
+	for _, c := range server.Clients.ByAccount(accountID) {
+		sessions = append(sessions, NewSessionInfo(c))
+	}
+	return sessions
+}
+
+// ListSessions returns one page of sessions matching query. Pages are keyed on
+// the sort value and session ID, so sessions connecting or leaving between
+// requests don't shift the rest of the listing.
+func ListSessions(server *structs.Server, query SessionQuery) (SessionPage, error) {
+	sortKey, err := sessionSortKey(query.Sort)
+	if err != nil {
+		return SessionPage{}, err
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultSessionLimit
+	}
+	if limit > maxSessionLimit {
+		limit = maxSessionLimit
+	}
+
+	var after *sessionCursor
+	if query.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+		if err != nil {
+			return SessionPage{}, fmt.Errorf("invalid cursor")
+		}
+		after = &sessionCursor{}
+		if err := json.Unmarshal(raw, after); err != nil {
+			return SessionPage{}, fmt.Errorf("invalid cursor")
+		}
+	}
+
+	clients := server.Clients.Snapshot()
+	sessions := make([]SessionInfo, 0, len(clients))
+	for _, c := range clients {
+		sessions = append(sessions, NewSessionInfo(c))
+	}
+
+	matched := sessions[:0]
+	for _, s := range sessions {
+		if query.Platform != "" && !strings.EqualFold(s.Platform, query.Platform) {
+			continue
+		}
+		if query.PartyID != "" && s.PartyID != query.PartyID {
+			continue
+		}
+		if query.DisplayName != "" && !strings.HasPrefix(strings.ToLower(s.DisplayName), strings.ToLower(query.DisplayName)) {
+			continue
+		}
+		if query.Authenticated != nil && s.Authenticated != *query.Authenticated {
+			continue
+		}
+		if query.Away != nil && s.Away != *query.Away {
+			continue
+		}
+		matched = append(matched, s)
+	}
+
+	less := func(a, b sessionCursor) bool {
+		if query.Desc {
+			a, b = b, a
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.ID < b.ID
+	}
+	cursorOf := func(s SessionInfo) sessionCursor {
+		return sessionCursor{Key: sortKey(s), ID: s.ID}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return less(cursorOf(matched[i]), cursorOf(matched[j]))
+	})
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(matched), func(i int) bool {
+			return less(*after, cursorOf(matched[i]))
+		})
+	}
+
+	end := start + limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	page := SessionPage{
+		Sessions: matched[start:end],
+		Total:    len(matched),
+	}
+	if end < len(matched) {
+		raw, _ := json.Marshal(cursorOf(matched[end-1]))
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	return page, nil
+}
+
+// sessionSortKey returns a function mapping a session to a string that sorts
+// the same way as the requested field.
+func sessionSortKey(field string) (func(SessionInfo) string, error) {
+	const timeKey = "2006-01-02T15:04:05.000000000"
+
+	switch field {
+	case "", "connectedAt":
+		return func(s SessionInfo) string { return s.ConnectedAt.UTC().Format(timeKey) }, nil
+	case "authenticatedAt":
+		return func(s SessionInfo) string {
+			if s.AuthenticatedAt == nil {
+				return ""
+			}
+			return s.AuthenticatedAt.UTC().Format(timeKey)
+		}, nil
+	case "displayName":
+		return func(s SessionInfo) string { return strings.ToLower(s.DisplayName) }, nil
+	case "accountId":
+		return func(s SessionInfo) string { return s.AccountID }, nil
+	case "queueDepth":
+		return func(s SessionInfo) string { return fmt.Sprintf("%010d", s.QueueDepth) }, nil
+	}
+	return nil, fmt.Errorf("unknown sort field %q", field)
+}
@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+// drainTick is how often DrainSessions closes its next batch of sessions.
+const drainTick = 100 * time.Millisecond
+
+var (
+	shuttingDown atomic.Bool
+	draining     atomic.Bool
+
+	// liveClients holds every connection whose writer is running, including
+	// those that haven't opened a stream yet; liveWriters counts them.
+	liveClients sync.Map
+	liveWriters sync.WaitGroup
+)
+
+// ShuttingDown reports whether CloseSessions has been called.
+func ShuttingDown() bool {
+	return shuttingDown.Load()
+}
+
+// Draining reports whether DrainSessions has been called, i.e. the listener
+// was handed to another process.
+func Draining() bool {
+	return draining.Load()
+}
+
+// DrainSessions closes the open connections with a system-shutdown stream
+// error at an even pace, so that the last one closes at ctx's deadline and
+// their clients reconnect to the process that took over the listener a few at
+// a time. It returns when every writer is done or ctx ends; connections left
+// open are for CloseSessions.
+func DrainSessions(ctx context.Context) {
+	draining.Store(true)
+
+	var clients []*structs.Client
+	liveClients.Range(func(key, _ any) bool {
+		clients = append(clients, key.(*structs.Client))
+		return true
+	})
+
+	deadline, ok := ctx.Deadline()
+	window := time.Until(deadline)
+	if !ok || window <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(drainTick)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for closed := 0; closed < len(clients); {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		due := int(int64(len(clients))*int64(time.Since(start))/int64(window)) + 1
+		for ; closed < len(clients) && closed < due; closed++ {
+			SendStreamError(clients[closed], "system-shutdown", "")
+		}
+	}
+	_ = Wait(ctx, &liveWriters)
+}
+
+// CloseSessions starts shutting down: every connection is sent a
+// system-shutdown stream error and closed once the stanzas already queued for
+// it are written. It returns when all writers are done, or when ctx ends, in
+// which case the remaining sockets are closed without waiting.
+func CloseSessions(ctx context.Context) error {
+	shuttingDown.Store(true)
+
+	liveClients.Range(func(key, _ any) bool {
+		SendStreamError(key.(*structs.Client), "system-shutdown", "")
+		return true
+	})
+
+	if err := Wait(ctx, &liveWriters); err != nil {
+		liveClients.Range(func(key, _ any) bool {
+			_ = key.(*structs.Client).Conn.Close()
+			return true
+		})
+		return err
+	}
+	return nil
+}
+
+// LeaveCluster removes this node and its sessions from every host's session
+// directory, so other nodes stop routing to it before its heartbeat expires.
+// A process that handed its listener over stays, as the new process runs
+// under the same node ID.
+func LeaveCluster(hosts *Hosts) {
+	if cluster == nil || Draining() {
+		return
+	}
+	for _, server := range hosts.List {
+		if err := server.Store.Sessions.ReleaseNode(context.Background(), cluster.nodeID); err != nil {
+			Log.Cluster.Error("Failed to leave the cluster", "domain", server.Domain, "error", err)
+		}
+	}
+}
+
+// Wait waits for wg until ctx ends.
+func Wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,470 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+const (
+	smNamespace = "urn:xmpp:sm:3"
+
+	// smRequestEvery is how many unacknowledged stanzas a resumable session
+	// is sent before the server asks the client for an ack.
+	smRequestEvery = 10
+)
+
+var (
+	errNotResumable = errors.New("no detached session with that id")
+	errAckTooHigh   = errors.New("acknowledged more stanzas than were sent")
+
+	// resumable maps the resumption ID of every detached session to it.
+	resumable sync.Map
+)
+
+type detachedSession struct {
+	server *structs.Server
+	client *structs.Client
+}
+
+// resumeState is what a new connection takes over from a detached session.
+// It is sent as JSON when the session was detached by the process that
+// handed its listener over.
+type resumeState struct {
+	ID               string                 `json:"id"`
+	JID              string                 `json:"jid"`
+	Resource         string                 `json:"resource"`
+	Presence         structs.PresenceUpdate `json:"presence"`
+	AutoAway         bool                   `json:"autoAway"`
+	Caps             structs.Caps           `json:"caps"`
+	InitialPresence  bool                   `json:"initialPresence"`
+	Invisible        bool                   `json:"invisible"`
+	DirectedPresence map[string]bool        `json:"directedPresence,omitempty"`
+	Inbound          uint32                 `json:"inbound"`
+	Acked            uint32                 `json:"acked"`
+	Unacked          [][]byte               `json:"unacked,omitempty"`
+}
+
+// HandleEnable turns on XEP-0198 stream management for a bound session. With
+// resume="true", and timeouts.resume set, the session can be resumed after
+// its connection drops.
+func HandleEnable(client *structs.Client, node map[string]interface{}) {
+	if node["-xmlns"] != smNamespace {
+		return
+	}
+	if client.JID == "" {
+		sendSMFailed(client, "unexpected-request")
+		return
+	}
+
+	timeout := CurrentConfig().Timeouts.Resume
+	resume := node["-resume"] == "true" || node["-resume"] == "1"
+
+	sm := &client.SM
+	sm.Mutex.Lock()
+	defer sm.Mutex.Unlock()
+	if sm.Enabled {
+		_ = send(client, structs.Frame{Data: smFailed("unexpected-request")})
+		return
+	}
+
+	sm.Enabled = true
+	enabled := fmt.Sprintf(`<enabled xmlns="%s"/>`, smNamespace)
+	if resume && timeout > 0 {
+		sm.ID = newResumptionID()
+		enabled = fmt.Sprintf(`<enabled xmlns="%s" id="%s" resume="true" max="%d"/>`,
+			smNamespace, sm.ID, int(timeout.Seconds()))
+	}
+	_ = send(client, structs.Frame{Data: []byte(enabled)})
+}
+
+// HandleAckRequest answers an <r/> with the number of stanzas handled.
+func HandleAckRequest(client *structs.Client, node map[string]interface{}) {
+	if node["-xmlns"] != smNamespace {
+		return
+	}
+
+	sm := &client.SM
+	sm.Mutex.Lock()
+	enabled, h := sm.Enabled, sm.Inbound
+	sm.Mutex.Unlock()
+
+	if !enabled {
+		sendSMFailed(client, "unexpected-request")
+		return
+	}
+	Enqueue(client, fmt.Sprintf(`<a xmlns="%s" h="%d"/>`, smNamespace, h))
+}
+
+// HandleAck drops the stanzas the client acknowledged with an <a/>.
+func HandleAck(client *structs.Client, node map[string]interface{}) {
+	if node["-xmlns"] != smNamespace {
+		return
+	}
+	h, err := parseHandled(node)
+	if err != nil {
+		Log.Stream.Warn("Invalid ack", "error", err, "session", client)
+		return
+	}
+
+	sm := &client.SM
+	sm.Mutex.Lock()
+	err = ackStanzas(sm, h)
+	sm.Mutex.Unlock()
+
+	if err != nil {
+		Log.Stream.Warn("Invalid ack", "error", err, "h", h, "session", client)
+		SendStreamError(client, "undefined-condition", "Acknowledged more stanzas than were sent")
+	}
+}
+
+// StanzaHandled counts a stanza received from the client for its acks.
+func StanzaHandled(client *structs.Client) {
+	sm := &client.SM
+	sm.Mutex.Lock()
+	if sm.Enabled {
+		sm.Inbound++
+	}
+	sm.Mutex.Unlock()
+}
+
+// HandleResume resumes a detached session of the authenticated account on
+// the client's connection, in place of binding a new one. Sessions detached
+// by the process that handed its listener over are taken from it.
+func HandleResume(client *structs.Client, node map[string]interface{}, server *structs.Server) {
+	if node["-xmlns"] != smNamespace {
+		return
+	}
+	ctx, span := startSessionSpan(context.Background(), client, "xmpp.resume")
+	defer span.End()
+
+	previd, _ := node["-previd"].(string)
+	h, err := parseHandled(node)
+	if !client.Authenticated || client.JID != "" || previd == "" || err != nil {
+		sendSMFailed(client, "unexpected-request")
+		return
+	}
+
+	remote := false
+	state, err := takeSession(previd, server.Domain, client.AccountID, h, client)
+	if errors.Is(err, errNotResumable) && resumeFromPrevious() {
+		remote = true
+		state, err = takeFromPrevious(takeoverRequest{ID: previd, Domain: server.Domain, AccountID: client.AccountID, H: h})
+		if err == nil {
+			attachState(client, state)
+		}
+	}
+	if err != nil {
+		Log.Stream.Debug("Resumption refused", "error", err, "session", client)
+		failSpan(span, err)
+		sendSMFailed(client, "item-not-found")
+		return
+	}
+
+	server.Clients.Update(client)
+	bindSession(ctx, server, client)
+	if remote && state.InitialPresence {
+		// Friends connected to this process haven't seen the session.
+		UpdatePresenceForFriends(ctx, server, client, state.Presence.Status, state.Presence.Away, false)
+	}
+
+	Log.Stream.Debug("Session resumed", "replayed", len(state.Unacked), "fromPreviousProcess", remote, "session", client)
+	publishSessionEvent(EventSessionResume, client, map[string]interface{}{"replayed": len(state.Unacked)})
+}
+
+// DetachClient keeps a resumable session registered for timeouts.resume
+// after its connection dropped, buffering the stanzas sent to it meanwhile.
+// It reports whether it did; otherwise the session is to be removed.
+func DetachClient(server *structs.Server, client *structs.Client) bool {
+	timeout := CurrentConfig().Timeouts.Resume
+
+	sm := &client.SM
+	sm.Mutex.Lock()
+	if sm.ID == "" || sm.Detached || sm.Resumed || client.JID == "" || timeout <= 0 || ShuttingDown() {
+		sm.Mutex.Unlock()
+		return false
+	}
+	sm.Detached = true
+	d := detachedSession{server: server, client: client}
+	resumable.Store(sm.ID, d)
+	sm.Expiry = time.AfterFunc(timeout, func() { expireSession(d) })
+	sm.Mutex.Unlock()
+
+	// Until it is resumed, other nodes see the account as offline.
+	releaseSession(context.Background(), server, client)
+	Log.Stream.Debug("Connection lost, session kept for resumption", "timeout", timeout, "session", client)
+	return true
+}
+
+// Detached reports whether client is a session waiting to be resumed.
+func Detached(client *structs.Client) bool {
+	sm := &client.SM
+	sm.Mutex.Lock()
+	defer sm.Mutex.Unlock()
+	return sm.Detached
+}
+
+// hasAttachedSession reports whether accountID has a session other than
+// detached ones, which a new login may resume.
+func hasAttachedSession(server *structs.Server, accountID string) bool {
+	for _, client := range server.Clients.ByAccount(accountID) {
+		if !Detached(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// EndDetachedSessions removes the detached sessions of accountID, once the
+// account bound a new session instead of resuming one.
+func EndDetachedSessions(server *structs.Server, accountID string) {
+	for _, client := range append([]*structs.Client(nil), server.Clients.ByAccount(accountID)...) {
+		expireSession(detachedSession{server: server, client: client})
+	}
+}
+
+// ExpireDetachedSessions removes every detached session. A stopping server
+// calls it, as no process is left to resume them.
+func ExpireDetachedSessions() {
+	resumable.Range(func(_, value any) bool {
+		expireSession(value.(detachedSession))
+		return true
+	})
+}
+
+// AwaitResumptions waits until every detached session was resumed or
+// expired, or ctx ends.
+func AwaitResumptions(ctx context.Context) {
+	ticker := time.NewTicker(drainTick)
+	defer ticker.Stop()
+	for {
+		waiting := false
+		resumable.Range(func(_, _ any) bool {
+			waiting = true
+			return false
+		})
+		if !waiting {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func expireSession(d detachedSession) {
+	sm := &d.client.SM
+	sm.Mutex.Lock()
+	if !sm.Detached {
+		sm.Mutex.Unlock()
+		return
+	}
+	endDetached(sm)
+	sm.Mutex.Unlock()
+
+	Log.Stream.Debug("Session not resumed in time", "session", d.client)
+	RemoveClient(d.server, d.client)
+}
+
+// endResumption makes client's session no longer resumable as it is being
+// removed. It reports false when the session was resumed by a new
+// connection, which the removal must leave alone.
+func endResumption(client *structs.Client) bool {
+	sm := &client.SM
+	sm.Mutex.Lock()
+	defer sm.Mutex.Unlock()
+
+	if sm.Resumed {
+		return false
+	}
+	if sm.Detached {
+		endDetached(sm)
+	}
+	sm.ID = ""
+	sm.Unacked = nil
+	return true
+}
+
+// endDetached stops waiting for a detached session to be resumed. sm.Mutex
+// must be held.
+func endDetached(sm *structs.StreamManagement) {
+	sm.Detached = false
+	sm.Expiry.Stop()
+	resumable.Delete(sm.ID)
+}
+
+// takeSession takes the detached session id of accountID over, acking the
+// h stanzas the client reports having handled. With successor set, the
+// session moves onto that client here; otherwise the caller restores the
+// returned state in another process.
+func takeSession(id, domain, accountID string, h uint32, successor *structs.Client) (*resumeState, error) {
+	value, ok := resumable.Load(id)
+	if !ok {
+		return nil, errNotResumable
+	}
+	d := value.(detachedSession)
+	old := d.client
+	if d.server.Domain != domain || old.AccountID != accountID {
+		return nil, errNotResumable
+	}
+
+	sm := &old.SM
+	sm.Mutex.Lock()
+	defer sm.Mutex.Unlock()
+	if !sm.Detached {
+		return nil, errNotResumable
+	}
+	if err := ackStanzas(sm, h); err != nil {
+		return nil, err
+	}
+
+	presence := LastPresence(old)
+	_, autoAway := lastActivity(old)
+	old.DirectedMutex.Lock()
+	directed := make(map[string]bool, len(old.DirectedPresence))
+	for jid, v := range old.DirectedPresence {
+		directed[jid] = v
+	}
+	old.DirectedMutex.Unlock()
+
+	state := &resumeState{
+		ID:               sm.ID,
+		JID:              old.JID,
+		Resource:         old.Resource,
+		Presence:         presence,
+		AutoAway:         autoAway,
+		Caps:             clientCaps(old),
+		InitialPresence:  old.InitialPresence,
+		Invisible:        old.Invisible,
+		DirectedPresence: directed,
+		Inbound:          sm.Inbound,
+		Acked:            h,
+		Unacked:          sm.Unacked,
+	}
+
+	endDetached(sm)
+	sm.Resumed = true
+	sm.Successor = successor
+	sm.Unacked = nil
+	d.server.Clients.Remove(old)
+	forgetPendingCaps(d.server, old)
+
+	// Stanzas queued for the old session from here on are forwarded, so the
+	// new one must have been sent those it missed first.
+	if successor != nil {
+		attachState(successor, state)
+	}
+	return state, nil
+}
+
+// attachState makes client the session state was taken from: it is sent
+// <resumed/> and the stanzas the old connection didn't get acked.
+func attachState(client *structs.Client, state *resumeState) {
+	client.Resource = state.Resource
+	client.JID = state.JID
+	setClientCaps(client, state.Caps)
+	client.InitialPresence = state.InitialPresence
+	client.Invisible = state.Invisible
+	setLastPresence(client, state.Presence)
+	client.ActivityMutex.Lock()
+	client.AutoAway = state.AutoAway
+	client.ActivityMutex.Unlock()
+	client.DirectedMutex.Lock()
+	client.DirectedPresence = state.DirectedPresence
+	client.DirectedMutex.Unlock()
+
+	sm := &client.SM
+	sm.Mutex.Lock()
+	defer sm.Mutex.Unlock()
+	sm.Enabled = true
+	sm.ID = state.ID
+	sm.Inbound = state.Inbound
+	sm.Outbound = state.Acked
+
+	resumed := fmt.Sprintf(`<resumed xmlns="%s" previd="%s" h="%d"/>`, smNamespace, state.ID, state.Inbound)
+	_ = send(client, structs.Frame{Data: []byte(resumed)})
+	for _, data := range state.Unacked {
+		if err := send(client, structs.Frame{Data: data}); err != nil {
+			Log.Stream.Warn("Failed to resend unacknowledged stanza", "error", err, "session", client)
+		}
+		trackStanza(client, data)
+	}
+}
+
+// trackStanza counts a stanza sent to client and keeps it until it is acked.
+// client.SM.Mutex must be held.
+func trackStanza(client *structs.Client, data []byte) {
+	sm := &client.SM
+	sm.Outbound++
+	if sm.ID == "" {
+		return
+	}
+
+	if len(sm.Unacked) >= CurrentConfig().Limits.OutboundQueue {
+		Log.Stream.Warn("Client isn't acknowledging stanzas, resumption turned off", "session", client)
+		sm.ID = ""
+		sm.Unacked = nil
+		return
+	}
+	sm.Unacked = append(sm.Unacked, data)
+	if !sm.Detached && len(sm.Unacked)%smRequestEvery == 0 {
+		_ = send(client, structs.Frame{Data: []byte(`<r xmlns="` + smNamespace + `"/>`)})
+	}
+}
+
+// ackStanzas drops the stanzas up to the h-th sent from sm.Unacked. sm.Mutex
+// must be held.
+func ackStanzas(sm *structs.StreamManagement, h uint32) error {
+	if sm.ID == "" {
+		return nil
+	}
+	pending := sm.Outbound - h
+	if pending > uint32(len(sm.Unacked)) {
+		return errAckTooHigh
+	}
+	sm.Unacked = sm.Unacked[len(sm.Unacked)-int(pending):]
+	return nil
+}
+
+// isStanza reports whether data is a stanza XEP-0198 counts, as opposed to a
+// stream-level element.
+func isStanza(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return bytes.HasPrefix(data, []byte("<message")) ||
+		bytes.HasPrefix(data, []byte("<presence")) ||
+		bytes.HasPrefix(data, []byte("<iq"))
+}
+
+func parseHandled(node map[string]interface{}) (uint32, error) {
+	s, _ := node["-h"].(string)
+	h, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid h %q", s)
+	}
+	return uint32(h), nil
+}
+
+func newResumptionID() string {
+	b := make([]byte, 18)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func smFailed(condition string) []byte {
+	return []byte(fmt.Sprintf(`<failed xmlns="%s"><%s xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></failed>`, smNamespace, condition))
+}
+
+func sendSMFailed(client *structs.Client, condition string) {
+	Enqueue(client, string(smFailed(condition)))
+}
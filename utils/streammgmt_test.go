@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+func smNode(attrs ...string) map[string]interface{} {
+	node := map[string]interface{}{"-xmlns": smNamespace}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		node["-"+attrs[i]] = attrs[i+1]
+	}
+	return node
+}
+
+// enableResumption enables stream management with resumption on client and
+// returns the resumption ID.
+func enableResumption(t *testing.T, client *structs.Client) string {
+	t.Helper()
+	HandleEnable(client, smNode("resume", "true"))
+	enabled := receive(t, client, "<enabled", `resume="true"`)
+	m := regexp.MustCompile(`id="([^"]+)"`).FindStringSubmatch(enabled)
+	if m == nil {
+		t.Fatalf("no resumption id in %s", enabled)
+	}
+	return m[1]
+}
+
+// sent returns the frames queued for client so far.
+func sent(client *structs.Client) []string {
+	var frames []string
+	for {
+		select {
+		case frame := <-client.Outbound:
+			frames = append(frames, string(frame.Data))
+		default:
+			return frames
+		}
+	}
+}
+
+// newConnection returns an authenticated, unbound session of accountID, as
+// a client reconnecting to resume would have.
+func newConnection(server *structs.Server, accountID string) *structs.Client {
+	client := &structs.Client{
+		ID:            accountID + "-reconnected",
+		AccountID:     accountID,
+		Domain:        server.Domain,
+		Outbound:      make(chan structs.Frame, 16),
+		Done:          make(chan struct{}),
+		Authenticated: true,
+		ClientExists:  true,
+	}
+	server.Clients.Add(client)
+	return client
+}
+
+func testMessage(n int) string {
+	return fmt.Sprintf(`<message id="m%d" xmlns="jabber:client"><body>%d</body></message>`, n, n)
+}
+
+func TestStreamResumption(t *testing.T) {
+	server := &structs.Server{Domain: testDomain, Store: storage.NewMemory(storage.Seed{})}
+	old := addTestSession(t, server, "", "alice")
+	id := enableResumption(t, old)
+
+	for i := 1; i <= 3; i++ {
+		Enqueue(old, testMessage(i))
+	}
+	sent(old)
+	HandleAck(old, smNode("h", "1"))
+	StanzaHandled(old)
+
+	if !DetachClient(server, old) {
+		t.Fatal("resumable session wasn't detached")
+	}
+	CloseClient(old)
+	if err := Enqueue(old, testMessage(4)); err != nil {
+		t.Fatalf("stanza for a detached session wasn't kept: %v", err)
+	}
+	if hasAttachedSession(server, "alice") {
+		t.Error("a detached session refuses new logins")
+	}
+
+	client := newConnection(server, "alice")
+	HandleResume(client, smNode("previd", id, "h", "2"), server)
+
+	frames := sent(client)
+	if len(frames) != 3 {
+		t.Fatalf("resumed connection was sent %q, want <resumed/> and m3, m4", frames)
+	}
+	if want := fmt.Sprintf(`<resumed xmlns="%s" previd="%s" h="1"/>`, smNamespace, id); frames[0] != want {
+		t.Errorf("got %s, want %s", frames[0], want)
+	}
+	if frames[1] != testMessage(3) || frames[2] != testMessage(4) {
+		t.Errorf("resent %q, want the unacknowledged m3 and m4 in order", frames[1:])
+	}
+
+	if client.JID != old.JID {
+		t.Errorf("resumed JID = %q, want %q", client.JID, old.JID)
+	}
+	if got := server.Clients.ByJID(old.JID); got != client {
+		t.Errorf("JID routes to %v, want the resumed session", got)
+	}
+	if Detached(old) || server.Clients.Len() != 1 {
+		t.Error("old session is still registered")
+	}
+
+	// Stanzas routed to the old session before it was looked up again
+	// reach the new connection.
+	Enqueue(old, testMessage(5))
+	receive(t, client, `id="m5"`)
+
+	// Counters carry over: the client must ack m3, m4 and m5.
+	HandleAck(client, smNode("h", "5"))
+	client.SM.Mutex.Lock()
+	unacked := len(client.SM.Unacked)
+	client.SM.Mutex.Unlock()
+	if unacked != 0 {
+		t.Errorf("%d stanzas unacked after acking all", unacked)
+	}
+	HandleAckRequest(client, smNode())
+	receive(t, client, `<a xmlns="urn:xmpp:sm:3" h="1"/>`)
+}
+
+func TestStreamResumptionRefused(t *testing.T) {
+	server := &structs.Server{Domain: testDomain, Store: storage.NewMemory(storage.Seed{})}
+	old := addTestSession(t, server, "", "alice")
+	id := enableResumption(t, old)
+	DetachClient(server, old)
+	t.Cleanup(ExpireDetachedSessions)
+
+	// Another account can't take the session over.
+	mallory := newConnection(server, "mallory")
+	HandleResume(mallory, smNode("previd", id, "h", "0"), server)
+	receive(t, mallory, "<failed", "item-not-found")
+	if !Detached(old) {
+		t.Fatal("failed resumption ended the session")
+	}
+
+	// Binding a new session ends the detached one.
+	EndDetachedSessions(server, "alice")
+	if Detached(old) || server.Clients.ByJID(old.JID) != nil {
+		t.Error("detached session survived a new bind")
+	}
+	client := newConnection(server, "alice")
+	HandleResume(client, smNode("previd", id, "h", "0"), server)
+	receive(t, client, "<failed", "item-not-found")
+}
+
+func TestStreamResumptionExpires(t *testing.T) {
+	cfg := *CurrentConfig()
+	cfg.Timeouts.Resume = 20 * time.Millisecond
+	previousConfig := currentConfig.Swap(&cfg)
+	t.Cleanup(func() { currentConfig.Store(previousConfig) })
+
+	server := &structs.Server{Domain: testDomain, Store: storage.NewMemory(storage.Seed{})}
+	old := addTestSession(t, server, "", "alice")
+	id := enableResumption(t, old)
+	// The disconnect is published once the expired session is cleaned up.
+	sub := SubscribeEvents(EventFilter{Domain: testDomain, AccountIDs: []string{"alice"}, Types: []string{EventSessionDisconnect}})
+	t.Cleanup(func() { UnsubscribeEvents(sub) })
+	DetachClient(server, old)
+
+	select {
+	case <-sub.C:
+	case <-time.After(2 * time.Second):
+		t.Fatal("detached session outlived timeouts.resume")
+	}
+	if server.Clients.Len() > 0 {
+		t.Fatal("expired session is still connected")
+	}
+	client := newConnection(server, "alice")
+	HandleResume(client, smNode("previd", id, "h", "0"), server)
+	receive(t, client, "<failed", "item-not-found")
+}
+
+func TestStreamResumptionAfterHandoff(t *testing.T) {
+	server := &structs.Server{Domain: testDomain, Store: storage.NewMemory(storage.Seed{})}
+	old := addTestSession(t, server, "", "alice")
+	id := enableResumption(t, old)
+	Enqueue(old, testMessage(1))
+	sent(old)
+	DetachClient(server, old)
+	t.Cleanup(ExpireDetachedSessions)
+
+	// The previous process serves its end; this test is the new process.
+	oldEnd, newEnd := net.Pipe()
+	go serveTakeovers(oldEnd)
+	setPrevious(newEnd)
+	t.Cleanup(func() {
+		previous.Lock()
+		previous.conn, previous.enc, previous.dec = nil, nil, nil
+		previous.Unlock()
+		newEnd.Close()
+	})
+
+	if _, err := takeFromPrevious(takeoverRequest{ID: id, Domain: testDomain, AccountID: "mallory"}); err == nil {
+		t.Fatal("another account took the session over")
+	}
+
+	state, err := takeFromPrevious(takeoverRequest{ID: id, Domain: testDomain, AccountID: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.JID != old.JID || len(state.Unacked) != 1 || string(state.Unacked[0]) != testMessage(1) {
+		t.Errorf("took over %+v", state)
+	}
+
+	// The old process lets go of the session without logging it out.
+	if server.Clients.Len() != 0 || Detached(old) || old.AccountID != "alice" {
+		t.Error("session taken over is still held, or was removed as a logout")
+	}
+	if err := Enqueue(old, testMessage(2)); err == nil {
+		t.Error("stanza for a session taken over by another process was kept")
+	}
+
+	client := newConnection(server, "alice")
+	attachState(client, state)
+	frames := sent(client)
+	if len(frames) != 2 || frames[1] != testMessage(1) {
+		t.Errorf("new process sent %q", frames)
+	}
+}
@@ -0,0 +1,247 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+	"github.com/google/uuid"
+)
+
+const nsRoster = "jabber:iq:roster"
+
+// HandleSubscription maps presence subscription stanzas onto the friends
+// documents: subscribe sends a friend request, subscribed accepts one and
+// unsubscribe/unsubscribed remove the friendship or request. Roster pushes
+// only go out once both documents are updated; if that fails, the change is
+// rolled back and the client gets a presence error.
+func HandleSubscription(ctx context.Context, client *structs.Client, subType, to string, server *structs.Server) {
+	targetID := AccountIDFromJID(to, server.Domain)
+	if targetID == "" || targetID == client.AccountID || client.AccountID == "" {
+		return
+	}
+
+	mine, err := server.Store.Friends.GetFriends(ctx, client.AccountID)
+	if err != nil {
+		Log.MongoDB.Error("Failed to load friends", "error", err, "session", client)
+		sendPresenceError(client, to, "wait", "internal-server-error")
+		return
+	}
+	theirs, err := server.Store.Friends.GetFriends(ctx, targetID)
+	if err != nil {
+		Log.MongoDB.Error("Failed to load friends", "error", err, "session", client)
+		sendPresenceError(client, to, "wait", "internal-server-error")
+		return
+	}
+
+	if hasFriendEntry(mine.List.Blocked, targetID) || hasFriendEntry(theirs.List.Blocked, client.AccountID) {
+		return
+	}
+
+	switch subType {
+	case "subscribe":
+		if hasFriendEntry(mine.List.Accepted, targetID) {
+			sendSubscriptionPresence(ctx, server, targetID, client.AccountID, "subscribed")
+			return
+		}
+		if hasFriendEntry(mine.List.Incoming, targetID) {
+			if err := acceptSubscription(ctx, mine, theirs, server); err != nil {
+				Log.MongoDB.Error("Failed to accept friend", "friendId", targetID, "error", err, "session", client)
+				sendPresenceError(client, to, "wait", "internal-server-error")
+			}
+			return
+		}
+
+		if _, err := server.Store.Users.GetUser(ctx, targetID); errors.Is(err, storage.ErrNotFound) {
+			sendPresenceError(client, to, "cancel", "item-not-found")
+			return
+		} else if err != nil {
+			Log.MongoDB.Error("Failed to look up user", "friendId", targetID, "error", err, "session", client)
+			sendPresenceError(client, to, "wait", "internal-server-error")
+			return
+		}
+
+		err := applyFriendChanges(ctx, server.Store.Friends, []friendChange{
+			{Add: true, AccountID: client.AccountID, List: "outgoing", FriendID: targetID},
+			{Add: true, AccountID: targetID, List: "incoming", FriendID: client.AccountID},
+		})
+		if err != nil {
+			Log.MongoDB.Error("Failed to add friend request", "friendId", targetID, "error", err, "session", client)
+			sendPresenceError(client, to, "wait", "internal-server-error")
+			return
+		}
+
+		pushRoster(ctx, server, client.AccountID, targetID, "none", "subscribe")
+		pushRoster(ctx, server, targetID, client.AccountID, "none", "")
+		sendSubscriptionPresence(ctx, server, client.AccountID, targetID, "subscribe")
+
+	case "subscribed":
+		if !hasFriendEntry(mine.List.Incoming, targetID) {
+			return
+		}
+		if err := acceptSubscription(ctx, mine, theirs, server); err != nil {
+			Log.MongoDB.Error("Failed to accept friend", "friendId", targetID, "error", err, "session", client)
+			sendPresenceError(client, to, "wait", "internal-server-error")
+		}
+
+	case "unsubscribe", "unsubscribed":
+		changes := append(
+			removeChanges(mine, targetID, "accepted", "incoming", "outgoing"),
+			removeChanges(theirs, client.AccountID, "accepted", "incoming", "outgoing")...,
+		)
+		if len(changes) == 0 {
+			return
+		}
+
+		if err := applyFriendChanges(ctx, server.Store.Friends, changes); err != nil {
+			Log.MongoDB.Error("Failed to remove friend", "friendId", targetID, "error", err, "session", client)
+			sendPresenceError(client, to, "wait", "internal-server-error")
+			return
+		}
+
+		pushRoster(ctx, server, client.AccountID, targetID, "remove", "")
+		pushRoster(ctx, server, targetID, client.AccountID, "remove", "")
+		sendSubscriptionPresence(ctx, server, client.AccountID, targetID, subType)
+
+		SendPresence(client.AccountID, targetID, true, server)
+		SendPresence(targetID, client.AccountID, true, server)
+	}
+}
+
+// acceptSubscription turns the pending request from the owner of requester
+// to the owner of mine into a friendship on both sides.
+func acceptSubscription(ctx context.Context, mine, requester *models.Friends, server *structs.Server) error {
+	accountID, requesterID := mine.AccountID, requester.AccountID
+
+	changes := append(
+		removeChanges(mine, requesterID, "incoming", "outgoing"),
+		removeChanges(requester, accountID, "incoming", "outgoing")...,
+	)
+	changes = append(changes,
+		friendChange{Add: true, AccountID: accountID, List: "accepted", FriendID: requesterID},
+		friendChange{Add: true, AccountID: requesterID, List: "accepted", FriendID: accountID},
+	)
+	if err := applyFriendChanges(ctx, server.Store.Friends, changes); err != nil {
+		return err
+	}
+
+	pushRoster(ctx, server, accountID, requesterID, "both", "")
+	pushRoster(ctx, server, requesterID, accountID, "both", "")
+	sendSubscriptionPresence(ctx, server, accountID, requesterID, "subscribed")
+
+	SendPresence(accountID, requesterID, false, server)
+	SendPresence(requesterID, accountID, false, server)
+	return nil
+}
+
+// friendChange adds FriendID to, or removes it from, one list of AccountID's
+// friends document.
+type friendChange struct {
+	Add       bool
+	AccountID string
+	List      string
+	FriendID  string
+}
+
+func (c friendChange) apply(ctx context.Context, store storage.FriendStore) error {
+	if c.Add {
+		return store.AddFriendEntry(ctx, c.AccountID, c.List, c.FriendID)
+	}
+	return store.RemoveFriendEntry(ctx, c.AccountID, c.FriendID, c.List)
+}
+
+// removeChanges returns the removals of friendID from those of lists in
+// friends that hold it.
+func removeChanges(friends *models.Friends, friendID string, lists ...string) []friendChange {
+	var changes []friendChange
+	for _, list := range lists {
+		if entries := friends.List.Named(list); entries != nil && hasFriendEntry(*entries, friendID) {
+			changes = append(changes, friendChange{AccountID: friends.AccountID, List: list, FriendID: friendID})
+		}
+	}
+	return changes
+}
+
+// applyFriendChanges applies changes in order. If one fails, those already
+// applied are undone so that the two sides of a friendship stay consistent.
+func applyFriendChanges(ctx context.Context, store storage.FriendStore, changes []friendChange) error {
+	for i, change := range changes {
+		err := change.apply(ctx, store)
+		if err == nil {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			undo := changes[j]
+			undo.Add = !undo.Add
+			if uerr := undo.apply(ctx, store); uerr != nil {
+				Log.MongoDB.Error("Failed to roll back friend change", "accountId", undo.AccountID, "friendId", undo.FriendID, "list", undo.List, "error", uerr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// sendPresenceError tells client that its presence to to couldn't be handled.
+func sendPresenceError(client *structs.Client, to, errType, condition string) {
+	errXML := fmt.Sprintf(
+		`<presence from="%s" to="%s" type="error" xmlns="jabber:client"><error type="%s"><%s xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></presence>`,
+		xmlEscape(to), client.JID, errType, condition,
+	)
+	Enqueue(client, errXML)
+}
+
+// DeliverPendingSubscriptions sends the subscribe requests that arrived while
+// the client was offline. It is called on the client's initial presence.
+func DeliverPendingSubscriptions(ctx context.Context, client *structs.Client, server *structs.Server) {
+	friends, err := server.Store.Friends.GetFriends(ctx, client.AccountID)
+	if err != nil {
+		Log.MongoDB.Error("Failed to load pending friend requests", "error", err, "session", client)
+		return
+	}
+
+	for _, entry := range friends.List.Incoming {
+		if HasBlocked(client, entry.AccountID) {
+			continue
+		}
+		presenceXML := fmt.Sprintf(`<presence from="%s" to="%s" type="subscribe" xmlns="jabber:client"/>`,
+			BareJID(entry.AccountID, server.Domain), client.JID)
+		Enqueue(client, presenceXML)
+	}
+}
+
+// pushRoster sends a roster push for itemID to every session of accountID,
+// on this node and on the others.
+func pushRoster(ctx context.Context, server *structs.Server, accountID, itemID, subscription, ask string) {
+	askAttr := ""
+	if ask != "" {
+		askAttr = fmt.Sprintf(` ask="%s"`, ask)
+	}
+
+	sendToAccount(ctx, server, accountID, "", func(jid string) string {
+		return fmt.Sprintf(`<iq to="%s" id="push_%s" type="set" xmlns="jabber:client"><query xmlns="%s"><item jid="%s" subscription="%s"%s/></query></iq>`,
+			jid, strings.ReplaceAll(uuid.New().String(), "-", ""), nsRoster, BareJID(itemID, server.Domain), subscription, askAttr)
+	})
+}
+
+// sendSubscriptionPresence delivers a subscription presence from fromID to every
+// online session of toID, on this node and on the others.
+func sendSubscriptionPresence(ctx context.Context, server *structs.Server, fromID, toID, subType string) {
+	sendToAccount(ctx, server, toID, fromID, func(jid string) string {
+		return fmt.Sprintf(`<presence from="%s" to="%s" type="%s" xmlns="jabber:client"/>`,
+			BareJID(fromID, server.Domain), jid, subType)
+	})
+}
+
+func hasFriendEntry(entries []models.FriendEntry, accountID string) bool {
+	for _, entry := range entries {
+		if entry.AccountID == accountID {
+			return true
+		}
+	}
+	return false
+}
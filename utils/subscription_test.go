@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+)
+
+func TestSubscribeToUnknownAccount(t *testing.T) {
+	store := storage.NewMemory(storage.Seed{Users: []models.User{{AccountID: "alice"}}})
+	server := &structs.Server{Domain: testDomain, Store: store}
+	alice := addTestSession(t, server, "", "alice")
+	ctx := context.Background()
+
+	HandleSubscription(ctx, alice, "subscribe", "nobody@"+testDomain, server)
+	receive(t, alice, `type="error"`, "item-not-found")
+
+	friends, err := store.Friends.GetFriends(ctx, "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(friends.List.Incoming) != 0 {
+		t.Error("friend request stored for an account that doesn't exist")
+	}
+}
+
+func TestSubscribeReachesOtherNodes(t *testing.T) {
+	store := storage.NewMemory(storage.Seed{Users: []models.User{{AccountID: "alice"}, {AccountID: "bob"}}})
+	a, b := startTestCluster(t, store)
+	alice := addTestSession(t, a, "", "alice")
+	bob := addTestSession(t, b, "b", "bob")
+
+	HandleSubscription(context.Background(), alice, "subscribe", "bob@"+testDomain, a)
+	receive(t, alice, "jabber:iq:roster", `jid="bob@`+testDomain+`"`, `ask="subscribe"`)
+	receive(t, bob, "jabber:iq:roster", `jid="alice@`+testDomain+`"`)
+	receive(t, bob, `type="subscribe"`, `from="alice@`+testDomain+`"`)
+}
@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/RazerFrFr/Voryn/config"
+	"github.com/RazerFrFr/Voryn/structs"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer starts Voryn's spans. Until StartTracing installs a provider it
+// hands out spans that record nothing.
+var tracer = otel.Tracer("github.com/RazerFrFr/Voryn")
+
+var (
+	tracerProvider *sdktrace.TracerProvider
+
+	// mongoSpans holds the spans of MongoDB commands in flight, keyed by the
+	// driver's request ID.
+	mongoSpans sync.Map
+)
+
+// StartTracing installs W3C trace context propagation and, unless
+// tracing.exporter is empty, a tracer provider exporting to it.
+func StartTracing(cfg config.TracingConfig) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.Exporter == "" {
+		return nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	case "stdout":
+		exporter, err = stdouttrace.New()
+	default:
+		err = fmt.Errorf("unknown exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(cfg.ServiceName)))
+	if err != nil {
+		return err
+	}
+
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		Log.Tracing.Warn("Tracing failed", "error", err)
+	}))
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	Log.Tracing.Info("Tracing enabled", "exporter", cfg.Exporter, "sampleRatio", cfg.SampleRatio)
+	return nil
+}
+
+// StopTracing exports the spans still buffered and shuts the exporter down.
+func StopTracing(ctx context.Context) error {
+	if tracerProvider == nil {
+		return nil
+	}
+	return tracerProvider.Shutdown(ctx)
+}
+
+// TraceRequests starts a server span for each request, continuing the trace
+// named by its traceparent header, and passes it on in the request context.
+func TraceRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.ClientAddress(c.ClientIP()),
+			))
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+	}
+}
+
+// startSessionSpan starts a span for work done on behalf of client.
+func startSessionSpan(ctx context.Context, client *structs.Client, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{attribute.String("xmpp.session.id", client.ID)}
+	if client.AccountID != "" {
+		attrs = append(attrs, attribute.String("xmpp.account.id", client.AccountID))
+	}
+	if client.JID != "" {
+		attrs = append(attrs, attribute.String("xmpp.jid", client.JID))
+	}
+	return tracer.Start(ctx, name, append(opts, trace.WithAttributes(attrs...))...)
+}
+
+// startWriteSpan starts the span of a traced frame's write. It begins when
+// the frame was queued, so it covers the wait behind other stanzas as well.
+func startWriteSpan(client *structs.Client, frame structs.Frame) trace.Span {
+	ctx := trace.ContextWithSpanContext(context.Background(), frame.Span)
+	_, span := startSessionSpan(ctx, client, "xmpp.write",
+		trace.WithTimestamp(frame.Queued),
+		trace.WithAttributes(attribute.Int("xmpp.bytes", len(frame.Data))))
+	span.AddEvent("dequeued")
+	return span
+}
+
+// failSpan marks span as failed with err, if there is one.
+func failSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// injectTrace adds the trace context of ctx to outgoing request headers.
+func injectTrace(ctx context.Context, header propagation.HeaderCarrier) {
+	otel.GetTextMapPropagator().Inject(ctx, header)
+}
+
+// startMongoSpan starts the span of a MongoDB command as a child of the span
+// in ctx. Commands run outside of one, such as the polling of the webhook
+// retry queue and the outbox or the cluster heartbeat, are not traced, so
+// they don't start a trace every few seconds.
+func startMongoSpan(ctx context.Context, e *event.CommandStartedEvent) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemNameMongoDB,
+		semconv.DBOperationName(e.CommandName),
+		semconv.DBNamespace(e.DatabaseName),
+	}
+	name := e.CommandName
+	if first, err := e.Command.IndexErr(0); err == nil {
+		if collection, ok := first.Value().StringValueOK(); ok {
+			attrs = append(attrs, semconv.DBCollectionName(collection))
+			name += " " + collection
+		}
+	}
+
+	_, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	if span.IsRecording() {
+		mongoSpans.Store(e.RequestID, span)
+	}
+}
+
+func endMongoSpan(requestID int64, err error) {
+	if v, ok := mongoSpans.LoadAndDelete(requestID); ok {
+		span := v.(trace.Span)
+		failSpan(span, err)
+		span.End()
+	}
+}
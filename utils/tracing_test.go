@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans makes tracer record every span until the test ends.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := tracer
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() {
+		tracer = previous
+		_ = provider.Shutdown(context.Background())
+	})
+	return recorder
+}
+
+func mongoCommand(t *testing.T, requestID int64) *event.CommandStartedEvent {
+	command, err := bson.Marshal(bson.D{{Key: "find", Value: "friends"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &event.CommandStartedEvent{Command: command, DatabaseName: "voryn", CommandName: "find", RequestID: requestID}
+}
+
+func TestMongoSpansJoinTraces(t *testing.T) {
+	recorder := recordSpans(t)
+
+	// Background polling runs outside of any span.
+	startMongoSpan(context.Background(), mongoCommand(t, 1))
+	endMongoSpan(1, nil)
+	if spans := recorder.Ended(); len(spans) != 0 {
+		t.Fatalf("a command without a parent span started a trace: %v", spans[0].Name())
+	}
+
+	ctx, parent := tracer.Start(context.Background(), "xmpp.presence")
+	startMongoSpan(ctx, mongoCommand(t, 2))
+	endMongoSpan(2, nil)
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].Name() != "find friends" {
+		t.Fatalf("recorded %d spans, want the command's and its parent's", len(spans))
+	}
+	if got := spans[0].Parent(); got.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("command span's parent = %s, want %s", got.SpanID(), parent.SpanContext().SpanID())
+	}
+}
+
+func TestClusterRouteCarriesTrace(t *testing.T) {
+	recordSpans(t)
+	previousPropagator := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(previousPropagator) })
+
+	a, _ := startTestCluster(t, storage.NewMemory(storage.Seed{}))
+	alice := addTestSession(t, a, "", "alice")
+	addTestSession(t, &structs.Server{Domain: testDomain, Store: a.Store}, "b", "bob")
+
+	parents := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parents <- r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(ts.Close)
+	clusterPeers.Store(&map[*structs.Server]map[string]models.ClusterNode{
+		a: {"b": {ID: "b", Address: ts.URL, Seen: time.Now()}},
+	})
+
+	ctx, span := tracer.Start(context.Background(), "xmpp.message")
+	defer span.End()
+	if !routeMessage(ctx, a, alice, "bob@"+testDomain, "bob", "m1", "chat", "hello") {
+		t.Fatal("bob's session on node b wasn't found")
+	}
+
+	select {
+	case parent := <-parents:
+		sc := span.SpanContext()
+		if want := "00-" + sc.TraceID().String() + "-" + sc.SpanID().String() + "-01"; parent != want {
+			t.Errorf("route sent with traceparent %q, want %q", parent, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("route wasn't sent")
+	}
+}
@@ -0,0 +1,328 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/config"
+	"github.com/RazerFrFr/Voryn/models"
+	"github.com/RazerFrFr/Voryn/storage"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	webhookWorkers      = 4
+	webhookQueueSize    = 1024
+	webhookTimeout      = 10 * time.Second
+	webhookPollInterval = 5 * time.Second
+	webhookLease        = time.Minute
+	webhookMaxAttempts  = 10
+	webhookBaseBackoff  = 30 * time.Second
+	webhookMaxBackoff   = time.Hour
+)
+
+// DefaultWebhookEvents are sent to webhooks that don't list their own: login,
+// logout, presence changes and party exits.
+var DefaultWebhookEvents = []string{
+	EventSessionAuth,
+	EventSessionDisconnect,
+	EventPresenceChange,
+	EventPartyExit,
+}
+
+// Webhook is an HTTP endpoint that receives events as JSON. When Secret is
+// set, each request carries an X-Voryn-Signature header holding the hex
+// HMAC-SHA256 of the body.
+type Webhook struct {
+	URL    string
+	Events []string
+	Secret string
+}
+
+type webhookJob struct {
+	store    storage.WebhookStore
+	hook     Webhook
+	delivery models.WebhookDelivery
+}
+
+var (
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+	webhookEvents = make(chan Event, webhookQueueSize)
+	webhookJobs   = make(chan webhookJob, webhookQueueSize)
+	webhookList   atomic.Pointer[[]Webhook]
+
+	// webhookHosts is set by StartWebhooks, before any event is published.
+	// webhookPending counts the events waiting for the writer and the jobs
+	// handed to the workers, until they are done.
+	webhookHosts   atomic.Pointer[Hosts]
+	webhookPending atomic.Int64
+)
+
+// configureWebhooks replaces the webhook targets. Deliveries already queued
+// for a URL that is no longer configured are dropped when retried.
+func configureWebhooks(hooks []config.WebhookConfig) {
+	list := make([]Webhook, 0, len(hooks))
+	for _, hook := range hooks {
+		events := hook.Events
+		if len(events) == 0 {
+			events = DefaultWebhookEvents
+		}
+		list = append(list, Webhook{URL: hook.URL, Events: events, Secret: hook.Secret})
+	}
+	webhookList.Store(&list)
+}
+
+func currentWebhooks() []Webhook {
+	if list := webhookList.Load(); list != nil {
+		return *list
+	}
+	return nil
+}
+
+// StartWebhooks starts delivering the events of every host to the configured
+// webhooks. Each delivery is saved to the webhook store of the event's host
+// by a background writer and removed once the endpoint accepted it, so with a
+// persistent store none are lost to a full worker queue or a crash. Failed
+// ones are retried with backoff.
+func StartWebhooks(hosts *Hosts) {
+	webhookHosts.Store(hosts)
+
+	go writeWebhooks()
+	for i := 0; i < webhookWorkers; i++ {
+		go webhookWorker()
+	}
+	for _, server := range hosts.List {
+		go retryWebhooks(server.Store.Webhooks)
+	}
+}
+
+// sendToWebhooks hands event to the webhook writer without blocking, so the
+// store is never written from the goroutine that published it. When the
+// writer is that far behind, the event is dropped.
+func sendToWebhooks(event Event) {
+	webhookPending.Add(1)
+	select {
+	case webhookEvents <- event:
+	default:
+		webhookPending.Add(-1)
+		Log.Webhooks.Warn("Webhook queue full, dropping event", "event", event.Type, "domain", event.Domain)
+	}
+}
+
+func writeWebhooks() {
+	for event := range webhookEvents {
+		writeWebhookEvent(event)
+		webhookPending.Add(-1)
+	}
+}
+
+// writeWebhookEvent queues the deliveries of event in the store of its host.
+// Events that don't name a domain belong to the default host.
+func writeWebhookEvent(event Event) {
+	server := webhookHosts.Load().Lookup(event.Domain)
+	if server == nil {
+		Log.Webhooks.Warn("Dropping webhook event for unknown domain", "event", event.Type, "domain", event.Domain)
+		return
+	}
+	queueWebhooks(server.Store.Webhooks, event)
+}
+
+// queueWebhooks saves a delivery of event for every webhook that wants it and
+// hands them to the workers. Deliveries the workers have no room for wait in
+// the store for the retry poller. It's called by the webhook writer.
+func queueWebhooks(store storage.WebhookStore, event Event) {
+	var payload []byte
+	for _, hook := range currentWebhooks() {
+		if !(EventFilter{Types: hook.Events}).matches(event) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			if payload, err = json.Marshal(event); err != nil {
+				Log.Webhooks.Error("Failed to encode webhook event", "event", event.Type, "error", err)
+				break
+			}
+		}
+
+		// The delivery starts out leased to the workers, so the retry
+		// poller leaves it alone unless this process dies first.
+		now := time.Now()
+		job := webhookJob{
+			store: store,
+			hook:  hook,
+			delivery: models.WebhookDelivery{
+				ID:          primitive.NewObjectID(),
+				URL:         hook.URL,
+				EventType:   event.Type,
+				Payload:     string(payload),
+				NextAttempt: now.Add(webhookLease),
+				Created:     now,
+			},
+		}
+		if err := store.SaveDelivery(context.Background(), job.delivery); err != nil {
+			Log.Webhooks.Error("Failed to queue webhook delivery", "url", hook.URL, "event", event.Type, "error", err)
+			continue
+		}
+
+		webhookPending.Add(1)
+		select {
+		case webhookJobs <- job:
+		default:
+			webhookPending.Add(-1)
+			job.delivery.NextAttempt = now
+			if err := store.UpdateDelivery(context.Background(), &job.delivery); err != nil {
+				Log.Webhooks.Warn("Failed to release webhook delivery", "id", job.delivery.ID.Hex(), "error", err)
+			}
+		}
+	}
+}
+
+func webhookWorker() {
+	for job := range webhookJobs {
+		deliverWebhook(job.store, job.hook, &job.delivery)
+		webhookPending.Add(-1)
+	}
+}
+
+// deliverWebhook posts a saved delivery, then removes it from the store or
+// schedules its next attempt.
+func deliverWebhook(store storage.WebhookStore, hook Webhook, delivery *models.WebhookDelivery) {
+	if err := postWebhook(hook, *delivery); err != nil {
+		rescheduleWebhookDelivery(store, delivery, err)
+		return
+	}
+	if err := store.DeleteDelivery(context.Background(), delivery.ID); err != nil {
+		Log.Webhooks.Error("Failed to remove delivered webhook", "id", delivery.ID.Hex(), "error", err)
+	}
+}
+
+// FlushWebhooks waits until the published events have been saved and the
+// deliveries handed to the workers have been attempted. Those still queued
+// when ctx ends stay in the webhook store, so with a persistent store they are
+// sent after a restart.
+func FlushWebhooks(ctx context.Context) error {
+	if webhookHosts.Load() == nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for webhookPending.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d webhook deliveries left for retry: %w", webhookPending.Load(), ctx.Err())
+		}
+	}
+	return nil
+}
+
+// retryWebhooks polls the retry queue for deliveries that are due.
+func retryWebhooks(store storage.WebhookStore) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		retryDueWebhooks(store)
+	}
+}
+
+// retryDueWebhooks attempts every delivery that is due. Each one is leased
+// before it is attempted so a slow endpoint isn't retried twice.
+func retryDueWebhooks(store storage.WebhookStore) {
+	byURL := map[string]Webhook{}
+	for _, hook := range currentWebhooks() {
+		byURL[hook.URL] = hook
+	}
+
+	for {
+		delivery, err := store.ClaimDelivery(context.Background(), webhookLease)
+		if err != nil {
+			if !errors.Is(err, storage.ErrNotFound) {
+				Log.Webhooks.Error("Failed to read webhook retry queue", "error", err)
+			}
+			return
+		}
+
+		hook, ok := byURL[delivery.URL]
+		if !ok {
+			Log.Webhooks.Warn("Dropping webhook delivery for unconfigured URL", "url", delivery.URL)
+			_ = store.DeleteDelivery(context.Background(), delivery.ID)
+			continue
+		}
+		deliverWebhook(store, hook, delivery)
+	}
+}
+
+func postWebhook(hook Webhook, delivery models.WebhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader([]byte(delivery.Payload)))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Voryn-Webhook")
+	req.Header.Set("X-Voryn-Event", delivery.EventType)
+	req.Header.Set("X-Voryn-Delivery", delivery.ID.Hex())
+	req.Header.Set("X-Voryn-Attempt", strconv.Itoa(delivery.Attempts+1))
+	if hook.Secret != "" {
+		req.Header.Set("X-Voryn-Signature", "sha256="+SignWebhook(hook.Secret, []byte(delivery.Payload)))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// SignWebhook returns the hex HMAC-SHA256 of body, as sent in the
+// X-Voryn-Signature header.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
+
+func rescheduleWebhookDelivery(store storage.WebhookStore, delivery *models.WebhookDelivery, cause error) {
+	delivery.Attempts++
+	delivery.LastError = cause.Error()
+	delivery.NextAttempt = time.Now().Add(webhookBackoff(delivery.Attempts))
+	if delivery.Attempts >= webhookMaxAttempts {
+		delivery.Failed = true
+		Log.Webhooks.Error("Giving up on webhook delivery", "id", delivery.ID.Hex(), "url", delivery.URL, "attempts", delivery.Attempts, "error", cause)
+	}
+
+	if err := store.UpdateDelivery(context.Background(), delivery); err != nil {
+		Log.Webhooks.Error("Failed to reschedule webhook delivery", "id", delivery.ID.Hex(), "error", err)
+	}
+}
@@ -0,0 +1,311 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RazerFrFr/Voryn/config"
+	"github.com/RazerFrFr/Voryn/storage"
+	"github.com/RazerFrFr/Voryn/structs"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// webhookRequest is what a test endpoint saw of one delivery.
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookEndpoint serves the given statuses in turn, then 200s, and records
+// every request.
+type webhookEndpoint struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []webhookRequest
+}
+
+func newWebhookEndpoint(t *testing.T, statuses ...int) *webhookEndpoint {
+	e := &webhookEndpoint{statuses: statuses}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		e.mu.Lock()
+		e.requests = append(e.requests, webhookRequest{header: r.Header.Clone(), body: body})
+		status := http.StatusOK
+		if len(e.statuses) > 0 {
+			status, e.statuses = e.statuses[0], e.statuses[1:]
+		}
+		e.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *webhookEndpoint) received() []webhookRequest {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]webhookRequest(nil), e.requests...)
+}
+
+// recordingWebhooks is a memory webhook store that remembers what was deleted.
+type recordingWebhooks struct {
+	storage.WebhookStore
+
+	mu      sync.Mutex
+	deleted []primitive.ObjectID
+}
+
+func newRecordingWebhooks() *recordingWebhooks {
+	return &recordingWebhooks{WebhookStore: storage.NewMemory(storage.Seed{}).Webhooks}
+}
+
+func (s *recordingWebhooks) DeleteDelivery(ctx context.Context, id primitive.ObjectID) error {
+	s.mu.Lock()
+	s.deleted = append(s.deleted, id)
+	s.mu.Unlock()
+	return s.WebhookStore.DeleteDelivery(ctx, id)
+}
+
+func (s *recordingWebhooks) wasDeleted(id primitive.ObjectID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, deleted := range s.deleted {
+		if deleted == id {
+			return true
+		}
+	}
+	return false
+}
+
+// takeWebhookJob takes the job queueWebhooks handed to the workers.
+func takeWebhookJob(t *testing.T) webhookJob {
+	t.Helper()
+	select {
+	case job := <-webhookJobs:
+		webhookPending.Add(-1)
+		return job
+	default:
+		t.Fatal("no webhook job was queued")
+		return webhookJob{}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	endpoint := newWebhookEndpoint(t)
+	configureWebhooks([]config.WebhookConfig{{URL: endpoint.URL, Secret: "s3cret"}})
+	t.Cleanup(func() { configureWebhooks(nil) })
+
+	store := newRecordingWebhooks()
+	event := Event{Type: EventSessionAuth, Domain: "example.com", AccountID: "a1", Timestamp: time.Now().UTC()}
+	queueWebhooks(store, event)
+	queueWebhooks(store, Event{Type: EventMessageDelivered, Timestamp: time.Now().UTC()})
+
+	job := takeWebhookJob(t)
+	if len(webhookJobs) != 0 {
+		t.Fatalf("an event the webhook doesn't want was queued")
+	}
+
+	// The delivery is saved before it's posted, leased to the worker.
+	if _, err := store.ClaimDelivery(context.Background(), webhookLease); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("a queued delivery could be claimed by the retry poller: %v", err)
+	}
+
+	deliverWebhook(store, job.hook, &job.delivery)
+
+	requests := endpoint.received()
+	if len(requests) != 1 {
+		t.Fatalf("endpoint got %d requests, want 1", len(requests))
+	}
+	req := requests[0]
+
+	var got Event
+	if err := json.Unmarshal(req.body, &got); err != nil {
+		t.Fatalf("body isn't an event: %v", err)
+	}
+	if got.Type != event.Type || got.AccountID != event.AccountID || got.Domain != event.Domain {
+		t.Errorf("body = %+v, want %+v", got, event)
+	}
+	if sig, want := req.header.Get("X-Voryn-Signature"), "sha256="+SignWebhook("s3cret", req.body); sig != want {
+		t.Errorf("X-Voryn-Signature = %q, want %q", sig, want)
+	}
+	if h := req.header.Get("X-Voryn-Event"); h != EventSessionAuth {
+		t.Errorf("X-Voryn-Event = %q", h)
+	}
+	if h := req.header.Get("X-Voryn-Delivery"); h != job.delivery.ID.Hex() {
+		t.Errorf("X-Voryn-Delivery = %q, want %q", h, job.delivery.ID.Hex())
+	}
+	if h := req.header.Get("X-Voryn-Attempt"); h != "1" {
+		t.Errorf("X-Voryn-Attempt = %q, want 1", h)
+	}
+	if !store.wasDeleted(job.delivery.ID) {
+		t.Error("delivered webhook wasn't removed from the store")
+	}
+}
+
+func TestWebhookRetryBackoff(t *testing.T) {
+	endpoint := newWebhookEndpoint(t, http.StatusInternalServerError)
+	configureWebhooks([]config.WebhookConfig{{URL: endpoint.URL}})
+	t.Cleanup(func() { configureWebhooks(nil) })
+
+	store := newRecordingWebhooks()
+	queueWebhooks(store, Event{Type: EventSessionDisconnect, Timestamp: time.Now().UTC()})
+	job := takeWebhookJob(t)
+
+	before := time.Now()
+	deliverWebhook(store, job.hook, &job.delivery)
+
+	delivery := job.delivery
+	if delivery.Attempts != 1 {
+		t.Errorf("attempts = %d after a failure, want 1", delivery.Attempts)
+	}
+	if !strings.Contains(delivery.LastError, "500") {
+		t.Errorf("last error = %q, want the status", delivery.LastError)
+	}
+	if delay := delivery.NextAttempt.Sub(before); delay < webhookBaseBackoff || delay > webhookBaseBackoff+time.Second {
+		t.Errorf("retried after %v, want %v", delay, webhookBaseBackoff)
+	}
+	if store.wasDeleted(delivery.ID) {
+		t.Fatal("failed delivery was removed from the store")
+	}
+
+	// Nothing is due until the backoff has passed.
+	retryDueWebhooks(store)
+	if n := len(endpoint.received()); n != 1 {
+		t.Fatalf("retried before the backoff ran out: %d requests", n)
+	}
+
+	delivery.NextAttempt = time.Now().Add(-time.Second)
+	if err := store.UpdateDelivery(context.Background(), &delivery); err != nil {
+		t.Fatal(err)
+	}
+	retryDueWebhooks(store)
+
+	requests := endpoint.received()
+	if len(requests) != 2 {
+		t.Fatalf("endpoint got %d requests, want 2", len(requests))
+	}
+	if h := requests[1].header.Get("X-Voryn-Attempt"); h != "2" {
+		t.Errorf("X-Voryn-Attempt = %q on the retry, want 2", h)
+	}
+	if h := requests[1].header.Get("X-Voryn-Delivery"); h != delivery.ID.Hex() {
+		t.Errorf("retry has delivery ID %q, want %q", h, delivery.ID.Hex())
+	}
+	if !store.wasDeleted(delivery.ID) {
+		t.Error("retried webhook wasn't removed from the store")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  webhookBaseBackoff,
+		2:  2 * webhookBaseBackoff,
+		3:  4 * webhookBaseBackoff,
+		20: webhookMaxBackoff,
+	} {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestWebhookOverflowParks(t *testing.T) {
+	endpoint := newWebhookEndpoint(t)
+	configureWebhooks([]config.WebhookConfig{{URL: endpoint.URL}})
+	t.Cleanup(func() { configureWebhooks(nil) })
+
+	// Fill the queue as if the workers were stuck.
+	for len(webhookJobs) < cap(webhookJobs) {
+		webhookJobs <- webhookJob{}
+	}
+	t.Cleanup(func() {
+		for len(webhookJobs) > 0 {
+			<-webhookJobs
+		}
+	})
+
+	store := newRecordingWebhooks()
+	queueWebhooks(store, Event{Type: EventPartyExit, AccountID: "a1", Timestamp: time.Now().UTC()})
+	if n := webhookPending.Load(); n != 0 {
+		t.Errorf("%d deliveries pending after overflowing, want 0", n)
+	}
+
+	// The delivery waits in the store, due right away.
+	delivery, err := store.ClaimDelivery(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("overflowing delivery wasn't parked: %v", err)
+	}
+	if delivery.EventType != EventPartyExit || delivery.URL != endpoint.URL {
+		t.Errorf("parked %+v", delivery)
+	}
+
+	retryDueWebhooks(store)
+	if n := len(endpoint.received()); n != 1 {
+		t.Fatalf("endpoint got %d requests from the retry, want 1", n)
+	}
+	if !store.wasDeleted(delivery.ID) {
+		t.Error("retried webhook wasn't removed from the store")
+	}
+}
+
+func TestWebhookEventsGoToTheirHost(t *testing.T) {
+	endpoint := newWebhookEndpoint(t)
+	configureWebhooks([]config.WebhookConfig{{URL: endpoint.URL}})
+	t.Cleanup(func() { configureWebhooks(nil) })
+
+	a := &structs.Server{Domain: "a.example.com", Store: storage.NewMemory(storage.Seed{})}
+	b := &structs.Server{Domain: "b.example.com", Store: storage.NewMemory(storage.Seed{})}
+	webhookHosts.Store(NewHosts(a, b))
+	t.Cleanup(func() {
+		webhookHosts.Store(nil)
+		for len(webhookEvents) > 0 {
+			<-webhookEvents
+			webhookPending.Add(-1)
+		}
+		for len(webhookJobs) > 0 {
+			<-webhookJobs
+			webhookPending.Add(-1)
+		}
+	})
+
+	// Publishing only hands the event to the writer.
+	PublishEvent(Event{Type: EventSessionAuth, Domain: "b.example.com", AccountID: "b1"})
+	if _, err := b.Store.Webhooks.ClaimDelivery(context.Background(), 0); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("delivery was saved by the publishing goroutine: %v", err)
+	}
+
+	var event Event
+	select {
+	case event = <-webhookEvents:
+		webhookPending.Add(-1)
+	default:
+		t.Fatal("event wasn't handed to the webhook writer")
+	}
+	writeWebhookEvent(event)
+
+	job := takeWebhookJob(t)
+	if job.store != b.Store.Webhooks {
+		t.Error("job doesn't deliver through the event's host store")
+	}
+	if _, err := a.Store.Webhooks.ClaimDelivery(context.Background(), webhookLease); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("delivery was saved in another host's store: %v", err)
+	}
+	job.delivery.NextAttempt = time.Now().Add(-time.Second)
+	if err := b.Store.Webhooks.UpdateDelivery(context.Background(), &job.delivery); err != nil {
+		t.Fatalf("delivery wasn't saved in its host's store: %v", err)
+	}
+	if _, err := b.Store.Webhooks.ClaimDelivery(context.Background(), webhookLease); err != nil {
+		t.Errorf("delivery wasn't saved in its host's store: %v", err)
+	}
+}